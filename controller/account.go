@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Tenant accounts, enabled by setting ADMIN_API_KEY. Every route then wants
+// an API key (Authorization: Bearer <key>, X-API-Key or ?api_key= for the
+// pages and event streams of a browser). The admin key sees and manages
+// everything, an account key only the jobs, reports, received faxes,
+// broadcasts, webhooks, mailboxes, routes and cover templates of its account.
+// Files of an account are kept under its own directory in /files/upload,
+// /files/inbound, /output and /xml/hct. Without ADMIN_API_KEY the controller
+// runs as before, unauthenticated and unscoped.
+//
+// Quotas of an account, 0 is unlimited: concurrent calls or faxes (every
+// fax job not ended and every voip_patrol call left), pages sent per day
+// (UTC) and bytes stored.
+
+// owner of the records created by the admin key, or without authentication
+const ACCOUNT_ADMIN = ""
+
+var accountBucket = []byte("accounts")
+var accountKeyBucket = []byte("account_keys")
+var accountUsageBucket = []byte("account_usage")
+
+var accountIdRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+var errQuota = errors.New("quota exceeded")
+
+type accountContextKey struct{}
+
+type AccountQuota struct {
+	MaxCalls     int   `json:"max_calls"`     // concurrent calls or faxes
+	PagesPerDay  int   `json:"pages_per_day"` // pages sent
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+type Account struct {
+	Id            string       `json:"id"`
+	Name          string       `json:"name"`
+	Quota         AccountQuota `json:"quota"`
+	CoverTemplate string       `json:"cover_template,omitempty"` // cover template used when a request names none
+	WebhookSecret string       `json:"webhook_secret,omitempty"` // signs the webhook_url deliveries of its jobs
+	EmailSenders  []string     `json:"email_senders,omitempty"`  // addresses or @domains of the SMTP sessions authenticated with its keys, any when empty
+	Created       time.Time    `json:"created"`
+}
+
+// AccountKey is stored under the SHA-256 of the key, the key itself is only
+// returned when it is created.
+type AccountKey struct {
+	Prefix    string    `json:"prefix"`
+	AccountId string    `json:"account_id"`
+	Created   time.Time `json:"created"`
+	Key       string    `json:"key,omitempty"`
+}
+
+type AccountUsage struct {
+	Active       int   `json:"active"`      // calls or faxes
+	PagesToday   int   `json:"pages_today"` // pages sent today (UTC)
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+func accountEnabled() bool {
+	return config.AdminApiKey != ""
+}
+
+func accountKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func accountGet(id string) (Account, error) {
+	var a Account
+	found, err := storeGet(accountBucket, id, &a)
+	if err == nil && !found {
+		err = fmt.Errorf("account not found [%s]", id)
+	}
+	return a, err
+}
+
+func accountList() ([]Account, error) {
+	list := []Account{}
+	err := storeEach(accountBucket, func(b []byte) error {
+		var a Account
+		if err := json.Unmarshal(b, &a); err != nil {
+			fmt.Printf("invalid account record [%s]\n", err)
+			return nil
+		}
+		list = append(list, a)
+		return nil
+	})
+	return list, err
+}
+
+func accountCheck(a Account) error {
+	if !accountIdRe.MatchString(a.Id) {
+		return fmt.Errorf("invalid account id [%s], lower case letters, digits, - and _", a.Id)
+	}
+	if a.Quota.MaxCalls < 0 || a.Quota.PagesPerDay < 0 || a.Quota.StorageBytes < 0 {
+		return errors.New("invalid quota, 0 for unlimited")
+	}
+	if a.CoverTemplate != "" {
+		if _, err := faxCoverTemplateGet(a.Id, a.CoverTemplate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountKeyCreate makes a new key for the account.
+func accountKeyCreate(id string) (AccountKey, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return AccountKey{}, err
+	}
+	key := "hct_" + hex.EncodeToString(b)
+	k := AccountKey{Prefix: key[:12], AccountId: id, Created: time.Now()}
+	if err := storePut(accountKeyBucket, accountKeyHash(key), k); err != nil {
+		return k, err
+	}
+	k.Key = key
+	return k, nil
+}
+
+func accountKeyList(id string) ([]AccountKey, error) {
+	keys := []AccountKey{}
+	err := storeEach(accountKeyBucket, func(b []byte) error {
+		var k AccountKey
+		if err := json.Unmarshal(b, &k); err == nil && k.AccountId == id {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// accountKeyDelete removes the key of the account with the prefix, every key when empty.
+func accountKeyDelete(id string, prefix string) (int, error) {
+	n := 0
+	err := faxDb.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(accountKeyBucket)
+		if bk == nil {
+			return nil
+		}
+		var hashes [][]byte
+		bk.ForEach(func(h, b []byte) error {
+			var k AccountKey
+			if err := json.Unmarshal(b, &k); err == nil && k.AccountId == id && (prefix == "" || k.Prefix == prefix) {
+				hashes = append(hashes, append([]byte{}, h...))
+			}
+			return nil
+		})
+		for _, h := range hashes {
+			if err := bk.Delete(h); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// accountKeyFrom returns the API key of the request.
+func accountKeyFrom(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// accountAuth wraps a handler, the account of the key is given to it in the
+// request context.
+func accountAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !accountEnabled() {
+			h(w, r)
+			return
+		}
+		key := accountKeyFrom(r)
+		if key == "" {
+			http.Error(w, "missing API key", http.StatusUnauthorized)
+			return
+		}
+		id, err := accountForKey(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if id == ACCOUNT_ADMIN {
+			h(w, r)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), accountContextKey{}, id)))
+	}
+}
+
+// accountForKey returns the account of the API key, ACCOUNT_ADMIN for the
+// admin key.
+func accountForKey(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("invalid API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(config.AdminApiKey)) == 1 {
+		return ACCOUNT_ADMIN, nil
+	}
+	var k AccountKey
+	found, err := storeGet(accountKeyBucket, accountKeyHash(key), &k)
+	if err == nil && !found {
+		err = errors.New("invalid API key")
+	}
+	return k.AccountId, err
+}
+
+// accountOf returns the account of the request, ACCOUNT_ADMIN for the admin key.
+func accountOf(r *http.Request) string {
+	id, _ := r.Context().Value(accountContextKey{}).(string)
+	return id
+}
+
+// accountVisible tells if the request may see a record owned by the account.
+func accountVisible(r *http.Request, owner string) bool {
+	id := accountOf(r)
+	return id == ACCOUNT_ADMIN || id == owner
+}
+
+// accountDir returns the directory of the account under root, created when missing.
+func accountDir(root string, account string) string {
+	dir := filepath.Join(root, account)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		fmt.Printf("account[%s] directory error [%s]\n", account, err)
+	}
+	return dir
+}
+
+// accountOutputDir is the directory of the voip_patrol results of the account.
+func accountOutputDir(account string) string {
+	return accountDir(config.Paths.Output, account)
+}
+
+func accountRoots() []string {
+	return []string{config.Paths.Upload, config.Paths.Inbound, config.Paths.Output, config.Paths.Xml}
+}
+
+func accountStorage(account string) int64 {
+	var size int64
+	for _, root := range accountRoots() {
+		filepath.Walk(filepath.Join(root, account), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+func accountActive(account string) int {
+	active := cmdAccountCalls(account)
+	jobs, err := faxStoreList()
+	if err != nil {
+		fmt.Printf("account[%s] fax jobs error [%s]\n", account, err)
+	}
+	for _, job := range jobs {
+		if job.Account == account && !faxStateTerminal(job.State) {
+			active++
+		}
+	}
+	return active
+}
+
+func accountUsageKey(account string) []byte {
+	return []byte(account + "/" + time.Now().UTC().Format("2006-01-02"))
+}
+
+func accountPagesToday(account string) int {
+	pages := 0
+	storeGet(accountUsageBucket, string(accountUsageKey(account)), &pages)
+	return pages
+}
+
+func accountUsage(account string) AccountUsage {
+	return AccountUsage{Active: accountActive(account), PagesToday: accountPagesToday(account),
+	                    StorageBytes: accountStorage(account)}
+}
+
+// accountAdmit checks the account can start that many more calls or faxes
+// and still has storage left.
+func accountAdmit(account string, calls int) error {
+	if account == ACCOUNT_ADMIN {
+		return nil
+	}
+	a, err := accountGet(account)
+	if err != nil {
+		return err
+	}
+	if q := a.Quota.MaxCalls; q > 0 {
+		if active := accountActive(account); active+calls > q {
+			return fmt.Errorf("%w, %d calls or faxes active, %d requested, at most %d", errQuota, active, calls, q)
+		}
+	}
+	if q := a.Quota.StorageBytes; q > 0 {
+		if used := accountStorage(account); used >= q {
+			return fmt.Errorf("%w, %d bytes stored, at most %d", errQuota, used, q)
+		}
+	}
+	return nil
+}
+
+// accountPagesUse counts the pages about to be sent, refused past the daily quota.
+func accountPagesUse(account string, pages int) error {
+	if account == ACCOUNT_ADMIN {
+		return nil
+	}
+	a, err := accountGet(account)
+	if err != nil {
+		return err
+	}
+	return faxDb.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(accountUsageBucket)
+		if err != nil {
+			return err
+		}
+		used := 0
+		json.Unmarshal(bk.Get(accountUsageKey(account)), &used)
+		if q := a.Quota.PagesPerDay; q > 0 && used+pages > q {
+			return fmt.Errorf("%w, %d pages sent today, %d more, at most %d", errQuota, used, pages, q)
+		}
+		b, _ := json.Marshal(used + pages)
+		return bk.Put(accountUsageKey(account), b)
+	})
+}
+
+// accountError answers 429 to a quota error.
+func accountError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, errQuota) {
+		status = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// accountSenderMatch tells if the address is one of the senders, addresses
+// or @domains.
+func accountSenderMatch(from string, senders []string) bool {
+	from = strings.ToLower(from)
+	for _, s := range senders {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "" && (from == s || (strings.HasPrefix(s, "@") && strings.HasSuffix(from, s))) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountsHandler serves /accounts (GET list, POST create, admin key only),
+// GET, PUT, DELETE /accounts/{id} and GET, POST /accounts/{id}/keys,
+// DELETE /accounts/{id}/keys/{prefix}. An account key can read its own
+// account and manage its own keys.
+func accountsHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "accounts"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/accounts"), "/"), "/")
+	id := parts[0]
+	admin := accountOf(r) == ACCOUNT_ADMIN
+	if (id == "" && !admin) || (id != "" && !accountVisible(r, id)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case id == "" && r.Method == "GET":
+		list, err := accountList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case id == "" && r.Method == "POST":
+		var a Account
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, fmt.Sprintf("invalid account [%s]", err), http.StatusBadRequest)
+			return
+		}
+		if err := accountCheck(a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := accountGet(a.Id); err == nil {
+			http.Error(w, "account already exists ["+a.Id+"]", http.StatusConflict)
+			return
+		}
+		a.Created = time.Now()
+		if a.WebhookSecret == "" {
+			secret, err := webhookSecretNew()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			a.WebhookSecret = secret
+		}
+		if err := storePut(accountBucket, a.Id, a); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		k, err := accountKeyCreate(a.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("account[%s] created key[%s]\n", a.Id, k.Prefix)
+		// the key is only returned here
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"account": a, "key": k})
+	case len(parts) == 1 && r.Method == "GET":
+		a, err := accountGet(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"account": a, "usage": accountUsage(id)})
+	case len(parts) == 1 && r.Method == "PUT" && admin:
+		old, err := accountGet(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		var a Account
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, fmt.Sprintf("invalid account [%s]", err), http.StatusBadRequest)
+			return
+		}
+		a.Id = id
+		a.Created = old.Created
+		if a.WebhookSecret == "" {
+			a.WebhookSecret = old.WebhookSecret
+		}
+		if err := accountCheck(a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := storePut(accountBucket, a.Id, a); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+	case len(parts) == 1 && r.Method == "DELETE" && admin:
+		if _, err := accountGet(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		// the records and files of the account are kept, only its keys go
+		if _, err := accountKeyDelete(id, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := storeDelete(accountBucket, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("account[%s] deleted\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "keys" && r.Method == "GET":
+		keys, err := accountKeyList(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	case len(parts) == 2 && parts[1] == "keys" && r.Method == "POST":
+		if _, err := accountGet(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		k, err := accountKeyCreate(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("account[%s] key[%s] created\n", id, k.Prefix)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(k)
+	case len(parts) == 3 && parts[1] == "keys" && r.Method == "DELETE":
+		n, err := accountKeyDelete(id, parts[2])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "key not found ["+parts[2]+"]", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// accountTestRequest runs the request through accountAuth and returns the
+// status and the account seen by the handler.
+func accountTestRequest(r *http.Request) (int, string, *http.Request) {
+	var seen *http.Request
+	w := httptest.NewRecorder()
+	accountAuth(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	})(w, r)
+	if seen == nil {
+		return w.Code, "", nil
+	}
+	return w.Code, accountOf(seen), seen
+}
+
+func TestAccountOf(t *testing.T) {
+	testStore(t)
+	testConfig(t)
+	config.AdminApiKey = "admin-secret"
+	if err := storePut(accountBucket, "acme", Account{Id: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	k, err := accountKeyCreate("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		header  string
+		value   string
+		query   string
+		status  int
+		account string
+	}{
+		{"no key", "", "", "", http.StatusUnauthorized, ""},
+		{"bad key", "X-API-Key", "hct_nope", "", http.StatusUnauthorized, ""},
+		{"admin bearer", "Authorization", "Bearer admin-secret", "", http.StatusOK, ACCOUNT_ADMIN},
+		{"account header", "X-API-Key", k.Key, "", http.StatusOK, "acme"},
+		{"account bearer", "Authorization", "Bearer " + k.Key, "", http.StatusOK, "acme"},
+		{"account query", "", "", "?api_key=" + k.Key, http.StatusOK, "acme"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/faxes"+c.query, nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		status, account, _ := accountTestRequest(r)
+		if status != c.status || account != c.account {
+			t.Errorf("%s: status %d account [%s], expected %d [%s]", c.name, status, account, c.status, c.account)
+		}
+	}
+
+	// a deleted key is refused
+	if _, err := accountKeyDelete("acme", k.Prefix); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/faxes", nil)
+	r.Header.Set("X-API-Key", k.Key)
+	if status, _, _ := accountTestRequest(r); status != http.StatusUnauthorized {
+		t.Errorf("deleted key: status %d, expected 401", status)
+	}
+}
+
+func TestAccountVisible(t *testing.T) {
+	testStore(t)
+	testConfig(t)
+	config.AdminApiKey = "admin-secret"
+	for _, id := range []string{"acme", "other"} {
+		if err := storePut(accountBucket, id, Account{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k, err := accountKeyCreate("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/faxes", nil)
+	r.Header.Set("X-API-Key", k.Key)
+	_, _, acme := accountTestRequest(r)
+	r = httptest.NewRequest("GET", "/faxes", nil)
+	r.Header.Set("X-API-Key", "admin-secret")
+	_, _, admin := accountTestRequest(r)
+	if acme == nil || admin == nil {
+		t.Fatal("request refused")
+	}
+	cases := []struct {
+		r       *http.Request
+		owner   string
+		visible bool
+	}{
+		{acme, "acme", true},
+		{acme, "other", false},
+		{acme, ACCOUNT_ADMIN, false},
+		{admin, "acme", true},
+		{admin, ACCOUNT_ADMIN, true},
+	}
+	for _, c := range cases {
+		if v := accountVisible(c.r, c.owner); v != c.visible {
+			t.Errorf("account [%s] owner [%s]: visible %t, expected %t", accountOf(c.r), c.owner, v, c.visible)
+		}
+	}
+
+	// without ADMIN_API_KEY there are no accounts, every request is the admin
+	config.AdminApiKey = ""
+	status, account, open := accountTestRequest(httptest.NewRequest("GET", "/faxes", nil))
+	if status != http.StatusOK || account != ACCOUNT_ADMIN || !accountVisible(open, "acme") {
+		t.Errorf("accounts disabled: status %d account [%s]", status, account)
+	}
+}
+
+func TestResHandlerAccount(t *testing.T) {
+	testConfig(t)
+	config.AdminApiKey = ""
+	config.Paths.Output = t.TempDir()
+	for _, c := range []struct {
+		query  string
+		status int
+	}{
+		{"?id=x", http.StatusOK},
+		{"?id=x&account=acme", http.StatusOK},
+		{"?id=x&account=..", http.StatusBadRequest},
+		{"?id=x&account=a/b", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		accountAuth(resHandler)(w, httptest.NewRequest("GET", "/res"+c.query, nil))
+		if w.Code != c.status {
+			t.Errorf("/res%s: status %d, expected %d [%s]", c.query, w.Code, c.status, w.Body.String())
+		}
+	}
+}
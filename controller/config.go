@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration of the controller, loaded once at startup from the defaults,
+// the YAML file (-config or CONFIG_FILE), the environment and the command line,
+// each source overriding the previous one. A setting has a YAML key, an
+// environment variable and a flag named after the key: rmq.ip, RMQ_IP, -rmq.ip.
+
+const CONFIG_REDACTED = "********"
+const CONFIG_PORT_RANGE_MAX = 65000
+
+type ConfigRmq struct {
+	Ip            string `yaml:"ip" env:"RMQ_IP" required:"true"`
+	Username      string `yaml:"username" env:"RMQ_USERNAME"`
+	Password      string `yaml:"password" env:"RMQ_PASSWORD" secret:"true"`
+	SubQCustomer  string `yaml:"sub_q_customer" env:"RMQ_SUB_Q_CUSTOMER" required:"true"`
+	SubQProvider  string `yaml:"sub_q_provider" env:"RMQ_SUB_Q_PROVIDER" required:"true"`
+	SubKeyCommand string `yaml:"sub_key_command" env:"RMQ_SUB_KEY_COMMAND"`
+	PubExchange   string `yaml:"pub_exchange" env:"RMQ_PUB_EXCHANGE" required:"true"`
+	PubKeySummary string `yaml:"pub_key_summary" env:"RMQ_PUB_KEY_SUMMARY" required:"true"`
+	PubKeyDetails string `yaml:"pub_key_details" env:"RMQ_PUB_KEY_DETAILS" required:"true"`
+	PubKeyFax     string `yaml:"pub_key_fax" env:"RMQ_PUB_KEY_FAX"`
+}
+
+type ConfigVp struct {
+	ServerIp   string `yaml:"server_ip" env:"VP_SERVER_IP" required:"true"`
+	ServerPort int    `yaml:"server_port" env:"VP_SERVER_PORT"`
+	LogLevel   int    `yaml:"log_level" env:"VP_LOG_LEVEL"`
+}
+
+type ConfigNet struct {
+	LocalIp           string `yaml:"local_ip" env:"LOCAL_IP" required:"true"`
+	PublicIpCustomer  string `yaml:"public_ip_customer" env:"PUBLIC_IP_CUSTOMER"`
+	PrivateIpCustomer string `yaml:"private_ip_customer" env:"PRIVATE_IP_CUSTOMER"`
+	PublicIpProvider  string `yaml:"public_ip_provider" env:"PUBLIC_IP_PROVIDER"`
+	PrivateIpProvider string `yaml:"private_ip_provider" env:"PRIVATE_IP_PROVIDER"`
+}
+
+// ConfigPorts are the voip_patrol ports, one SIP port and a block of 200 RTP
+// ports per exec.
+type ConfigPorts struct {
+	SipStart int `yaml:"sip_start" env:"SIP_PORT_START"`
+	SipEnd   int `yaml:"sip_end" env:"SIP_PORT_END"`
+	RtpStart int `yaml:"rtp_start" env:"RTP_PORT_START"`
+	RtpEnd   int `yaml:"rtp_end" env:"RTP_PORT_END"`
+}
+
+// ConfigPaths are the directories, Files is shared with the FreeSWITCH
+// container, the static dialplan (00_inbound_did.xml) writes in /files/inbound.
+type ConfigPaths struct {
+	Output  string `yaml:"output" env:"OUTPUT_DIR"`       // voip_patrol results, shared with hct_client
+	Xml     string `yaml:"xml" env:"XML_DIR"`             // voip_patrol scenarios, shared with hct_client
+	Files   string `yaml:"files" env:"FILES_DIR"`         // test documents, the route directories are under it
+	Inbound string `yaml:"inbound" env:"FAX_INBOUND_DIR"` // received faxes
+	Upload  string `yaml:"upload" env:"UPLOAD_DIR"`       // documents to send
+	Db      string `yaml:"db" env:"FAX_DB"`               // fax store
+}
+
+type ConfigEsl struct {
+	Host     string `yaml:"host" env:"ESL_HOST"`
+	Port     int    `yaml:"port" env:"ESL_PORT"`
+	Password string `yaml:"password" env:"ESL_PASSWORD" secret:"true"`
+}
+
+// ConfigDialplan limits /dialplan to FreeSWITCH: its addresses (IPs or CIDRs,
+// comma separated) and, when set, the password of the xml_curl
+// gateway-credentials.
+type ConfigDialplan struct {
+	Allow  string `yaml:"allow" env:"DIALPLAN_ALLOW"`
+	Secret string `yaml:"secret" env:"DIALPLAN_SECRET" secret:"true"`
+}
+
+type ConfigSmtp struct {
+	Host     string `yaml:"host" env:"SMTP_HOST"`
+	Port     int    `yaml:"port" env:"SMTP_PORT"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD" secret:"true"`
+	From     string `yaml:"from" env:"SMTP_FROM"`
+}
+
+type ConfigFaxmail struct {
+	Listen       string `yaml:"listen" env:"FAXMAIL_LISTEN"`
+	Domain       string `yaml:"domain" env:"FAXMAIL_DOMAIN"`
+	Gateway      string `yaml:"gateway" env:"FAXMAIL_GATEWAY"`
+	Senders      string `yaml:"senders" env:"FAXMAIL_SENDERS"`
+	Cover        bool   `yaml:"cover" env:"FAXMAIL_COVER"`
+	TlsCert      string `yaml:"tls_cert" env:"FAXMAIL_TLS_CERT"`
+	TlsKey       string `yaml:"tls_key" env:"FAXMAIL_TLS_KEY"`
+	InsecureAuth bool   `yaml:"insecure_auth" env:"FAXMAIL_INSECURE_AUTH"`
+}
+
+type Config struct {
+	Port          int            `yaml:"port" env:"PORT"` // HTTP API
+	MaxCalls      int            `yaml:"max_calls" env:"MAX_CALLS"`
+	AdminApiKey   string         `yaml:"admin_api_key" env:"ADMIN_API_KEY" secret:"true"`
+	WebhookSecret string         `yaml:"webhook_secret" env:"WEBHOOK_SECRET" secret:"true"`
+	Receiver      string         `yaml:"receiver_url" env:"RECEIVER_URL"`                        // fax test: the receiving controller
+	ReceiverKey   string         `yaml:"receiver_api_key" env:"RECEIVER_API_KEY" secret:"true"` // fax test: key on RECEIVER_URL
+	WsOrigins     string         `yaml:"ws_origins" env:"WS_ORIGINS"` // other origins of the progress WebSocket, comma separated
+	Rmq           ConfigRmq      `yaml:"rmq"`
+	Vp            ConfigVp       `yaml:"vp"`
+	Net           ConfigNet      `yaml:"net"`
+	Ports         ConfigPorts    `yaml:"ports"`
+	Paths         ConfigPaths    `yaml:"paths"`
+	Esl           ConfigEsl      `yaml:"esl"`
+	Dialplan      ConfigDialplan `yaml:"dialplan"`
+	Smtp          ConfigSmtp     `yaml:"smtp"`
+	Faxmail       ConfigFaxmail  `yaml:"faxmail"`
+}
+
+// ConfigSetting is a setting as shown on /config.
+type ConfigSetting struct {
+	Key    string      `json:"key"`
+	Env    string      `json:"env"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"` // default, file, env or flag
+}
+
+var (
+	config Config
+	configFile string
+	configSources = make(map[string]string)
+)
+
+func configDefault() Config {
+	var c Config
+	c.Port = 8090
+	c.MaxCalls = 20
+	c.Vp.ServerPort = 5060
+	c.Vp.LogLevel = 5
+	c.Ports = ConfigPorts{SipStart: 15060, SipEnd: 15159, RtpStart: 40000, RtpEnd: 59999}
+	c.Paths = ConfigPaths{Output: "/output", Xml: "/xml/hct", Files: "/files", Inbound: "/files/inbound",
+	                      Upload: "/files/upload", Db: "/files/fax.db"}
+	c.Esl = ConfigEsl{Host: "127.0.0.1", Port: 8021, Password: "ClueCon"}
+	c.Dialplan.Allow = "127.0.0.1,::1"
+	c.Smtp.Port = 25
+	c.Faxmail.Cover = true
+	return c
+}
+
+type configField struct {
+	key      string
+	env      string
+	secret   bool
+	required bool
+	v        reflect.Value
+}
+
+// configFields walks the settings of the struct, the keys are the YAML path.
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("yaml")
+		if f.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(i), key+".")...)
+			continue
+		}
+		fields = append(fields, configField{key, f.Tag.Get("env"), f.Tag.Get("secret") == "true",
+		                                    f.Tag.Get("required") == "true", v.Field(i)})
+	}
+	return fields
+}
+
+func configSet(f configField, s string) error {
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid %s [%s], expected a number", f.key, s)
+		}
+		f.v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid %s [%s], expected true or false", f.key, s)
+		}
+		f.v.SetBool(b)
+	}
+	return nil
+}
+
+// configLoad sets config from the command line arguments, the flags come
+// before the HTTP port, which can still be given alone as the first argument.
+// All the missing and invalid values are returned as one error.
+func configLoad(args []string) error {
+	c := configDefault()
+	sources := make(map[string]string)
+	fields := configFields(reflect.ValueOf(&c).Elem(), "")
+	for _, f := range fields {
+		sources[f.key] = "default"
+	}
+
+	fs := flag.NewFlagSet("hct_controller", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file (CONFIG_FILE)")
+	flags := make(map[string]*string)
+	for _, f := range fields {
+		usage := f.env
+		if f.required {
+			usage += ", required"
+		}
+		flags[f.key] = fs.String(f.key, "", usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file != "" {
+		b, err := os.ReadFile(*file)
+		if err != nil {
+			return fmt.Errorf("config file: %w", err)
+		}
+		before := make(map[string]interface{})
+		for _, f := range fields {
+			before[f.key] = f.v.Interface()
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config file %s: %w", *file, err)
+		}
+		for _, f := range fields {
+			if f.v.Interface() != before[f.key] {
+				sources[f.key] = "file"
+			}
+		}
+	}
+
+	var errs []string
+	for _, f := range fields {
+		if s, found := os.LookupEnv(f.env); found && s != "" {
+			if err := configSet(f, s); err != nil {
+				errs = append(errs, err.Error()+" from "+f.env)
+				continue
+			}
+			sources[f.key] = "env"
+		}
+	}
+	setFlags := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		setFlags[fl.Name] = true
+	})
+	for _, f := range fields {
+		if setFlags[f.key] {
+			if err := configSet(f, *flags[f.key]); err != nil {
+				errs = append(errs, err.Error()+" from -"+f.key)
+				continue
+			}
+			sources[f.key] = "flag"
+		}
+	}
+	if fs.NArg() > 0 && !setFlags["port"] {
+		port, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid port argument [%s]", fs.Arg(0)))
+		} else {
+			c.Port = port
+			sources["port"] = "flag"
+		}
+	}
+
+	for _, f := range fields {
+		if f.required && f.v.Kind() == reflect.String && f.v.String() == "" {
+			errs = append(errs, fmt.Sprintf("missing %s, set %s or -%s", f.key, f.env, f.key))
+		}
+	}
+	errs = append(errs, configCheck(c)...)
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	config = c
+	configSources = sources
+	configFile = *file
+	return nil
+}
+
+func configPortCheck(name string, port int, min int, max int) string {
+	if port < min || port > max {
+		return fmt.Sprintf("invalid %s [%d], expected %d to %d", name, port, min, max)
+	}
+	return ""
+}
+
+func configPathCheck(name string, path string) string {
+	if !filepath.IsAbs(path) {
+		return fmt.Sprintf("invalid %s [%s], expected an absolute path", name, path)
+	}
+	return ""
+}
+
+// configCheck returns the invalid values.
+func configCheck(c Config) []string {
+	var errs []string
+	add := func(s string) {
+		if s != "" {
+			errs = append(errs, s)
+		}
+	}
+	add(configPortCheck("port", c.Port, 1, 65535))
+	add(configPortCheck("vp.server_port", c.Vp.ServerPort, 1, 65535))
+	// the ranges stay clear of 65535, the uint16 port loops would wrap
+	add(configPortCheck("ports.sip_start", c.Ports.SipStart, 1024, CONFIG_PORT_RANGE_MAX))
+	add(configPortCheck("ports.sip_end", c.Ports.SipEnd, 1024, CONFIG_PORT_RANGE_MAX))
+	add(configPortCheck("ports.rtp_start", c.Ports.RtpStart, 1024, CONFIG_PORT_RANGE_MAX))
+	add(configPortCheck("ports.rtp_end", c.Ports.RtpEnd, 1024, CONFIG_PORT_RANGE_MAX))
+	add(configPortCheck("esl.port", c.Esl.Port, 1, 65535))
+	add(configPortCheck("smtp.port", c.Smtp.Port, 1, 65535))
+	if c.MaxCalls < 1 {
+		add(fmt.Sprintf("invalid max_calls [%d], expected at least 1", c.MaxCalls))
+	}
+	if c.Vp.LogLevel < 0 || c.Vp.LogLevel > 10 {
+		add(fmt.Sprintf("invalid vp.log_level [%d], expected 0 to 10", c.Vp.LogLevel))
+	}
+	if c.Ports.SipEnd < c.Ports.SipStart {
+		add(fmt.Sprintf("invalid sip port range %d !<= %d", c.Ports.SipStart, c.Ports.SipEnd))
+	}
+	if c.Ports.RtpEnd - c.Ports.RtpStart < 199 {
+		add(fmt.Sprintf("invalid rtp port range %d to %d, expected at least 200 ports", c.Ports.RtpStart, c.Ports.RtpEnd))
+	}
+	add(configPathCheck("paths.output", c.Paths.Output))
+	add(configPathCheck("paths.xml", c.Paths.Xml))
+	add(configPathCheck("paths.files", c.Paths.Files))
+	add(configPathCheck("paths.inbound", c.Paths.Inbound))
+	add(configPathCheck("paths.upload", c.Paths.Upload))
+	add(configPathCheck("paths.db", c.Paths.Db))
+	if _, err := faxDialplanNets(c.Dialplan.Allow); err != nil {
+		add(fmt.Sprintf("invalid dialplan.allow [%s], %s", c.Dialplan.Allow, err))
+	}
+	if (c.Faxmail.TlsCert == "") != (c.Faxmail.TlsKey == "") {
+		add("faxmail.tls_cert and faxmail.tls_key go together")
+	}
+	return errs
+}
+
+// configSettings returns the effective settings, the secrets redacted.
+func configSettings() []ConfigSetting {
+	c := config
+	var res []ConfigSetting
+	for _, f := range configFields(reflect.ValueOf(&c).Elem(), "") {
+		value := f.v.Interface()
+		if f.secret && f.v.String() != "" {
+			value = CONFIG_REDACTED
+		}
+		res = append(res, ConfigSetting{f.key, f.env, value, configSources[f.key]})
+	}
+	return res
+}
+
+// configHandler serves GET /config, admin key only when accounts are enabled.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "config"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if accountOf(r) != ACCOUNT_ADMIN {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		File     string          `json:"file,omitempty"`
+		Settings []ConfigSetting `json:"settings"`
+	}{configFile, configSettings()})
+}
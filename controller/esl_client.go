@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FreeSWITCH event socket (mod_event_socket) inbound client.
+// One connection is kept open for the life of the controller, commands are
+// serialized and their replies matched in order, events are dispatched to
+// the subscriber registered for the channel UUID (or bgapi Job-UUID).
+// FreeSWITCH replies in order, the reply of a command that timed out is
+// skipped when it comes so the next command does not read it.
+
+const ESL_EVENTS = "CHANNEL_PROGRESS CHANNEL_PROGRESS_MEDIA CHANNEL_ANSWER CHANNEL_HANGUP_COMPLETE BACKGROUND_JOB CUSTOM " +
+	"spandsp::txfaxnegociateresult spandsp::rxfaxnegociateresult " +
+	"spandsp::txfaxpageresult spandsp::rxfaxpageresult " +
+	"spandsp::txfaxresult spandsp::rxfaxresult"
+
+var (
+	eslConn net.Conn
+	eslConnMu sync.Mutex
+	eslCmdMu sync.Mutex
+	eslReplies = make(chan EslEvent, 1)
+	eslRepliesMu sync.Mutex
+	eslRepliesSkip int // replies of the commands that timed out, still to come
+	eslDown = make(chan struct{}) // closed when the connection drops
+	eslHandlers = make(map[string]chan EslEvent)
+	eslHandlersMu sync.Mutex
+)
+
+type EslEvent struct {
+	Headers map[string]string
+	Body    string
+}
+
+func (e EslEvent) Get(key string) string {
+	return e.Headers[key]
+}
+
+// Name returns the event name, using the subclass for CUSTOM events.
+func (e EslEvent) Name() string {
+	if e.Headers["Event-Name"] == "CUSTOM" {
+		return e.Headers["Event-Subclass"]
+	}
+	return e.Headers["Event-Name"]
+}
+
+func (e EslEvent) ReplyOk() bool {
+	return !strings.HasPrefix(e.Headers["Reply-Text"], "-ERR") && !strings.HasPrefix(e.Body, "-ERR")
+}
+
+func eslReadMessage(r *bufio.Reader) (EslEvent, error) {
+	ev := EslEvent{Headers: make(map[string]string)}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ev, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(ev.Headers) == 0 {
+				continue
+			}
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		ev.Headers[kv[0]] = strings.TrimSpace(kv[1])
+	}
+	if l, found := ev.Headers["Content-Length"]; found {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return ev, fmt.Errorf("invalid Content-Length [%s]", l)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return ev, err
+		}
+		ev.Body = string(b)
+	}
+	return ev, nil
+}
+
+// eslParsePlainEvent parses a text/event-plain body, values are url encoded.
+func eslParsePlainEvent(s string) EslEvent {
+	ev := EslEvent{Headers: make(map[string]string)}
+	parts := strings.SplitN(s, "\n\n", 2)
+	for _, line := range strings.Split(parts[0], "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			v = strings.TrimSpace(kv[1])
+		}
+		ev.Headers[kv[0]] = v
+	}
+	if len(parts) == 2 {
+		ev.Body = parts[1]
+	}
+	return ev
+}
+
+// eslDispatch delivers the event to the subscriber of its channel UUID (or
+// Job-UUID), events of channels nobody follows go to the subscriber of the event name.
+func eslDispatch(ev EslEvent) {
+	key := ev.Get("Unique-ID")
+	if ev.Get("Event-Name") == "BACKGROUND_JOB" {
+		key = ev.Get("Job-UUID")
+	}
+	eslHandlersMu.Lock()
+	ch, found := eslHandlers[key]
+	if !found {
+		ch, found = eslHandlers[ev.Name()]
+	}
+	eslHandlersMu.Unlock()
+	if !found {
+		return
+	}
+	select {
+	case ch <- ev:
+	default:
+		fmt.Printf("esl: event queue full uuid[%s] dropping [%s]\n", key, ev.Name())
+	}
+}
+
+// eslSubscribe returns one channel receiving the events of all the keys,
+// a key is either a channel UUID or an event name.
+func eslSubscribe(keys ...string) chan EslEvent {
+	ch := make(chan EslEvent, 64)
+	eslHandlersMu.Lock()
+	for _, k := range keys {
+		eslHandlers[k] = ch
+	}
+	eslHandlersMu.Unlock()
+	return ch
+}
+
+func eslUnsubscribe(keys ...string) {
+	eslHandlersMu.Lock()
+	for _, k := range keys {
+		delete(eslHandlers, k)
+	}
+	eslHandlersMu.Unlock()
+}
+
+// eslDisconnected returns a channel closed when the current connection drops,
+// the calls waiting for their events then end.
+func eslDisconnected() chan struct{} {
+	eslConnMu.Lock()
+	defer eslConnMu.Unlock()
+	return eslDown
+}
+
+// eslReply hands the reply to the waiting command, unless it is the late
+// reply of a command that timed out.
+func eslReply(ev EslEvent) {
+	eslRepliesMu.Lock()
+	defer eslRepliesMu.Unlock()
+	if eslRepliesSkip > 0 {
+		eslRepliesSkip--
+		fmt.Printf("esl: late reply dropped [%s]\n", ev.Get("Reply-Text"))
+		return
+	}
+	select {
+	case eslReplies <- ev:
+	default:
+	}
+}
+
+// eslRepliesReset forgets the replies of the previous connection.
+func eslRepliesReset() {
+	eslRepliesMu.Lock()
+	defer eslRepliesMu.Unlock()
+	eslRepliesSkip = 0
+	select {
+	case <-eslReplies:
+	default:
+	}
+}
+
+func eslConnect() (*bufio.Reader, error) {
+	addr := net.JoinHostPort(config.Esl.Host, strconv.Itoa(config.Esl.Port))
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	ev, err := eslReadMessage(r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ev.Get("Content-Type") != "auth/request" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting [%s]", ev.Get("Content-Type"))
+	}
+	fmt.Fprintf(conn, "auth %s\n\n", config.Esl.Password)
+	ev, err = eslReadMessage(r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !ev.ReplyOk() {
+		conn.Close()
+		return nil, fmt.Errorf("authentication failed [%s]", ev.Get("Reply-Text"))
+	}
+	fmt.Fprintf(conn, "event plain %s\n\n", ESL_EVENTS)
+	ev, err = eslReadMessage(r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !ev.ReplyOk() {
+		conn.Close()
+		return nil, fmt.Errorf("event subscription failed [%s]", ev.Get("Reply-Text"))
+	}
+	eslConnMu.Lock()
+	eslConn = conn
+	eslConnMu.Unlock()
+	fmt.Printf("esl: connected to [%s]\n", addr)
+	return r, nil
+}
+
+// eslRun keeps the event socket connected and reads from it, reconnecting on errors.
+func eslRun() {
+	for {
+		r, err := eslConnect()
+		if err != nil {
+			fmt.Printf("esl: connection error [%s]\n", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for {
+			ev, err := eslReadMessage(r)
+			if err != nil {
+				fmt.Printf("esl: read error [%s]\n", err)
+				break
+			}
+			switch ev.Get("Content-Type") {
+			case "command/reply", "api/response":
+				eslReply(ev)
+			case "text/event-plain":
+				eslDispatch(eslParsePlainEvent(ev.Body))
+			case "text/disconnect-notice":
+				fmt.Printf("esl: disconnect notice\n")
+			}
+		}
+		eslConnMu.Lock()
+		eslConn.Close()
+		eslConn = nil
+		close(eslDown)
+		eslDown = make(chan struct{})
+		eslConnMu.Unlock()
+		eslRepliesReset()
+		time.Sleep(time.Second)
+	}
+}
+
+func eslCommand(cmd string) (EslEvent, error) {
+	eslCmdMu.Lock()
+	defer eslCmdMu.Unlock()
+	eslConnMu.Lock()
+	conn := eslConn
+	eslConnMu.Unlock()
+	if conn == nil {
+		return EslEvent{}, errors.New("event socket not connected")
+	}
+	fmt.Printf("esl: >> %s\n", strings.Split(cmd, "\n")[0])
+	if _, err := fmt.Fprintf(conn, "%s\n\n", cmd); err != nil {
+		return EslEvent{}, err
+	}
+	select {
+	case ev := <-eslReplies:
+		if !ev.ReplyOk() {
+			return ev, fmt.Errorf("esl command failed [%s%s]", ev.Get("Reply-Text"), strings.TrimSpace(ev.Body))
+		}
+		return ev, nil
+	case <-time.After(10 * time.Second):
+		eslRepliesMu.Lock()
+		defer eslRepliesMu.Unlock()
+		select {
+		case <-eslReplies: // came with the timeout
+		default:
+			eslRepliesSkip++
+		}
+		return EslEvent{}, errors.New("esl command timeout")
+	}
+}
+
+// eslBgapi runs a background api command, the result comes back as a
+// BACKGROUND_JOB event dispatched to the subscriber of jobUuid.
+func eslBgapi(cmd string, jobUuid string) error {
+	_, err := eslCommand(fmt.Sprintf("bgapi %s\nJob-UUID: %s", cmd, jobUuid))
+	return err
+}
+
+func eslApi(cmd string) (string, error) {
+	ev, err := eslCommand("api " + cmd)
+	return strings.TrimSpace(ev.Body), err
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+// A fax call is hung up by FreeSWITCH when not answered after
+// FAX_ORIGINATE_TIMEOUT or still up after FAX_CALL_MAX_DURATION, eslSendFax
+// gives up waiting for the hangup a little later.
+const FAX_ORIGINATE_TIMEOUT = 60 * time.Second
+const FAX_CALL_MAX_DURATION = 30 * time.Minute
+const FAX_CALL_WAIT = FAX_ORIGINATE_TIMEOUT + FAX_CALL_MAX_DURATION + time.Minute
+
+type FaxRequest struct {
+	Destination     string          `json:"destination"`      // number, user@host[:port] or a full sofia dial string
+	Gateway         string          `json:"gateway"`          // sofia gateway used to reach a number
+	Profile         string          `json:"profile"`          // sofia profile, default "external"
+	CallerIdNumber  string          `json:"caller_id_number"`
+	CallerIdName    string          `json:"caller_id_name"`
+	Ident           string          `json:"ident"`            // TSI / local station identifier
+	Header          string          `json:"header"`           // page header text
+	Resolution      string          `json:"resolution"`       // standard, fine (default) or superfine
+	PageSize        string          `json:"page_size"`        // a4, letter (default) or legal
+	Tag             string          `json:"tag"`              // sent in X-Fax-Tag, lets the receiving side find the fax
+	Codec           string          `json:"codec"`            // PCMU (default) or PCMA
+	T38             *bool           `json:"t38"`              // request T.38, spandsp.conf default when not set
+	Ecm             *bool           `json:"ecm"`
+	V17             *bool           `json:"v17"`
+	MaxRate         int             `json:"max_rate"`         // 14400 or 9600 (V.17 disabled)
+	Retry           *FaxRetryPolicy `json:"retry"`            // sent once when not set
+	ContinuedMarker bool            `json:"continued_marker"` // stamp "continued" on the first page a retry resends
+	WebhookUrl      string          `json:"webhook_url"`      // called on dialing, completed, failed, cancelled
+	Email           *FaxEmail       `json:"email,omitempty"`  // the email the job came from, answered when the job ends
+	Cover           *FaxCover       `json:"cover,omitempty"`  // cover page put in front of the document
+	NotBefore       time.Time       `json:"not_before"`       // not dialed before
+	Window          *FaxWindow      `json:"window,omitempty"` // only dialed inside this delivery window
+	Document        string          `json:"document"`         // base64 encoded document (JSON requests only)
+	DocumentName    string          `json:"document_name"`
+}
+
+type FaxJob struct {
+	Id          string        `json:"id"`
+	Account     string        `json:"account,omitempty"`
+	State       string        `json:"state"`
+	Request     FaxRequest    `json:"request"`
+	Document    string        `json:"document"`
+	BroadcastId string        `json:"broadcast_id,omitempty"`
+	Parts       []string      `json:"parts,omitempty"` // documents sent after Document, the attachments of an email
+	Tiff        string        `json:"tiff,omitempty"`
+	TiffInfo    *FaxTiffInfo  `json:"tiff_info,omitempty"`
+	CallUuid    string        `json:"call_uuid,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Report      *FaxReport    `json:"report,omitempty"`
+	Attempts    []FaxAttempt  `json:"attempts"`
+	NextAttempt time.Time     `json:"next_attempt,omitempty"`
+	Created     time.Time     `json:"created"`
+	Updated     time.Time     `json:"updated"`
+	History     []FaxJobEvent `json:"history"`
+}
+
+// faxDefaultRequest is used by /upload, it sends to the fax test extension of the voip_patrol server.
+func faxDefaultRequest() FaxRequest {
+	return FaxRequest{Destination: "fax@"+config.Vp.ServerIp+":"+strconv.Itoa(config.Vp.ServerPort)}
+}
+
+// faxVar quotes a channel variable value for the originate {} block.
+func faxVar(name string, value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == '\'' || r == '{' || r == '}' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, value)
+	return fmt.Sprintf("%s='%s'", name, value)
+}
+
+// the parts of the dial string, it goes on the bgapi line of the event socket
+// and must not carry spaces, line breaks or {} variables
+var faxDialRe = regexp.MustCompile(`^[A-Za-z0-9_.@:+-]+$`)
+var faxDialSofiaRe = regexp.MustCompile(`^sofia/[A-Za-z0-9_.@:+/-]+$`)
+
+func faxDialString(req FaxRequest) (string, error) {
+	dest := strings.TrimPrefix(strings.Trim(req.Destination, " "), "sip:")
+	if dest == "" {
+		return "", errors.New("missing destination")
+	}
+	if strings.HasPrefix(dest, "sofia/") {
+		if !faxDialSofiaRe.MatchString(dest) {
+			return "", fmt.Errorf("invalid destination [%q]", dest)
+		}
+		return dest, nil
+	}
+	if !faxDialRe.MatchString(dest) {
+		return "", fmt.Errorf("invalid destination [%q]", dest)
+	}
+	if req.Gateway != "" && !faxDialRe.MatchString(req.Gateway) {
+		return "", fmt.Errorf("invalid gateway [%q]", req.Gateway)
+	}
+	if req.Profile != "" && !faxDialRe.MatchString(req.Profile) {
+		return "", fmt.Errorf("invalid profile [%q]", req.Profile)
+	}
+	if req.Gateway != "" {
+		return "sofia/gateway/"+req.Gateway+"/"+dest, nil
+	}
+	if !strings.Contains(dest, "@") {
+		return "", fmt.Errorf("destination [%s] is a number, a gateway is required", dest)
+	}
+	profile := req.Profile
+	if profile == "" {
+		profile = "external"
+	}
+	return "sofia/"+profile+"/"+dest, nil
+}
+
+// faxTransportCheck validates the codec and modem settings of the request.
+func faxTransportCheck(req *FaxRequest) error {
+	req.Codec = strings.ToUpper(req.Codec)
+	if req.Codec == "" {
+		req.Codec = "PCMU"
+	}
+	if req.Codec != "PCMU" && req.Codec != "PCMA" {
+		return fmt.Errorf("invalid codec [%s], expected PCMU or PCMA", req.Codec)
+	}
+	switch req.MaxRate {
+	case 0, 14400:
+	case 9600:
+		if req.V17 != nil && *req.V17 {
+			return errors.New("max rate 9600 requires V.17 disabled")
+		}
+	default:
+		// spandsp only lets us choose the modems, V.27ter/V.29 are always offered
+		return fmt.Errorf("invalid max rate [%d], expected 14400 or 9600", req.MaxRate)
+	}
+	return nil
+}
+
+// faxTransportVars returns the spandsp channel variables of the request, they
+// are also sent in X-Fax-* headers so the receiving dialplan can mirror them.
+func faxTransportVars(req FaxRequest) []string {
+	var vars []string
+	set := func(name string, header string, value bool) {
+		v := fmt.Sprintf("%t", value)
+		vars = append(vars, name+"="+v, "sip_h_"+header+"="+v)
+	}
+	if req.T38 != nil {
+		set("fax_enable_t38", "X-Fax-T38", *req.T38)
+		vars = append(vars, fmt.Sprintf("fax_enable_t38_request=%t", *req.T38))
+	}
+	if req.Ecm != nil {
+		set("fax_use_ecm", "X-Fax-ECM", *req.Ecm)
+	}
+	if req.MaxRate == 9600 {
+		set("fax_disable_v17", "X-Fax-Disable-V17", true)
+	} else if req.V17 != nil {
+		set("fax_disable_v17", "X-Fax-Disable-V17", !*req.V17)
+	}
+	return vars
+}
+
+// faxOriginate builds the originate command, the spandsp settings of the
+// request are set as channel variables and override spandsp.conf.xml.
+func faxOriginate(req FaxRequest, callUuid string, tiff string) (string, error) {
+	dial, err := faxDialString(req)
+	if err != nil {
+		return "", err
+	}
+	codec := req.Codec
+	if codec == "" {
+		codec = "PCMU"
+	}
+	vars := []string{"origination_uuid="+callUuid, "absolute_codec_string='"+codec+"'",
+	                 fmt.Sprintf("originate_timeout=%d", int(FAX_ORIGINATE_TIMEOUT.Seconds())),
+	                 fmt.Sprintf("execute_on_answer='sched_hangup +%d ALLOTTED_TIMEOUT'", int(FAX_CALL_MAX_DURATION.Seconds()))}
+	vars = append(vars, faxTransportVars(req)...)
+	if req.CallerIdNumber != "" {
+		vars = append(vars, faxVar("origination_caller_id_number", req.CallerIdNumber))
+	}
+	if req.CallerIdName != "" {
+		vars = append(vars, faxVar("origination_caller_id_name", req.CallerIdName))
+	}
+	if req.Ident != "" {
+		vars = append(vars, faxVar("fax_ident", req.Ident))
+	}
+	if req.Header != "" {
+		vars = append(vars, faxVar("fax_header", req.Header))
+	}
+	if req.Tag != "" {
+		vars = append(vars, faxVar("sip_h_X-Fax-Tag", req.Tag))
+	}
+	return "originate {"+strings.Join(vars, ",")+"}"+dial+" &txfax("+tiff+")", nil
+}
+
+// eslSendFax originates the fax call and waits for it to hang up, every
+// event of the channel is passed to progress. The wait ends with an error when
+// the event socket drops or after FAX_CALL_WAIT, the hangup event is lost.
+func eslSendFax(label string, req FaxRequest, tiff string, uuid string, progress func(ev EslEvent)) (FaxReport, error) {
+	var report FaxReport
+	originate, err := faxOriginate(req, uuid, tiff)
+	if err != nil {
+		return report, err
+	}
+	events := eslSubscribe(uuid)
+	defer eslUnsubscribe(uuid)
+	down := eslDisconnected()
+	err = eslBgapi(originate, uuid)
+	if err != nil {
+		fmt.Printf("error [%s]\n", err.Error())
+		return report, err
+	}
+	deadline := time.NewTimer(FAX_CALL_WAIT)
+	defer deadline.Stop()
+	var result EslEvent
+	for {
+		var ev EslEvent
+		select {
+		case ev = <-events:
+		case <-down:
+			return report, errors.New("event socket disconnected during the call")
+		case <-deadline.C:
+			eslApi("uuid_kill "+uuid)
+			return report, fmt.Errorf("no hangup after %s", FAX_CALL_WAIT)
+		}
+		fmt.Printf("eslSendFax: uuid[%s] event[%s]\n", uuid, ev.Name())
+		if progress != nil {
+			progress(ev)
+		}
+		switch ev.Name() {
+		case "BACKGROUND_JOB":
+			if !ev.ReplyOk() {
+				return report, fmt.Errorf("originate failed [%s]", strings.TrimSpace(ev.Body))
+			}
+		case "spandsp::txfaxresult":
+			result = ev
+			fmt.Printf("eslSendFax: uuid[%s] success[%s] result[%s][%s] pages[%s/%s]\n", uuid,
+			           ev.Get("fax-success"), ev.Get("fax-result-code"), ev.Get("fax-result-text"),
+			           ev.Get("fax-document-transferred-pages"), ev.Get("fax-document-total-pages"))
+		case "CHANNEL_HANGUP_COMPLETE":
+			report = faxReportCreate(label, "txfax", ev, result)
+			if result.Headers == nil && ev.Get("variable_fax_success") == "" {
+				return report, fmt.Errorf("call ended without fax result [%s]", ev.Get("Hangup-Cause"))
+			}
+			if !report.Success {
+				return report, fmt.Errorf("fax failed [%d][%s]", report.ResultCode, report.ResultText)
+			}
+			return report, nil
+		}
+	}
+}
+
+// faxJobProgress moves the job forward as the call events come in, first
+// and total are the first document page of the call and the document pages.
+func faxJobProgress(id string, ev EslEvent, first int, total int) {
+	faxProgressCall(id, ev, first, total)
+	switch ev.Name() {
+	case "CHANNEL_ANSWER":
+		faxJobTransition(id, FAX_NEGOTIATING, "answered")
+	case "spandsp::txfaxnegociateresult":
+		faxJobTransition(id, FAX_TRANSMITTING, fmt.Sprintf("rate[%s] ecm[%s] remote[%s]",
+		                 ev.Get("fax-transfer-rate"), ev.Get("fax-ecm-used"), ev.Get("fax-remote-station-id")))
+	}
+}
+
+// faxJobEnd moves the job to a terminal state from wherever it is, unless it
+// already ended (cancelled while the call was running).
+func faxJobEnd(id string, state string, detail string) {
+	faxJobUpdate(id, func(job *FaxJob) error {
+		if faxStateTerminal(job.State) {
+			return nil
+		}
+		fmt.Printf("fax job[%s] %s -> %s %s\n", id, job.State, state, detail)
+		job.State = state
+		if state == FAX_FAILED {
+			job.Error = detail
+		}
+		job.History = append(job.History, FaxJobEvent{State: state, Time: time.Now(), Detail: detail})
+		return nil
+	})
+}
+
+func faxJobRun(id string) {
+	job, err := faxJobTransition(id, FAX_CONVERTING, "")
+	if err != nil {
+		fmt.Printf("fax job[%s] not started [%s]\n", id, err)
+		return
+	}
+	// the jobs of a broadcast share the TIFF converted once
+	tiff := job.Tiff
+	if tiff == "" {
+		tiff, err = faxConvertAll(append([]string{job.Document}, job.Parts...),
+		                          FaxConvertOptions{Resolution: job.Request.Resolution, PageSize: job.Request.PageSize})
+		if err != nil {
+			faxJobEnd(id, FAX_FAILED, fmt.Sprintf("conversion error [%s]", err))
+			return
+		}
+	}
+	info, err := faxTiffInspect(tiff)
+	if err == nil && job.Request.Cover != nil {
+		tiff, err = faxCoverAdd(job, tiff, info.Pages)
+		if err != nil {
+			faxJobEnd(id, FAX_FAILED, fmt.Sprintf("cover page error [%s]", err))
+			return
+		}
+		info, err = faxTiffInspect(tiff)
+	}
+	if err == nil {
+		err = faxTiffCheck(info)
+	}
+	if err == nil {
+		if qerr := accountPagesUse(job.Account, info.Pages); qerr != nil {
+			faxJobEnd(id, FAX_FAILED, qerr.Error())
+			return
+		}
+	}
+	faxJobUpdate(id, func(job *FaxJob) error {
+		job.Tiff = tiff
+		job.TiffInfo = &info
+		return nil
+	})
+	if err != nil {
+		faxJobEnd(id, FAX_FAILED, fmt.Sprintf("invalid fax image [%s]", err))
+		return
+	}
+	faxJobSend(id)
+}
+
+// faxReadRequest accepts either a multipart form with a "document" file and
+// the FaxRequest fields as form values, or a JSON FaxRequest with a base64 document.
+// A broadcast request has no destination, it comes with the recipient list.
+func faxReadRequest(r *http.Request, id string, broadcast bool) (FaxRequest, string, error) {
+	var req FaxRequest
+	var doc []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		// Maximum upload of 16 MB files
+		err := r.ParseMultipartForm(16 << 20)
+		if err != nil {
+			return req, "", err
+		}
+		req.Destination = r.FormValue("destination")
+		req.Gateway = r.FormValue("gateway")
+		req.Profile = r.FormValue("profile")
+		req.CallerIdNumber = r.FormValue("caller_id_number")
+		req.CallerIdName = r.FormValue("caller_id_name")
+		req.Ident = r.FormValue("ident")
+		req.Header = r.FormValue("header")
+		req.Resolution = r.FormValue("resolution")
+		req.PageSize = r.FormValue("page_size")
+		req.Tag = r.FormValue("tag")
+		req.Codec = r.FormValue("codec")
+		for name, v := range map[string]**bool{"t38": &req.T38, "ecm": &req.Ecm, "v17": &req.V17} {
+			if r.FormValue(name) == "" {
+				continue
+			}
+			b, err := strconv.ParseBool(r.FormValue(name))
+			if err != nil {
+				return req, "", fmt.Errorf("invalid %s [%s]", name, r.FormValue(name))
+			}
+			*v = &b
+		}
+		if r.FormValue("max_rate") != "" {
+			req.MaxRate, err = strconv.Atoi(r.FormValue("max_rate"))
+			if err != nil {
+				return req, "", fmt.Errorf("invalid max_rate [%s]", r.FormValue("max_rate"))
+			}
+		}
+		req.WebhookUrl = r.FormValue("webhook_url")
+		req.Cover = faxCoverForm(r)
+		req.NotBefore, err = faxNotBeforeForm(r.FormValue("not_before"))
+		if err != nil {
+			return req, "", err
+		}
+		req.Window, err = faxWindowForm(r.FormValue("window"), r.FormValue("window_days"), r.FormValue("time_zone"))
+		if err != nil {
+			return req, "", err
+		}
+		req.ContinuedMarker = r.FormValue("continued_marker") == "true" || r.FormValue("continued_marker") == "1"
+		req.Retry, err = faxRetryPolicyForm(r.FormValue("max_attempts"), r.FormValue("backoff"), r.FormValue("retry_on"))
+		if err != nil {
+			return req, "", err
+		}
+		file, handler, err := r.FormFile("document")
+		if err != nil {
+			return req, "", fmt.Errorf("missing document [%s]", err)
+		}
+		defer file.Close()
+		req.DocumentName = handler.Filename
+		doc, err = io.ReadAll(file)
+		if err != nil {
+			return req, "", err
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return req, "", fmt.Errorf("invalid fax request [%s]", err)
+		}
+		doc, err = base64.StdEncoding.DecodeString(req.Document)
+		if err != nil {
+			return req, "", fmt.Errorf("invalid document encoding [%s]", err)
+		}
+		req.Document = ""
+		// only set by the email gateway
+		req.Email = nil
+	}
+	if len(doc) == 0 {
+		return req, "", errors.New("missing document")
+	}
+	if req.DocumentName == "" {
+		req.DocumentName = "document.pdf"
+	}
+	if broadcast {
+		req.Destination = ""
+	} else if _, err := faxDialString(req); err != nil {
+		return req, "", err
+	}
+	if err := faxTransportCheck(&req); err != nil {
+		return req, "", err
+	}
+	if err := faxRetryPolicyCheck(req.Retry); err != nil {
+		return req, "", err
+	}
+	if err := faxWindowCheck(req.Window); err != nil {
+		return req, "", err
+	}
+	if err := faxCoverRequestCheck(accountOf(r), req.Cover); err != nil {
+		return req, "", err
+	}
+	if req.WebhookUrl != "" {
+		if err := webhookJobUrlCheck(req.WebhookUrl, accountOf(r)); err != nil {
+			return req, "", err
+		}
+	}
+	opts := FaxConvertOptions{Resolution: req.Resolution, PageSize: req.PageSize}
+	if err := faxConvertOptionsCheck(&opts); err != nil {
+		return req, "", err
+	}
+	fn := accountDir(config.Paths.Upload, accountOf(r))+"/"+id+"-"+filepath.Base(req.DocumentName)
+	if err := os.WriteFile(fn, doc, 0666); err != nil {
+		return req, "", err
+	}
+	if _, err := faxDocumentCheck(fn); err != nil {
+		os.Remove(fn)
+		return req, "", err
+	}
+	return req, fn, nil
+}
+
+func faxCreate(w http.ResponseWriter, r *http.Request) {
+	job := FaxJob{Id: uuid.NewString(), Account: accountOf(r)}
+	if err := accountAdmit(job.Account, 1); err != nil {
+		accountError(w, err)
+		return
+	}
+	req, fn, err := faxReadRequest(r, job.Id, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.Request = req
+	job.Document = fn
+	err = faxJobCreate(&job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("fax job[%s] destination[%s] document[%s]\n", job.Id, req.Destination, fn)
+	go faxJobRun(job.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": job.Id})
+}
+
+func faxesHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "faxes"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	switch r.Method {
+	case "POST":
+		faxCreate(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// faxJobCancel ends the job and hangs up its call if there is one.
+func faxJobCancel(id string, detail string) (FaxJob, error) {
+	job, err := faxJobTransition(id, FAX_CANCELLED, detail)
+	if err != nil {
+		return job, err
+	}
+	if job.CallUuid != "" {
+		if _, err := eslApi("uuid_kill "+job.CallUuid); err != nil {
+			fmt.Printf("fax job[%s] uuid_kill error [%s]\n", id, err)
+		}
+	}
+	return job, nil
+}
+
+func faxCancel(w http.ResponseWriter, id string) {
+	job, err := faxJobCancel(id, "cancelled by request")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// faxDocument serves the inspection of the TIFF the job sends, or will send.
+func faxDocument(w http.ResponseWriter, job FaxJob) {
+	info := job.TiffInfo
+	if info == nil && job.Tiff != "" {
+		i, err := faxTiffInspect(job.Tiff)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info = &i
+	}
+	if info == nil {
+		http.Error(w, "document not converted yet, job "+job.State, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// faxHandler serves /faxes/{id}, /faxes/{id}/document and /faxes/{id}/events
+func faxHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "fax"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/faxes/"), "/"), "/")
+	id := parts[0]
+	if id == "" {
+		faxesHandler(w, r)
+		return
+	}
+	if len(parts) > 1 {
+		if (parts[1] != "document" && parts[1] != "events") || r.Method != "GET" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		job, err := faxStoreGet(id)
+		if err != nil || !accountVisible(r, job.Account) {
+			http.Error(w, "fax job not found ["+id+"]", http.StatusNotFound)
+			return
+		}
+		if parts[1] == "events" {
+			faxEvents(w, r, job)
+			return
+		}
+		faxDocument(w, job)
+		return
+	}
+	job, err := faxStoreGet(id)
+	if err != nil || !accountVisible(r, job.Account) {
+		http.Error(w, "fax job not found ["+id+"]", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	case "DELETE":
+		faxCancel(w, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/google/uuid"
+)
+
+// Broadcast, one document sent to a list of recipients. The document is
+// converted once, then a fax job is created per recipient with the shared
+// TIFF, at most Concurrency of them running at a time. The dispatcher follows
+// the jobs through the fax store, so a broadcast carries on after a controller
+// restart. When every job has ended a summary is published on
+// RMQ_PUB_KEY_SUMMARY, the outcome of each recipient can be exported as CSV.
+
+const (
+	FAX_BROADCAST_CONVERTING = "converting"
+	FAX_BROADCAST_RUNNING    = "running"
+	FAX_BROADCAST_COMPLETED  = "completed"
+	FAX_BROADCAST_FAILED     = "failed"
+	FAX_BROADCAST_CANCELLED  = "cancelled"
+)
+
+// recipient waiting for a free slot
+const FAX_RECIPIENT_PENDING = "pending"
+
+const FAX_BROADCAST_CONCURRENCY = 4
+const FAX_BROADCAST_MAX_CONCURRENCY = 50
+const FAX_BROADCAST_MAX_RECIPIENTS = 10000
+// the dispatcher is woken up by the job state changes, this is a safety net
+const FAX_BROADCAST_POLL = 30 * time.Second
+
+var faxBroadcastBucket = []byte("broadcasts")
+
+type FaxRecipient struct {
+	Destination string    `json:"destination"`
+	Gateway     string    `json:"gateway,omitempty"`
+	Name        string    `json:"name,omitempty"` // cover page "to" when the request has a cover
+	JobId       string    `json:"job_id,omitempty"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	Pages       int       `json:"pages_transferred"`
+	Result      string    `json:"result,omitempty"`
+	HangupCause string    `json:"hangup_cause,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+type FaxBroadcast struct {
+	Id          string         `json:"id"`
+	Account     string         `json:"account,omitempty"`
+	State       string         `json:"state"`
+	Request     FaxRequest     `json:"request"`
+	Document    string         `json:"document"`
+	Tiff        string         `json:"tiff,omitempty"`
+	TiffInfo    *FaxTiffInfo   `json:"tiff_info,omitempty"`
+	Concurrency int            `json:"concurrency"`
+	Error       string         `json:"error,omitempty"`
+	Recipients  []FaxRecipient `json:"recipients"`
+	Created     time.Time      `json:"created"`
+	Updated     time.Time      `json:"updated"`
+	Ended       time.Time      `json:"ended,omitempty"`
+}
+
+type FaxBroadcastSummary struct {
+	Label      string         `json:"label"`
+	Account    string         `json:"account,omitempty"`
+	Action     string         `json:"action"`
+	Start      string         `json:"start"`
+	End        string         `json:"end"`
+	Result     string         `json:"result"` // SUCCESS, PARTIAL or FAILED
+	State      string         `json:"state"`
+	Duration   int32          `json:"duration"`
+	Total      int            `json:"total"`
+	Completed  int            `json:"completed"`
+	Failed     int            `json:"failed"`
+	Cancelled  int            `json:"cancelled"`
+	PagesTotal int            `json:"pages_total"` // document pages
+	Pages      int            `json:"pages_transferred"`
+	Recipients []FaxRecipient `json:"recipients"`
+}
+
+var (
+	faxBroadcastMu   sync.Mutex
+	faxBroadcastWake = make(map[string]chan bool)
+)
+
+func faxBroadcastPut(b *FaxBroadcast) error {
+	return storePut(faxBroadcastBucket, b.Id, b)
+}
+
+func faxBroadcastGet(id string) (FaxBroadcast, error) {
+	var b FaxBroadcast
+	found, err := storeGet(faxBroadcastBucket, id, &b)
+	if err == nil && !found {
+		err = fmt.Errorf("broadcast not found [%s]", id)
+	}
+	return b, err
+}
+
+func faxBroadcastList() ([]FaxBroadcast, error) {
+	list := []FaxBroadcast{}
+	err := storeEach(faxBroadcastBucket, func(v []byte) error {
+		var b FaxBroadcast
+		if err := json.Unmarshal(v, &b); err != nil {
+			fmt.Printf("invalid broadcast record [%s]\n", err)
+			return nil
+		}
+		list = append(list, b)
+		return nil
+	})
+	return list, err
+}
+
+// faxBroadcastUpdate reads, modifies and writes back a broadcast under the broadcast lock.
+func faxBroadcastUpdate(id string, update func(b *FaxBroadcast) error) (FaxBroadcast, error) {
+	faxBroadcastMu.Lock()
+	defer faxBroadcastMu.Unlock()
+	b, err := faxBroadcastGet(id)
+	if err != nil {
+		return b, err
+	}
+	if err := update(&b); err != nil {
+		return b, err
+	}
+	b.Updated = time.Now()
+	return b, faxBroadcastPut(&b)
+}
+
+func faxBroadcastTerminal(state string) bool {
+	return state == FAX_BROADCAST_COMPLETED || state == FAX_BROADCAST_FAILED || state == FAX_BROADCAST_CANCELLED
+}
+
+// faxBroadcastRecipients reads a JSON list (of objects or of destinations) or
+// a CSV with the columns destination, name, gateway (header line optional).
+func faxBroadcastRecipients(data []byte) ([]FaxRecipient, error) {
+	var list []FaxRecipient
+	data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err := json.Unmarshal(data, &list); err != nil {
+			var numbers []string
+			list = nil
+			if json.Unmarshal(data, &numbers) != nil {
+				return nil, fmt.Errorf("invalid recipient list [%s]", err)
+			}
+			for _, n := range numbers {
+				list = append(list, FaxRecipient{Destination: n})
+			}
+		}
+	} else {
+		r := csv.NewReader(bytes.NewReader(data))
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		cols := map[string]int{"destination": 0, "name": 1, "gateway": 2}
+		for line := 1; ; line++ {
+			rec, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipient csv [%s]", err)
+			}
+			if line == 1 && len(rec) > 0 {
+				first := strings.ToLower(strings.TrimSpace(rec[0]))
+				if first == "destination" || first == "number" || first == "name" || first == "gateway" {
+					cols = map[string]int{"destination": -1, "name": -1, "gateway": -1}
+					for i, h := range rec {
+						h = strings.ToLower(strings.TrimSpace(h))
+						if h == "number" {
+							h = "destination"
+						}
+						cols[h] = i
+					}
+					if cols["destination"] < 0 {
+						return nil, errors.New("recipient csv has no destination column")
+					}
+					continue
+				}
+			}
+			field := func(name string) string {
+				if i := cols[name]; i >= 0 && i < len(rec) {
+					return strings.TrimSpace(rec[i])
+				}
+				return ""
+			}
+			if field("destination") == "" {
+				continue
+			}
+			list = append(list, FaxRecipient{Destination: field("destination"), Name: field("name"),
+			                                  Gateway: field("gateway")})
+		}
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no recipient")
+	}
+	if len(list) > FAX_BROADCAST_MAX_RECIPIENTS {
+		return nil, fmt.Errorf("too many recipients [%d], at most %d", len(list), FAX_BROADCAST_MAX_RECIPIENTS)
+	}
+	return list, nil
+}
+
+// faxBroadcastRequest is the request of the job of a recipient.
+func faxBroadcastRequest(b FaxBroadcast, r FaxRecipient) FaxRequest {
+	req := b.Request
+	req.Destination = r.Destination
+	if r.Gateway != "" {
+		req.Gateway = r.Gateway
+	}
+	if req.Cover != nil {
+		cover := *req.Cover
+		if cover.To == "" {
+			cover.To = r.Name
+		}
+		req.Cover = &cover
+	}
+	return req
+}
+
+func faxRecipientUpdate(r *FaxRecipient, job FaxJob) {
+	r.State = job.State
+	r.Attempts = len(job.Attempts)
+	r.Pages = faxPagesDelivered(job)
+	r.Error = job.Error
+	if job.Report != nil {
+		r.Result = job.Report.Result
+		r.HangupCause = job.Report.HangupCause
+	}
+	r.Updated = job.Updated
+}
+
+func faxBroadcastWakeChan(id string) chan bool {
+	faxBroadcastMu.Lock()
+	defer faxBroadcastMu.Unlock()
+	ch, found := faxBroadcastWake[id]
+	if !found {
+		ch = make(chan bool, 1)
+		faxBroadcastWake[id] = ch
+	}
+	return ch
+}
+
+func faxBroadcastNotify(id string) {
+	faxBroadcastMu.Lock()
+	ch := faxBroadcastWake[id]
+	faxBroadcastMu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- true:
+	default:
+	}
+}
+
+// faxBroadcastJobEvent wakes the dispatcher of the broadcast of the job up.
+func faxBroadcastJobEvent(job FaxJob) {
+	if job.BroadcastId != "" {
+		faxBroadcastNotify(job.BroadcastId)
+	}
+}
+
+func faxBroadcastConvert(id string) error {
+	b, err := faxBroadcastGet(id)
+	if err != nil {
+		return err
+	}
+	if b.Tiff != "" {
+		return nil
+	}
+	tiff, err := faxConvert(b.Document, FaxConvertOptions{Resolution: b.Request.Resolution, PageSize: b.Request.PageSize})
+	if err != nil {
+		return fmt.Errorf("conversion error [%s]", err)
+	}
+	info, err := faxTiffInspect(tiff)
+	if err == nil {
+		err = faxTiffCheck(info)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid fax image [%s]", err)
+	}
+	_, err = faxBroadcastUpdate(id, func(b *FaxBroadcast) error {
+		b.Tiff = tiff
+		b.TiffInfo = &info
+		if b.State == FAX_BROADCAST_CONVERTING {
+			b.State = FAX_BROADCAST_RUNNING
+		}
+		return nil
+	})
+	return err
+}
+
+// faxBroadcastDispatch refreshes the recipients from their jobs and starts
+// jobs for the pending ones while there is a free slot, returns the number of
+// jobs still running or recipients held back by the quota of the account.
+func faxBroadcastDispatch(b *FaxBroadcast) int {
+	active := 0
+	for i := range b.Recipients {
+		r := &b.Recipients[i]
+		if r.JobId == "" || faxStateTerminal(r.State) {
+			continue
+		}
+		if job, err := faxStoreGet(r.JobId); err == nil {
+			faxRecipientUpdate(r, job)
+		}
+		if !faxStateTerminal(r.State) {
+			active++
+		}
+	}
+	if b.State != FAX_BROADCAST_RUNNING {
+		return active
+	}
+	for i := range b.Recipients {
+		if active >= b.Concurrency {
+			break
+		}
+		r := &b.Recipients[i]
+		if r.State != FAX_RECIPIENT_PENDING {
+			continue
+		}
+		// the quota of the account holds the pending ones back too
+		if err := accountAdmit(b.Account, 1); err != nil {
+			fmt.Printf("fax broadcast[%s] account[%s] %s\n", b.Id, b.Account, err)
+			for _, r := range b.Recipients[i:] {
+				if r.State == FAX_RECIPIENT_PENDING {
+					active++
+				}
+			}
+			break
+		}
+		job := FaxJob{Id: uuid.NewString(), Account: b.Account, Request: faxBroadcastRequest(*b, *r), Document: b.Document,
+		              BroadcastId: b.Id, Tiff: b.Tiff, TiffInfo: b.TiffInfo}
+		if err := faxJobCreate(&job); err != nil {
+			r.State = FAX_FAILED
+			r.Error = err.Error()
+			continue
+		}
+		r.JobId = job.Id
+		r.State = job.State
+		r.Updated = job.Updated
+		fmt.Printf("fax broadcast[%s] recipient[%s] job[%s]\n", b.Id, r.Destination, job.Id)
+		go faxJobRun(job.Id)
+		active++
+	}
+	return active
+}
+
+// faxBroadcastRun converts the document and keeps Concurrency jobs running
+// until every recipient has been handled.
+func faxBroadcastRun(id string) {
+	wake := faxBroadcastWakeChan(id)
+	defer func() {
+		faxBroadcastMu.Lock()
+		delete(faxBroadcastWake, id)
+		faxBroadcastMu.Unlock()
+	}()
+	if err := faxBroadcastConvert(id); err != nil {
+		fmt.Printf("fax broadcast[%s] %s\n", id, err)
+		b, _ := faxBroadcastUpdate(id, func(b *FaxBroadcast) error {
+			b.State = FAX_BROADCAST_FAILED
+			b.Error = err.Error()
+			b.Ended = time.Now()
+			for i := range b.Recipients {
+				b.Recipients[i].State = FAX_FAILED
+				b.Recipients[i].Error = b.Error
+			}
+			return nil
+		})
+		faxBroadcastPublish(b)
+		return
+	}
+	for {
+		b, err := faxBroadcastUpdate(id, func(b *FaxBroadcast) error {
+			if faxBroadcastDispatch(b) > 0 {
+				return nil
+			}
+			if b.State == FAX_BROADCAST_RUNNING {
+				b.State = FAX_BROADCAST_COMPLETED
+			}
+			if b.Ended.IsZero() {
+				b.Ended = time.Now()
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("fax broadcast[%s] error [%s]\n", id, err)
+			return
+		}
+		if !b.Ended.IsZero() {
+			fmt.Printf("fax broadcast[%s] %s\n", id, b.State)
+			faxBroadcastPublish(b)
+			return
+		}
+		select {
+		case <-wake:
+		case <-time.After(FAX_BROADCAST_POLL):
+		}
+	}
+}
+
+func faxBroadcastSummarize(b FaxBroadcast) FaxBroadcastSummary {
+	s := FaxBroadcastSummary{Label: b.Id, Account: b.Account, Action: "fax_broadcast", Start: b.Created.Format(time.RFC3339),
+	                         State: b.State, Total: len(b.Recipients), Recipients: b.Recipients}
+	if !b.Ended.IsZero() {
+		s.End = b.Ended.Format(time.RFC3339)
+		s.Duration = int32(b.Ended.Sub(b.Created).Seconds())
+	}
+	if b.TiffInfo != nil {
+		s.PagesTotal = b.TiffInfo.Pages
+	}
+	for _, r := range b.Recipients {
+		switch r.State {
+		case FAX_COMPLETED:
+			s.Completed++
+		case FAX_FAILED:
+			s.Failed++
+		case FAX_CANCELLED, FAX_RECIPIENT_PENDING:
+			s.Cancelled++
+		}
+		s.Pages += r.Pages
+	}
+	switch {
+	case s.Completed == s.Total:
+		s.Result = "SUCCESS"
+	case s.Completed > 0:
+		s.Result = "PARTIAL"
+	default:
+		s.Result = "FAILED"
+	}
+	return s
+}
+
+func faxBroadcastPublish(b FaxBroadcast) {
+	summary, err := json.Marshal(faxBroadcastSummarize(b))
+	if err != nil {
+		fmt.Printf("invalid broadcast summary [%s]\n", err)
+		return
+	}
+	fmt.Println(string(summary))
+	rmqPublish(string(summary), config.Rmq.PubKeySummary)
+}
+
+// faxBroadcastCancel drops the pending recipients and cancels the running jobs.
+func faxBroadcastCancel(id string) (FaxBroadcast, error) {
+	var running []string
+	b, err := faxBroadcastUpdate(id, func(b *FaxBroadcast) error {
+		if faxBroadcastTerminal(b.State) {
+			return fmt.Errorf("broadcast %s already %s", id, b.State)
+		}
+		b.State = FAX_BROADCAST_CANCELLED
+		for i := range b.Recipients {
+			r := &b.Recipients[i]
+			if r.State == FAX_RECIPIENT_PENDING {
+				r.State = FAX_CANCELLED
+				r.Updated = time.Now()
+			} else if r.JobId != "" && !faxStateTerminal(r.State) {
+				running = append(running, r.JobId)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return b, err
+	}
+	for _, jobId := range running {
+		if _, err := faxJobCancel(jobId, "broadcast cancelled"); err != nil {
+			fmt.Printf("fax broadcast[%s] job[%s] cancel error [%s]\n", id, jobId, err)
+		}
+	}
+	faxBroadcastNotify(id)
+	return b, nil
+}
+
+// faxBroadcastsResume restarts the dispatchers of the broadcasts not ended.
+func faxBroadcastsResume() {
+	list, err := faxBroadcastList()
+	if err != nil {
+		fmt.Printf("fax broadcast resume error [%s]\n", err)
+		return
+	}
+	for _, b := range list {
+		if b.Ended.IsZero() {
+			fmt.Printf("fax broadcast[%s] resuming %s\n", b.Id, b.State)
+			go faxBroadcastRun(b.Id)
+		}
+	}
+}
+
+func faxBroadcastCsv(w http.ResponseWriter, b FaxBroadcast) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"broadcast-%s.csv\"", b.Id))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"destination", "name", "state", "job_id", "attempts", "pages_transferred", "result",
+	                  "hangup_cause", "error", "updated"})
+	for _, r := range b.Recipients {
+		updated := ""
+		if !r.Updated.IsZero() {
+			updated = r.Updated.Format(time.RFC3339)
+		}
+		cw.Write([]string{r.Destination, r.Name, r.State, r.JobId, strconv.Itoa(r.Attempts), strconv.Itoa(r.Pages),
+		                  r.Result, r.HangupCause, r.Error, updated})
+	}
+	cw.Flush()
+}
+
+// faxBroadcastCreate takes a multipart form with the document, the recipient
+// list as a "recipients" file or value, the concurrency and the fields of a fax request.
+func faxBroadcastCreate(w http.ResponseWriter, r *http.Request) {
+	b := FaxBroadcast{Id: uuid.NewString(), Account: accountOf(r), State: FAX_BROADCAST_CONVERTING,
+	                  Concurrency: FAX_BROADCAST_CONCURRENCY}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		http.Error(w, "multipart form expected", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := accountAdmit(b.Account, 1); err != nil {
+		accountError(w, err)
+		return
+	}
+	req, fn, err := faxReadRequest(r, b.Id, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var list []byte
+	if file, _, err := r.FormFile("recipients"); err == nil {
+		list, err = io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		list = []byte(r.FormValue("recipients"))
+	}
+	b.Recipients, err = faxBroadcastRecipients(list)
+	if err == nil && r.FormValue("concurrency") != "" {
+		b.Concurrency, err = strconv.Atoi(r.FormValue("concurrency"))
+		if err != nil || b.Concurrency < 1 || b.Concurrency > FAX_BROADCAST_MAX_CONCURRENCY {
+			err = fmt.Errorf("invalid concurrency [%s], 1 to %d", r.FormValue("concurrency"), FAX_BROADCAST_MAX_CONCURRENCY)
+		}
+	}
+	b.Request = req
+	for i := range b.Recipients {
+		if err != nil {
+			break
+		}
+		rcpt := b.Recipients[i]
+		b.Recipients[i] = FaxRecipient{Destination: rcpt.Destination, Gateway: rcpt.Gateway, Name: rcpt.Name,
+		                               State: FAX_RECIPIENT_PENDING}
+		if _, err = faxDialString(faxBroadcastRequest(b, rcpt)); err != nil {
+			err = fmt.Errorf("recipient %d: %s", i+1, err)
+		}
+	}
+	if err != nil {
+		os.Remove(fn)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.Document = fn
+	b.Created = time.Now()
+	b.Updated = b.Created
+	if err := faxBroadcastPut(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("fax broadcast[%s] recipients[%d] concurrency[%d] document[%s]\n", b.Id, len(b.Recipients),
+	           b.Concurrency, fn)
+	go faxBroadcastRun(b.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": b.Id, "recipients": len(b.Recipients)})
+}
+
+// faxBroadcastsHandler serves /faxes/broadcasts (GET list, POST create),
+// GET, DELETE /faxes/broadcasts/{id} and GET /faxes/broadcasts/{id}/{summary|recipients.csv}
+func faxBroadcastsHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "broadcasts"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/faxes/broadcasts"), "/"), "/")
+	id := parts[0]
+	switch {
+	case id == "" && r.Method == "GET":
+		list, err := faxBroadcastList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := []FaxBroadcastSummary{}
+		for _, b := range list {
+			if !accountVisible(r, b.Account) {
+				continue
+			}
+			s := faxBroadcastSummarize(b)
+			s.Recipients = nil
+			res = append(res, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	case id == "" && r.Method == "POST":
+		faxBroadcastCreate(w, r)
+	case id != "" && r.Method == "GET":
+		b, err := faxBroadcastGet(id)
+		if err != nil || !accountVisible(r, b.Account) {
+			http.Error(w, "broadcast not found ["+id+"]", http.StatusNotFound)
+			return
+		}
+		if len(parts) == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(b)
+		} else if parts[1] == "summary" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(faxBroadcastSummarize(b))
+		} else if parts[1] == "recipients.csv" {
+			faxBroadcastCsv(w, b)
+		} else {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	case id != "" && r.Method == "DELETE":
+		if b, err := faxBroadcastGet(id); err != nil || !accountVisible(r, b.Account) {
+			http.Error(w, "broadcast not found ["+id+"]", http.StatusNotFound)
+			return
+		}
+		b, err := faxBroadcastCancel(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(faxBroadcastSummarize(b))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFaxBroadcastRecipients(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		list []FaxRecipient
+	}{
+		{"json objects", `[{"destination":"15145550100","name":"Front Desk","gateway":"carrier2"},
+		                   {"destination":"15145550101"}]`,
+		 []FaxRecipient{{Destination: "15145550100", Name: "Front Desk", Gateway: "carrier2"},
+		                {Destination: "15145550101"}}},
+		{"json numbers", `["15145550100","15145550101"]`,
+		 []FaxRecipient{{Destination: "15145550100"}, {Destination: "15145550101"}}},
+		{"csv", "15145550100,Front Desk,carrier2\n15145550101\n",
+		 []FaxRecipient{{Destination: "15145550100", Name: "Front Desk", Gateway: "carrier2"},
+		                {Destination: "15145550101"}}},
+		{"csv header", "\xef\xbb\xbfName, Number\nFront Desk, 15145550100\n,\nSales,15145550101\n",
+		 []FaxRecipient{{Destination: "15145550100", Name: "Front Desk"},
+		                {Destination: "15145550101", Name: "Sales"}}},
+	}
+	for _, c := range cases {
+		list, err := faxBroadcastRecipients([]byte(c.data))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, c.list) {
+			t.Errorf("%s: %+v, expected %+v", c.name, list, c.list)
+		}
+	}
+
+	invalid := map[string]string{
+		"empty":          "",
+		"no destination": "name,gateway\nFront Desk,carrier2\n",
+		"bad json":       `[{"destination":`,
+		"too many":       strings.Repeat("15145550100\n", FAX_BROADCAST_MAX_RECIPIENTS+1),
+	}
+	for name, data := range invalid {
+		if list, err := faxBroadcastRecipients([]byte(data)); err == nil {
+			t.Errorf("%s: accepted %d recipients", name, len(list))
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Document conversion to the G4 TIFF sent by txfax, the converter is chosen
+// from the content of the document, not from its name.
+
+type FaxConvertOptions struct {
+	Resolution string // standard, fine, superfine
+	PageSize   string // a4, letter, legal
+}
+
+type FaxConverter interface {
+	Name() string
+	Match(contentType string, head []byte) bool
+	// Check rejects corrupt input before the job is accepted
+	Check(src string) error
+	Convert(src string, dst string, opts FaxConvertOptions) error
+}
+
+var faxConverters = []FaxConverter{
+	faxPdfConverter{},
+	faxImageConverter{},
+	faxTiffConverter{},
+	faxTextConverter{},
+}
+
+const FAX_PAGE_WIDTH = 1728
+
+var faxResolutions = map[string][2]int{
+	"standard":  {204, 98},
+	"fine":      {204, 196},
+	"superfine": {204, 391},
+}
+
+// page heights in inches
+var faxPageSizes = map[string]float64{
+	"a4":     11.69,
+	"letter": 11,
+	"legal":  14,
+}
+
+func faxConvertOptionsCheck(opts *FaxConvertOptions) error {
+	opts.Resolution = strings.ToLower(opts.Resolution)
+	opts.PageSize = strings.ToLower(opts.PageSize)
+	if opts.Resolution == "" {
+		opts.Resolution = "fine"
+	}
+	if opts.PageSize == "" {
+		opts.PageSize = "letter"
+	}
+	if _, found := faxResolutions[opts.Resolution]; !found {
+		return fmt.Errorf("invalid resolution [%s], expected standard, fine or superfine", opts.Resolution)
+	}
+	if _, found := faxPageSizes[opts.PageSize]; !found {
+		return fmt.Errorf("invalid page size [%s], expected a4, letter or legal", opts.PageSize)
+	}
+	return nil
+}
+
+// faxPageGeometry returns the x and y resolution in dpi and the page size in pixels.
+func faxPageGeometry(opts FaxConvertOptions) (int, int, int, int) {
+	res := faxResolutions[opts.Resolution]
+	height := int(math.Round(faxPageSizes[opts.PageSize] * float64(res[1])))
+	return res[0], res[1], FAX_PAGE_WIDTH, height
+}
+
+func faxConverterFind(src string) (FaxConverter, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return nil, errors.New("empty document")
+		}
+		return nil, err
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	for _, c := range faxConverters {
+		if c.Match(contentType, head) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported document type [%s]", contentType)
+}
+
+// faxDocumentCheck finds the converter of the document and checks it can be converted.
+func faxDocumentCheck(src string) (FaxConverter, error) {
+	c, err := faxConverterFind(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Check(src); err != nil {
+		return nil, fmt.Errorf("invalid %s document [%s]", c.Name(), err)
+	}
+	return c, nil
+}
+
+// faxConvert converts the document to a G4 TIFF next to it, returns the TIFF file name.
+func faxConvert(src string, opts FaxConvertOptions) (string, error) {
+	if err := faxConvertOptionsCheck(&opts); err != nil {
+		return "", err
+	}
+	c, err := faxDocumentCheck(src)
+	if err != nil {
+		return "", err
+	}
+	dst := src+".tiff"
+	fmt.Printf("faxConvert: [%s] %s resolution[%s] page[%s]\n", src, c.Name(), opts.Resolution, opts.PageSize)
+	if err := c.Convert(src, dst, opts); err != nil {
+		return "", fmt.Errorf("%s conversion failed [%s]", c.Name(), err)
+	}
+	return dst, nil
+}
+
+// faxConvertAll converts the documents and joins their pages in one TIFF.
+func faxConvertAll(docs []string, opts FaxConvertOptions) (string, error) {
+	if len(docs) == 1 {
+		return faxConvert(docs[0], opts)
+	}
+	args := []string{"-c", "g4"}
+	for _, doc := range docs {
+		tiff, err := faxConvert(doc, opts)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", filepath.Base(doc), err)
+		}
+		args = append(args, tiff)
+	}
+	dst := docs[0]+".all.tiff"
+	if err := faxExec("tiffcp", append(args, dst)...); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func faxExec(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println("Error executing command:", name, err)
+		return fmt.Errorf("%s: %s [%s]", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// faxGhostscript renders a PDF or PostScript file to G4 on the fax page size.
+func faxGhostscript(src string, dst string, opts FaxConvertOptions) error {
+	xres, yres, width, height := faxPageGeometry(opts)
+	// gs -q -dNOPAUSE -sDEVICE=tiffg4 -sOutputFile=/files/upload/tx.tiff /files/upload/invoice.pdf -c quit
+	return faxExec("gs", "-q", "-dNOPAUSE", "-dBATCH", "-dSAFER", "-sDEVICE=tiffg4",
+	               fmt.Sprintf("-r%dx%d", xres, yres), fmt.Sprintf("-g%dx%d", width, height),
+	               "-dFIXEDMEDIA", "-dPDFFitPage", "-sOutputFile="+dst, src)
+}
+
+type faxPdfConverter struct{}
+
+func (faxPdfConverter) Name() string { return "pdf" }
+
+func (faxPdfConverter) Match(contentType string, head []byte) bool {
+	return contentType == "application/pdf" || contentType == "application/postscript"
+}
+
+func (faxPdfConverter) Check(src string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tail := b
+	if len(tail) > 1024 {
+		tail = tail[len(tail)-1024:]
+	}
+	if bytes.HasPrefix(b, []byte("%PDF-")) && !bytes.Contains(tail, []byte("%%EOF")) {
+		return errors.New("truncated PDF, missing %%EOF")
+	}
+	return nil
+}
+
+func (faxPdfConverter) Convert(src string, dst string, opts FaxConvertOptions) error {
+	return faxGhostscript(src, dst, opts)
+}
+
+type faxImageConverter struct{}
+
+func (faxImageConverter) Name() string { return "image" }
+
+func (faxImageConverter) Match(contentType string, head []byte) bool {
+	return contentType == "image/png" || contentType == "image/jpeg" || contentType == "image/gif"
+}
+
+func (faxImageConverter) Check(src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = image.DecodeConfig(f)
+	return err
+}
+
+func (faxImageConverter) Convert(src string, dst string, opts FaxConvertOptions) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	xres, yres, width, height := faxPageGeometry(opts)
+	page := faxBitmapFromImage(img, width, height, float64(xres), float64(yres))
+	raw := dst+".raw"
+	defer os.Remove(raw)
+	if err := faxTiffWrite(raw, []*faxBitmap{page}, xres, yres); err != nil {
+		return err
+	}
+	return faxExec("tiffcp", "-c", "g4", raw, dst)
+}
+
+type faxTiffConverter struct{}
+
+func (faxTiffConverter) Name() string { return "tiff" }
+
+func (faxTiffConverter) Match(contentType string, head []byte) bool {
+	return bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*"))
+}
+
+func (faxTiffConverter) Check(src string) error {
+	info, err := faxTiffInspect(src)
+	if err != nil {
+		return err
+	}
+	return faxTiffCheck(info)
+}
+
+// Convert passes the TIFF through as is, resolution and page size are the ones of the file.
+func (faxTiffConverter) Convert(src string, dst string, opts FaxConvertOptions) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, b, 0666)
+}
+
+type faxTextConverter struct{}
+
+func (faxTextConverter) Name() string { return "text" }
+
+func (faxTextConverter) Match(contentType string, head []byte) bool {
+	return strings.HasPrefix(contentType, "text/plain")
+}
+
+func (faxTextConverter) Check(src string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(b) {
+		return errors.New("text is not valid UTF-8")
+	}
+	return nil
+}
+
+func (faxTextConverter) Convert(src string, dst string, opts FaxConvertOptions) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	ps := dst+".ps"
+	defer os.Remove(ps)
+	if err := os.WriteFile(ps, []byte(faxTextToPostScript(string(b), opts)), 0666); err != nil {
+		return err
+	}
+	return faxGhostscript(ps, dst, opts)
+}
+
+func faxPostScriptString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// faxTextToPostScript lays the text out in 10pt Courier, lines are wrapped
+// and a form feed starts a new page.
+func faxTextToPostScript(text string, opts FaxConvertOptions) string {
+	xres, yres, width, height := faxPageGeometry(opts)
+	pageWidth := float64(width) / float64(xres) * 72
+	pageHeight := float64(height) / float64(yres) * 72
+	margin := 36.0
+	fontSize := 10.0
+	lineHeight := 12.0
+	cols := int((pageWidth - 2*margin) / (fontSize * 0.6))
+	rows := int((pageHeight - 2*margin) / lineHeight)
+
+	var pages [][]string
+	var lines []string
+	newPage := func() {
+		pages = append(pages, lines)
+		lines = nil
+	}
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\t", "        ")
+	for _, chunk := range strings.Split(text, "\f") {
+		if len(pages) > 0 || len(lines) > 0 {
+			newPage()
+		}
+		for _, line := range strings.Split(chunk, "\n") {
+			r := []rune(line)
+			for {
+				if len(lines) == rows {
+					newPage()
+				}
+				if len(r) <= cols {
+					lines = append(lines, string(r))
+					break
+				}
+				lines = append(lines, string(r[:cols]))
+				r = r[cols:]
+			}
+		}
+	}
+	newPage()
+
+	var ps strings.Builder
+	ps.WriteString("%!PS-Adobe-3.0\n")
+	for _, page := range pages {
+		fmt.Fprintf(&ps, "/Courier findfont %.1f scalefont setfont\n", fontSize)
+		y := pageHeight - margin - fontSize
+		for _, line := range page {
+			fmt.Fprintf(&ps, "%.1f %.1f moveto (%s) show\n", margin, y, faxPostScriptString(line))
+			y -= lineHeight
+		}
+		ps.WriteString("showpage\n")
+	}
+	return ps.String()
+}
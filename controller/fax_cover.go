@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Cover pages, a Go text/template rendered with the job details, converted
+// like any document (plain text, or PostScript when the template starts with
+// %!PS-Adobe-) and put in front of the pages before txfax. Templates are
+// stored by name in the fax store, "default" is built in unless one is stored
+// under it. The templates of an account are seen by it only and come before
+// the shared ones of the same name, the cover_template of the account is used
+// when a request names none.
+
+const FAX_COVER_DEFAULT = "default"
+
+var faxCoverBucket = []byte("cover_templates")
+
+var faxCoverNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+const faxCoverDefaultBody = `
+
+
+                                     F A X
+
+
+    Date:      {{.Date.Format "Mon, 02 Jan 2006 15:04 MST"}}
+
+    To:        {{.To}}
+    Fax:       {{.ToNumber}}
+
+    From:      {{.From}}
+    Fax:       {{.FromNumber}}
+
+    Subject:   {{.Subject}}
+    Pages:     {{.Pages}} including this cover page
+
+    ---------------------------------------------------------------------------
+{{if .Note}}
+{{.Note}}
+{{end}}`
+
+// FaxCover asks for a cover page, the fields are given to the template.
+type FaxCover struct {
+	Template string `json:"template"` // stored template name, "default" when empty
+	From     string `json:"from"`     // CallerIdName or Ident when empty
+	To       string `json:"to"`
+	Subject  string `json:"subject"`
+	Note     string `json:"note"`
+}
+
+type FaxCoverTemplate struct {
+	Name    string    `json:"name"`
+	Account string    `json:"account,omitempty"`
+	Body    string    `json:"body"`
+	Created time.Time `json:"created"`
+}
+
+// FaxCoverData is what the template sees.
+type FaxCoverData struct {
+	From       string
+	FromNumber string
+	To         string
+	ToNumber   string
+	Subject    string
+	Note       string
+	Pages      int // document pages plus the cover page
+	Date       time.Time
+	JobId      string
+}
+
+func faxCoverKey(account string, name string) string {
+	if account == ACCOUNT_ADMIN {
+		return name
+	}
+	return account + "/" + name
+}
+
+// faxCoverTemplateGet returns the template of the account, or the shared one.
+// The name has no "/", an account only reaches its own and the shared keys.
+func faxCoverTemplateGet(account string, name string) (FaxCoverTemplate, error) {
+	var t FaxCoverTemplate
+	if name == "" && account != ACCOUNT_ADMIN {
+		if a, err := accountGet(account); err == nil {
+			name = a.CoverTemplate
+		}
+	}
+	if name == "" {
+		name = FAX_COVER_DEFAULT
+	}
+	if !faxCoverNameRe.MatchString(name) {
+		return t, fmt.Errorf("invalid cover template name [%s]", name)
+	}
+	for _, key := range []string{faxCoverKey(account, name), name} {
+		found, err := storeGet(faxCoverBucket, key, &t)
+		if err != nil {
+			return t, err
+		}
+		if found {
+			break
+		}
+	}
+	if t.Name == "" {
+		if name != FAX_COVER_DEFAULT {
+			return t, fmt.Errorf("cover template not found [%s]", name)
+		}
+		t = FaxCoverTemplate{Name: FAX_COVER_DEFAULT, Body: faxCoverDefaultBody}
+	}
+	return t, nil
+}
+
+// faxCoverTemplateList returns the shared templates and the ones of the
+// account, every one for ACCOUNT_ADMIN.
+func faxCoverTemplateList(account string) ([]FaxCoverTemplate, error) {
+	list := []FaxCoverTemplate{}
+	stored := false
+	err := storeEach(faxCoverBucket, func(b []byte) error {
+		var t FaxCoverTemplate
+		if err := json.Unmarshal(b, &t); err != nil {
+			fmt.Printf("invalid cover template record [%s]\n", err)
+			return nil
+		}
+		if account != ACCOUNT_ADMIN && t.Account != ACCOUNT_ADMIN && t.Account != account {
+			return nil
+		}
+		stored = stored || (t.Name == FAX_COVER_DEFAULT && t.Account == ACCOUNT_ADMIN)
+		list = append(list, t)
+		return nil
+	})
+	if !stored {
+		list = append([]FaxCoverTemplate{{Name: FAX_COVER_DEFAULT, Body: faxCoverDefaultBody}}, list...)
+	}
+	return list, err
+}
+
+func faxCoverExecute(body string, data FaxCoverData) ([]byte, error) {
+	t, err := template.New("cover").Option("missingkey=error").Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// faxCoverCheck parses and runs the template on sample data.
+func faxCoverCheck(body string) error {
+	_, err := faxCoverExecute(body, FaxCoverData{From: "HCT", FromNumber: "15145550100", To: "Recipient",
+	                                             ToNumber: "15145550199", Subject: "Subject", Note: "Note", Pages: 2,
+	                                             Date: time.Now(), JobId: "job"})
+	return err
+}
+
+// faxCoverRequestCheck checks the template the request asks for exists.
+func faxCoverRequestCheck(account string, cover *FaxCover) error {
+	if cover == nil {
+		return nil
+	}
+	_, err := faxCoverTemplateGet(account, cover.Template)
+	return err
+}
+
+// faxCoverForm reads the cover_* form fields, no cover unless one is set.
+func faxCoverForm(r *http.Request) *FaxCover {
+	cover := FaxCover{Template: r.FormValue("cover_template"), From: r.FormValue("cover_from"),
+	                  To: r.FormValue("cover_to"), Subject: r.FormValue("cover_subject"), Note: r.FormValue("cover_note")}
+	if cover == (FaxCover{}) && r.FormValue("cover") != "true" && r.FormValue("cover") != "1" {
+		return nil
+	}
+	return &cover
+}
+
+// faxCoverAdd renders the cover page of the job, converts it with the options
+// of the document and returns the TIFF with the cover in front of the pages.
+func faxCoverAdd(job FaxJob, tiff string, pages int) (string, error) {
+	req := job.Request
+	t, err := faxCoverTemplateGet(job.Account, req.Cover.Template)
+	if err != nil {
+		return "", err
+	}
+	from := req.Cover.From
+	if from == "" {
+		from = req.CallerIdName
+	}
+	if from == "" {
+		from = req.Ident
+	}
+	b, err := faxCoverExecute(t.Body, FaxCoverData{From: from, FromNumber: req.CallerIdNumber, To: req.Cover.To,
+	                                               ToNumber: req.Destination, Subject: req.Cover.Subject,
+	                                               Note: req.Cover.Note, Pages: pages + 1, Date: time.Now(),
+	                                               JobId: job.Id})
+	if err != nil {
+		return "", fmt.Errorf("template %s [%s]", t.Name, err)
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return "", errors.New("template " + t.Name + " rendered an empty page")
+	}
+	if ps := bytes.TrimSpace(b); bytes.HasPrefix(ps, []byte("%!PS")) {
+		b = ps
+	}
+	// named after the job, the document and its TIFF can be shared by a broadcast
+	src := filepath.Join(filepath.Dir(job.Document), job.Id+"-cover")
+	if err := os.WriteFile(src, b, 0666); err != nil {
+		return "", err
+	}
+	cover, err := faxConvert(src, FaxConvertOptions{Resolution: req.Resolution, PageSize: req.PageSize})
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(filepath.Dir(tiff), job.Id+"-fax.tiff")
+	if err := faxExec("tiffcp", "-c", "g4", cover, tiff, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// faxCoversHandler serves /faxes/covers (GET list, POST store a template) and
+// GET, DELETE /faxes/covers/{name}, the admin key gives ?account= to list,
+// store and reach the templates of an account.
+func faxCoversHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "covers"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/faxes/covers"), "/")
+	account := accountOf(r)
+	if account == ACCOUNT_ADMIN && r.URL.Query().Get("account") != "" {
+		account = r.URL.Query().Get("account")
+		if _, err := accountGet(account); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	switch {
+	case name == "" && r.Method == "GET":
+		list, err := faxCoverTemplateList(account)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case name == "" && r.Method == "POST":
+		var t FaxCoverTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cover template [%s]", err), http.StatusBadRequest)
+			return
+		}
+		if !faxCoverNameRe.MatchString(t.Name) {
+			http.Error(w, fmt.Sprintf("invalid cover template name [%s]", t.Name), http.StatusBadRequest)
+			return
+		}
+		if err := faxCoverCheck(t.Body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cover template [%s]", err), http.StatusBadRequest)
+			return
+		}
+		t.Account = account
+		t.Created = time.Now()
+		if err := storePut(faxCoverBucket, faxCoverKey(account, t.Name), t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("cover template[%s] account[%s] stored\n", t.Name, t.Account)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	case name != "" && r.Method == "GET":
+		t, err := faxCoverTemplateGet(account, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	case name != "" && r.Method == "DELETE":
+		var t FaxCoverTemplate
+		found := false
+		if faxCoverNameRe.MatchString(name) {
+			found, _ = storeGet(faxCoverBucket, faxCoverKey(account, name), &t)
+		}
+		if !found {
+			http.Error(w, "cover template not found ["+name+"]", http.StatusNotFound)
+			return
+		}
+		if err := storeDelete(faxCoverBucket, faxCoverKey(account, name)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Delivery queue of the webhooks and of the fax-to-email mails: a delivery is
+// kept in its bucket of the fax store until it is sent, attempted again after
+// the backoff and dropped once the attempts run out. Stop ends the deliveries
+// waiting for their next attempt, they are resumed from the store on start.
+
+// DeliveryState is the retry state of a delivery, embedded in the record.
+type DeliveryState struct {
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type DeliveryQueue struct {
+	name        string // in the logs, e.g. "mail delivery"
+	bucket      []byte
+	backoff     []time.Duration
+	maxAttempts int
+	mu          sync.Mutex
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// deliveryDropError ends a delivery without another attempt.
+type deliveryDropError struct {
+	err error
+}
+
+func (e deliveryDropError) Error() string {
+	return e.err.Error()
+}
+
+func deliveryDrop(err error) error {
+	return deliveryDropError{err: err}
+}
+
+func deliveryQueueNew(name string, bucket []byte, backoff []time.Duration, maxAttempts int) *DeliveryQueue {
+	return &DeliveryQueue{name: name, bucket: bucket, backoff: backoff, maxAttempts: maxAttempts,
+	                      stop: make(chan struct{})}
+}
+
+// Go runs f, a delivery or a stream of them, in a goroutine Stop waits for.
+func (q *DeliveryQueue) Go(f func()) {
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		f()
+	}()
+}
+
+// Stop ends the deliveries waiting for an attempt and waits for the ones being
+// sent, the queue takes new deliveries again after it.
+func (q *DeliveryQueue) Stop() {
+	q.mu.Lock()
+	close(q.stop)
+	q.mu.Unlock()
+	q.wg.Wait()
+	q.mu.Lock()
+	q.stop = make(chan struct{})
+	q.mu.Unlock()
+}
+
+func (q *DeliveryQueue) stopped() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stop
+}
+
+// Run attempts the delivery id until send succeeds, send fails with a
+// deliveryDrop error or the attempts run out. state is the DeliveryState of
+// record, record is stored again after a failed attempt.
+func (q *DeliveryQueue) Run(id string, what string, state *DeliveryState, record interface{}, send func() error) {
+	stop := q.stopped()
+	for {
+		if wait := time.Until(state.NextAttempt); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		err := send()
+		var drop deliveryDropError
+		if errors.As(err, &drop) {
+			fmt.Printf("%s[%s] dropped [%s]\n", q.name, id, drop.err)
+			storeDelete(q.bucket, id)
+			return
+		}
+		state.Attempts++
+		if err == nil {
+			fmt.Printf("%s[%s] %s delivered attempt[%d]\n", q.name, id, what, state.Attempts)
+			storeDelete(q.bucket, id)
+			return
+		}
+		state.LastError = err.Error()
+		if state.Attempts >= q.maxAttempts {
+			fmt.Printf("%s[%s] %s failed after %d attempts [%s]\n", q.name, id, what, state.Attempts, err)
+			storeDelete(q.bucket, id)
+			return
+		}
+		i := state.Attempts - 1
+		if i >= len(q.backoff) {
+			i = len(q.backoff) - 1
+		}
+		state.NextAttempt = time.Now().Add(q.backoff[i])
+		fmt.Printf("%s[%s] %s attempt[%d] error [%s], next at %s\n", q.name, id, what, state.Attempts, err,
+		           state.NextAttempt.Format(time.RFC3339))
+		if err := storePut(q.bucket, id, record); err != nil {
+			fmt.Printf("%s[%s] store error [%s]\n", q.name, id, err)
+		}
+	}
+}
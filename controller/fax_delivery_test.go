@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type deliveryTestRecord struct {
+	Id string `json:"id"`
+	DeliveryState
+}
+
+// deliveryTestRun runs a delivery of the queue until it ends, sends counts the attempts.
+func deliveryTestRun(t *testing.T, q *DeliveryQueue, errs ...error) (deliveryTestRecord, int, bool) {
+	d := deliveryTestRecord{Id: "d-1"}
+	if err := storePut(q.bucket, d.Id, d); err != nil {
+		t.Fatal(err)
+	}
+	sends := 0
+	q.Run(d.Id, "test", &d.DeliveryState, &d, func() error {
+		sends++
+		if sends <= len(errs) {
+			return errs[sends-1]
+		}
+		return nil
+	})
+	var stored deliveryTestRecord
+	found, err := storeGet(q.bucket, d.Id, &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, sends, found
+}
+
+func TestDeliveryQueueRun(t *testing.T) {
+	testStore(t)
+	q := deliveryQueueNew("test delivery", []byte("test_deliveries"), []time.Duration{time.Millisecond}, 3)
+	failed := errors.New("receiver down")
+
+	d, sends, found := deliveryTestRun(t, q)
+	if sends != 1 || d.Attempts != 1 || found {
+		t.Errorf("delivered: sends %d attempts %d stored %t, expected 1 1 false", sends, d.Attempts, found)
+	}
+	d, sends, found = deliveryTestRun(t, q, failed, failed)
+	if sends != 3 || d.Attempts != 3 || d.LastError != failed.Error() || found {
+		t.Errorf("delivered after retries: sends %d attempts %d [%s] stored %t", sends, d.Attempts, d.LastError, found)
+	}
+	d, sends, found = deliveryTestRun(t, q, failed, failed, failed, failed)
+	if sends != 3 || d.Attempts != 3 || found {
+		t.Errorf("attempts run out: sends %d attempts %d stored %t, expected 3 3 false", sends, d.Attempts, found)
+	}
+	d, sends, found = deliveryTestRun(t, q, deliveryDrop(errors.New("no secret")))
+	if sends != 1 || d.Attempts != 0 || found {
+		t.Errorf("dropped: sends %d attempts %d stored %t, expected 1 0 false", sends, d.Attempts, found)
+	}
+}
+
+func TestDeliveryQueueStop(t *testing.T) {
+	testStore(t)
+	q := deliveryQueueNew("test delivery", []byte("test_deliveries"), []time.Duration{time.Hour}, 3)
+	d := deliveryTestRecord{Id: "d-1"}
+	q.Go(func() {
+		q.Run(d.Id, "test", &d.DeliveryState, &d, func() error { return errors.New("receiver down") })
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var stored deliveryTestRecord
+		if found, _ := storeGet(q.bucket, d.Id, &stored); found && stored.Attempts == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed attempt not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopped := make(chan bool)
+	go func() {
+		q.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery waiting for its next attempt not stopped")
+	}
+	// the delivery stays in the store to be resumed
+	var stored deliveryTestRecord
+	if found, _ := storeGet(q.bucket, d.Id, &stored); !found {
+		t.Fatal("stopped delivery not kept")
+	}
+}
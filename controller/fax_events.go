@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+// Live progress of the fax jobs, built from the FreeSWITCH events of the call
+// and the job state changes, streamed on GET /faxes/{id}/events as
+// Server-Sent Events or over a WebSocket when the request asks for an upgrade.
+// The events of a job are kept in memory so a late client gets them all.
+
+const (
+	FAX_PHASE_STATE       = "state"
+	FAX_PHASE_CALL_SETUP  = "call_setup"
+	FAX_PHASE_NEGOTIATION = "negotiation" // DIS/DCS exchange
+	FAX_PHASE_TRAINING    = "training"
+	FAX_PHASE_PAGE        = "page"        // page sent, MCF (confirmed) or RTN (to resend)
+	FAX_PHASE_RESULT      = "result"
+	FAX_PHASE_HANGUP      = "hangup"
+)
+
+// how long the events of an ended job stay available
+const FAX_PROGRESS_KEEP = 10 * time.Minute
+const FAX_PROGRESS_PING = 15 * time.Second
+
+type FaxProgress struct {
+	Seq      int       `json:"seq"`
+	Time     time.Time `json:"time"`
+	Phase    string    `json:"phase"`
+	State    string    `json:"state,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Page     int       `json:"page,omitempty"`     // document page
+	Pages    int       `json:"pages,omitempty"`    // document pages
+	Response string    `json:"response,omitempty"` // MCF or RTN
+	Rate     int       `json:"rate,omitempty"`
+}
+
+var (
+	faxProgressMu        sync.Mutex
+	faxProgressLog       = make(map[string][]FaxProgress)
+	faxProgressSubs      = make(map[string]map[chan FaxProgress]bool)
+	faxProgressConfirmed = make(map[string]int) // pages confirmed during the current call
+)
+
+var faxWsUpgrader = websocket.Upgrader{CheckOrigin: faxWsOriginCheck}
+
+// faxWsOriginCheck accepts the WebSocket of a client without Origin (not a
+// browser), of a page served by the controller, or of an origin listed in
+// WS_ORIGINS (scheme://host[:port]).
+func faxWsOriginCheck(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range strings.Split(config.WsOrigins, ",") {
+		o = strings.TrimSpace(o)
+		if o != "" && strings.EqualFold(strings.TrimSuffix(o, "/"), u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	fmt.Printf("websocket origin [%s] refused\n", origin)
+	return false
+}
+
+func faxProgressPublish(id string, p FaxProgress) {
+	faxProgressMu.Lock()
+	defer faxProgressMu.Unlock()
+	p.Seq = len(faxProgressLog[id]) + 1
+	p.Time = time.Now()
+	faxProgressLog[id] = append(faxProgressLog[id], p)
+	for ch := range faxProgressSubs[id] {
+		select {
+		case ch <- p:
+		default:
+			fmt.Printf("fax job[%s] progress subscriber too slow, event %d dropped\n", id, p.Seq)
+		}
+	}
+	if p.Phase == FAX_PHASE_STATE && faxStateTerminal(p.State) {
+		delete(faxProgressConfirmed, id)
+		time.AfterFunc(FAX_PROGRESS_KEEP, func() {
+			faxProgressMu.Lock()
+			delete(faxProgressLog, id)
+			faxProgressMu.Unlock()
+		})
+	}
+}
+
+// faxProgressSubscribe returns the events published so far and a channel for the next ones.
+func faxProgressSubscribe(id string) ([]FaxProgress, chan FaxProgress) {
+	faxProgressMu.Lock()
+	defer faxProgressMu.Unlock()
+	ch := make(chan FaxProgress, 64)
+	if faxProgressSubs[id] == nil {
+		faxProgressSubs[id] = make(map[chan FaxProgress]bool)
+	}
+	faxProgressSubs[id][ch] = true
+	past := make([]FaxProgress, len(faxProgressLog[id]))
+	copy(past, faxProgressLog[id])
+	return past, ch
+}
+
+func faxProgressUnsubscribe(id string, ch chan FaxProgress) {
+	faxProgressMu.Lock()
+	defer faxProgressMu.Unlock()
+	delete(faxProgressSubs[id], ch)
+	if len(faxProgressSubs[id]) == 0 {
+		delete(faxProgressSubs, id)
+	}
+}
+
+func faxProgressState(job FaxJob) {
+	detail := ""
+	if len(job.History) > 0 {
+		detail = job.History[len(job.History)-1].Detail
+	}
+	faxProgressPublish(job.Id, FaxProgress{Phase: FAX_PHASE_STATE, State: job.State, Detail: detail})
+}
+
+// faxProgressCall turns a call event into a progress event, first is the
+// index of the first document page sent by the call, total the document pages.
+func faxProgressCall(id string, ev EslEvent, first int, total int) {
+	p := FaxProgress{Pages: total}
+	switch ev.Name() {
+	case "CHANNEL_PROGRESS":
+		p.Phase, p.Detail = FAX_PHASE_CALL_SETUP, "ringing"
+	case "CHANNEL_PROGRESS_MEDIA":
+		p.Phase, p.Detail = FAX_PHASE_CALL_SETUP, "early media"
+	case "CHANNEL_ANSWER":
+		faxProgressPublish(id, FaxProgress{Phase: FAX_PHASE_CALL_SETUP, Detail: "answered", Pages: total})
+		p.Phase, p.Detail = FAX_PHASE_NEGOTIATION, "waiting for DIS"
+	case "spandsp::txfaxnegociateresult":
+		p.Rate = int(faxAtoi(ev.Get("fax-transfer-rate")))
+		faxProgressPublish(id, FaxProgress{Phase: FAX_PHASE_NEGOTIATION, Pages: total, Rate: p.Rate,
+		                   Detail: fmt.Sprintf("DIS/DCS exchanged remote[%s]", ev.Get("fax-remote-station-id"))})
+		p.Phase = FAX_PHASE_TRAINING
+		p.Detail = fmt.Sprintf("trained at %d bps ecm[%s] t38[%s]", p.Rate, ev.Get("fax-ecm-used"), ev.Get("fax-t38-status"))
+	case "spandsp::txfaxpageresult":
+		confirmed := int(faxAtoi(ev.Get("fax-document-transferred-pages")))
+		faxProgressMu.Lock()
+		previous := faxProgressConfirmed[id]
+		faxProgressConfirmed[id] = confirmed
+		faxProgressMu.Unlock()
+		// spandsp only reports the confirmed pages, a page not counted was answered RTN
+		p.Phase = FAX_PHASE_PAGE
+		p.Page = first + confirmed
+		p.Response = "MCF"
+		if confirmed <= previous {
+			p.Page = first + previous + 1
+			p.Response = "RTN"
+		}
+		p.Detail = fmt.Sprintf("page %d of %d sent, %s bad rows[%s]", p.Page, total, p.Response, ev.Get("fax-bad-rows"))
+	case "spandsp::txfaxresult":
+		p.Phase = FAX_PHASE_RESULT
+		p.Detail = fmt.Sprintf("success[%s] result[%s][%s] pages[%s/%s]", ev.Get("fax-success"), ev.Get("fax-result-code"),
+		                       ev.Get("fax-result-text"), ev.Get("fax-document-transferred-pages"),
+		                       ev.Get("fax-document-total-pages"))
+	case "CHANNEL_HANGUP_COMPLETE":
+		faxProgressMu.Lock()
+		delete(faxProgressConfirmed, id)
+		faxProgressMu.Unlock()
+		p.Phase = FAX_PHASE_HANGUP
+		p.Detail = fmt.Sprintf("%s sip[%s]", ev.Get("Hangup-Cause"), ev.Get("variable_sip_term_status"))
+	default:
+		return
+	}
+	faxProgressPublish(id, p)
+}
+
+func faxProgressEnd(p FaxProgress) bool {
+	return p.Phase == FAX_PHASE_STATE && faxStateTerminal(p.State)
+}
+
+// faxProgressStream calls send with the events of the job from seq on, until
+// the job ends or the client goes away. send returns false on a write error.
+func faxProgressStream(r *http.Request, job FaxJob, seq int, send func(p FaxProgress) bool, ping func() bool) {
+	past, ch := faxProgressSubscribe(job.Id)
+	defer faxProgressUnsubscribe(job.Id, ch)
+	if len(past) == 0 && faxStateTerminal(job.State) {
+		// ended before this controller started or too long ago
+		send(FaxProgress{Seq: 0, Time: job.Updated, Phase: FAX_PHASE_STATE, State: job.State, Detail: job.Error})
+		return
+	}
+	for _, p := range past {
+		if p.Seq <= seq {
+			continue
+		}
+		if !send(p) || faxProgressEnd(p) {
+			return
+		}
+	}
+	ticker := time.NewTicker(FAX_PROGRESS_PING)
+	defer ticker.Stop()
+	for {
+		select {
+		case p := <-ch:
+			if p.Seq <= seq {
+				continue
+			}
+			if !send(p) || faxProgressEnd(p) {
+				return
+			}
+		case <-ticker.C:
+			if !ping() {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// faxEvents serves /faxes/{id}/events, Last-Event-ID resumes an interrupted stream.
+func faxEvents(w http.ResponseWriter, r *http.Request, job FaxJob) {
+	seq, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := faxWsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			fmt.Printf("fax job[%s] websocket error [%s]\n", job.Id, err)
+			return
+		}
+		defer conn.Close()
+		// the client only reads, its close is noticed by the reader
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}()
+		faxProgressStream(r, job, seq, func(p FaxProgress) bool {
+			return conn.WriteJSON(p) == nil
+		}, func() bool {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)) == nil
+		})
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		                  time.Now().Add(time.Second))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	faxProgressStream(r, job, seq, func(p FaxProgress) bool {
+		b, _ := json.Marshal(p)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", p.Seq, p.Phase, b); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}, func() bool {
+		if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	})
+}
+
+// faxUploadProgress writes the progress of the job sent from the upload page
+// as text lines, with a bar of the pages confirmed.
+func faxUploadProgress(w http.ResponseWriter, r *http.Request, job FaxJob) {
+	flusher, _ := w.(http.Flusher)
+	confirmed := 0
+	faxProgressStream(r, job, 0, func(p FaxProgress) bool {
+		if p.Response == "MCF" {
+			confirmed = p.Page
+		}
+		bar := ""
+		if p.Pages > 0 {
+			bar = "[" + strings.Repeat("#", confirmed*20/p.Pages) + strings.Repeat("-", 20-confirmed*20/p.Pages) + "] "
+		}
+		line := p.Phase
+		if p.State != "" {
+			line += " " + p.State
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", bar, line, p.Detail); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}, func() bool {
+		return true
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Received faxes, the dialplan stores the image in paths.inbound and sets
+// fax_rx_file on the channel, when the call hangs up the controller converts
+// it to PDF and keeps its metadata in the fax store.
+
+var faxInboundBucket = []byte("inbound")
+
+type FaxInbound struct {
+	Id       string    `json:"id"`
+	Account  string    `json:"account,omitempty"` // account of the route of the DID
+	Caller   string    `json:"caller"`
+	Did      string    `json:"did"`
+	Tag      string    `json:"tag,omitempty"`
+	Mailbox  string    `json:"mailbox,omitempty"` // set by the route of the DID
+	Tiff     string    `json:"tiff"`
+	Pdf      string    `json:"pdf,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Received time.Time `json:"received"`
+	Report   FaxReport `json:"report"`
+}
+
+func faxInboundPut(fax *FaxInbound) error {
+	return storePut(faxInboundBucket, fax.Id, fax)
+}
+
+func faxInboundGet(id string) (FaxInbound, error) {
+	var fax FaxInbound
+	found, err := storeGet(faxInboundBucket, id, &fax)
+	if err == nil && !found {
+		err = fmt.Errorf("inbound fax not found [%s]", id)
+	}
+	return fax, err
+}
+
+func faxInboundList() ([]FaxInbound, error) {
+	var faxes []FaxInbound
+	err := storeEach(faxInboundBucket, func(b []byte) error {
+		var fax FaxInbound
+		if err := json.Unmarshal(b, &fax); err != nil {
+			fmt.Printf("invalid inbound fax record [%s]\n", err)
+			return nil
+		}
+		faxes = append(faxes, fax)
+		return nil
+	})
+	sort.Slice(faxes, func(i, j int) bool { return faxes[i].Received.After(faxes[j].Received) })
+	return faxes, err
+}
+
+func faxTiffToPdf(tiff string) (string, error) {
+	// tiff2pdf -o rx.pdf -p A4 -F rx.tiff
+	pdf := strings.TrimSuffix(tiff, ".tiff")+".pdf"
+	cmd := exec.Command("tiff2pdf", "-o", pdf, "-p", "A4", "-F", tiff)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("tiff2pdf error [%s][%s]", err, strings.TrimSpace(string(output)))
+	}
+	return pdf, nil
+}
+
+func faxInboundProcess(hangup EslEvent) {
+	fax := FaxInbound{
+		Id:       hangup.Get("Unique-ID"),
+		Caller:   hangup.Get("Caller-Caller-ID-Number"),
+		Did:      hangup.Get("Caller-Destination-Number"),
+		Tag:      hangup.Get("variable_sip_h_X-Fax-Tag"),
+		Mailbox:  hangup.Get("variable_fax_mailbox"),
+		Account:  hangup.Get("variable_fax_account"),
+		Tiff:     hangup.Get("variable_fax_rx_file"),
+		Received: time.Now(),
+		Report:   faxReportCreate(hangup.Get("Unique-ID"), "rxfax", hangup, EslEvent{}),
+	}
+	fax.Report.Account = fax.Account
+	fmt.Printf("inbound fax[%s] caller[%s] did[%s] result[%s] pages[%d]\n", fax.Id, fax.Caller, fax.Did,
+	           fax.Report.Result, fax.Report.PagesTransferred)
+	if _, err := os.Stat(fax.Tiff); err != nil {
+		fax.Error = fmt.Sprintf("no image received [%s]", err)
+	} else {
+		pdf, err := faxTiffToPdf(fax.Tiff)
+		if err != nil {
+			fax.Error = err.Error()
+		}
+		fax.Pdf = pdf
+	}
+	if err := faxInboundPut(&fax); err != nil {
+		fmt.Printf("inbound fax[%s] store error [%s]\n", fax.Id, err)
+	}
+	faxReportPublish(fax.Report)
+	webhookInboundEvent(fax)
+	mailInboundEvent(fax)
+}
+
+// faxInboundRun picks up the hangup of every received fax.
+func faxInboundRun() {
+	if err := os.MkdirAll(config.Paths.Inbound, 0777); err != nil {
+		fmt.Printf("inbound fax directory error [%s]\n", err)
+	}
+	events := eslSubscribe("CHANNEL_HANGUP_COMPLETE")
+	for ev := range events {
+		if ev.Get("variable_fax_rx_file") == "" {
+			continue
+		}
+		go faxInboundProcess(ev)
+	}
+}
+
+func faxInboundDownload(w http.ResponseWriter, r *http.Request, fax FaxInbound, format string) {
+	fn := ""
+	switch format {
+	case "pdf":
+		fn = fax.Pdf
+		w.Header().Set("Content-Type", "application/pdf")
+	case "tiff":
+		fn = fax.Tiff
+		w.Header().Set("Content-Type", "image/tiff")
+	default:
+		http.Error(w, "unknown format [" + format + "]", http.StatusNotFound)
+		return
+	}
+	if fn == "" || !checkFileExists(fn) {
+		http.Error(w, format + " not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", fax.Id, format))
+	http.ServeFile(w, r, fn)
+}
+
+// faxInboundHandler serves /faxes/inbound (filters: did, caller, tag), /faxes/inbound/{id} and /faxes/inbound/{id}/{pdf|tiff}
+func faxInboundHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "inbound"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/faxes/inbound"), "/")
+	w.Header().Set("Content-Type", "application/json")
+	if path == "" {
+		faxes, err := faxInboundList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		did := r.URL.Query().Get("did")
+		caller := r.URL.Query().Get("caller")
+		tag := r.URL.Query().Get("tag")
+		res := []FaxInbound{}
+		for _, fax := range faxes {
+			if !accountVisible(r, fax.Account) {
+				continue
+			}
+			if (did != "" && fax.Did != did) || (caller != "" && fax.Caller != caller) || (tag != "" && fax.Tag != tag) {
+				continue
+			}
+			res = append(res, fax)
+		}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	parts := strings.Split(path, "/")
+	fax, err := faxInboundGet(parts[0])
+	if err != nil || !accountVisible(r, fax.Account) {
+		http.Error(w, "inbound fax not found ["+parts[0]+"]", http.StatusNotFound)
+		return
+	}
+	if len(parts) > 1 {
+		faxInboundDownload(w, r, fax, parts[1])
+		return
+	}
+	json.NewEncoder(w).Encode(fax)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+// Fax-to-email, every received fax is mailed as a PDF attachment to the
+// mailboxes of the rules matching its DID, through the SMTP relay given by
+// SMTP_HOST/SMTP_PORT (SMTP_USERNAME/SMTP_PASSWORD when the relay wants
+// authentication). Like the webhook deliveries, the mails are kept in the fax
+// store until the relay accepts them and are retried with backoff. The status
+// replies of the email-to-fax gateway go out the same way.
+
+const MAIL_MAX_ATTEMPTS = 10
+const MAIL_DID_ANY = "*"
+
+var mailBackoff = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour}
+
+var mailboxBucket = []byte("mailboxes")
+var mailDeliveryBucket = []byte("mail_deliveries")
+
+var mailDeliveries = deliveryQueueNew("mail delivery", mailDeliveryBucket, mailBackoff, MAIL_MAX_ATTEMPTS)
+
+// Mailbox is a rule, faxes received on Did ("*" for any) or routed to the
+// mailbox (see fax_route.go) are mailed to To.
+type Mailbox struct {
+	Id      string    `json:"id"`
+	Account string    `json:"account,omitempty"` // only gets the faxes of the account
+	Did     string    `json:"did"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject,omitempty"` // default "Fax from <caller>"
+	Created time.Time `json:"created"`
+}
+
+type MailDelivery struct {
+	Id          string    `json:"id"`
+	Account     string    `json:"account,omitempty"`
+	MailboxId   string    `json:"mailbox_id,omitempty"`
+	InboundId   string    `json:"inbound_id,omitempty"`
+	JobId       string    `json:"job_id,omitempty"` // status reply of a job sent by email
+	InReplyTo   string    `json:"in_reply_to,omitempty"`
+	To          []string  `json:"to"`
+	Subject     string    `json:"subject"`
+	Created     time.Time `json:"created"`
+	DeliveryState
+}
+
+func mailboxList() ([]Mailbox, error) {
+	boxes := []Mailbox{}
+	err := storeEach(mailboxBucket, func(b []byte) error {
+		var box Mailbox
+		if err := json.Unmarshal(b, &box); err != nil {
+			fmt.Printf("invalid mailbox record [%s]\n", err)
+			return nil
+		}
+		boxes = append(boxes, box)
+		return nil
+	})
+	return boxes, err
+}
+
+func mailboxGet(id string) (Mailbox, error) {
+	var box Mailbox
+	found, err := storeGet(mailboxBucket, id, &box)
+	if err == nil && !found {
+		err = fmt.Errorf("mailbox not found [%s]", id)
+	}
+	return box, err
+}
+
+func mailboxCheck(box Mailbox) error {
+	if box.Did == "" {
+		return errors.New("missing did, \"*\" for any")
+	}
+	if len(box.To) == 0 {
+		return errors.New("missing to")
+	}
+	for _, to := range box.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid address [%s]", to)
+		}
+	}
+	return nil
+}
+
+func mailFrom() string {
+	from := config.Smtp.From
+	if from == "" {
+		from = "fax@" + config.Net.LocalIp
+	}
+	return from
+}
+
+// mailMessage builds the MIME message, the text part describes the fax and
+// the PDF is attached when the conversion worked.
+func mailMessage(d MailDelivery, fax FaxInbound) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	mailHeader(&buf, d, fax.Id)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	r := fax.Report
+	fmt.Fprintf(part, "Fax received on %s\r\n\r\n", fax.Did)
+	fmt.Fprintf(part, "Caller ID:     %s\r\n", fax.Caller)
+	fmt.Fprintf(part, "Remote ident:  %s\r\n", r.RemoteStationId)
+	fmt.Fprintf(part, "Received:      %s\r\n", fax.Received.Format(time.RFC1123))
+	fmt.Fprintf(part, "Pages:         %d\r\n", r.PagesTransferred)
+	fmt.Fprintf(part, "Result:        %s (%d %s)\r\n", r.Result, r.ResultCode, r.ResultText)
+	fmt.Fprintf(part, "Transfer rate: %d bps, ECM %t\r\n", r.TransferRate, r.EcmUsed)
+	if fax.Error != "" {
+		fmt.Fprintf(part, "\r\nNo PDF attached: %s\r\n", fax.Error)
+	}
+
+	if fax.Pdf != "" && fax.Error == "" {
+		b, err := os.ReadFile(fax.Pdf)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(fax.Pdf)
+		h = make(textproto.MIMEHeader)
+		h.Set("Content-Type", fmt.Sprintf("application/pdf; name=\"%s\"", name))
+		h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+		h.Set("Content-Transfer-Encoding", "base64")
+		part, err = w.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		enc := base64.StdEncoding.EncodeToString(b)
+		for len(enc) > 76 {
+			fmt.Fprintf(part, "%s\r\n", enc[:76])
+			enc = enc[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", enc)
+	}
+	w.Close()
+	return buf.Bytes(), nil
+}
+
+func mailHeader(buf *bytes.Buffer, d MailDelivery, faxId string) {
+	fmt.Fprintf(buf, "From: %s\r\n", mailFrom())
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(d.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", d.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s@hct-controller>\r\n", d.Id)
+	if d.InReplyTo != "" {
+		fmt.Fprintf(buf, "In-Reply-To: %s\r\nReferences: %s\r\n", d.InReplyTo, d.InReplyTo)
+	}
+	fmt.Fprintf(buf, "X-Fax-Id: %s\r\n", faxId)
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+}
+
+// mailStatusMessage is the reply to the sender of an email-to-fax job.
+func mailStatusMessage(d MailDelivery, job FaxJob) []byte {
+	var buf bytes.Buffer
+	mailHeader(&buf, d, job.Id)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Your fax to %s %s.\r\n\r\n", job.Request.Destination, job.State)
+	fmt.Fprintf(&buf, "Job:      %s\r\n", job.Id)
+	fmt.Fprintf(&buf, "Subject:  %s\r\n", job.Request.Email.Subject)
+	if job.TiffInfo != nil {
+		fmt.Fprintf(&buf, "Pages:    %d\r\n", job.TiffInfo.Pages)
+	}
+	fmt.Fprintf(&buf, "Attempts: %d\r\n", len(job.Attempts))
+	if job.Report != nil {
+		r := job.Report
+		fmt.Fprintf(&buf, "Sent:     %d pages, %d bps\r\n", r.PagesTransferred, r.TransferRate)
+		fmt.Fprintf(&buf, "Result:   %s (%d %s) %s\r\n", r.Result, r.ResultCode, r.ResultText, r.HangupCause)
+	}
+	if job.Error != "" {
+		fmt.Fprintf(&buf, "Error:    %s\r\n", job.Error)
+	}
+	fmt.Fprintf(&buf, "\r\n")
+	for _, h := range job.History {
+		fmt.Fprintf(&buf, "%s %-12s %s\r\n", h.Time.Format(time.RFC3339), h.State, h.Detail)
+	}
+	return buf.Bytes()
+}
+
+func mailSend(to []string, msg []byte) error {
+	host := config.Smtp.Host
+	if host == "" {
+		return errors.New("SMTP_HOST not set")
+	}
+	var auth smtp.Auth
+	if config.Smtp.Username != "" {
+		auth = smtp.PlainAuth("", config.Smtp.Username, config.Smtp.Password, host)
+	}
+	from, err := mail.ParseAddress(mailFrom())
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM [%s]", mailFrom())
+	}
+	rcpt := []string{}
+	for _, t := range to {
+		a, err := mail.ParseAddress(t)
+		if err != nil {
+			return fmt.Errorf("invalid address [%s]", t)
+		}
+		rcpt = append(rcpt, a.Address)
+	}
+	// STARTTLS is used when the relay offers it
+	return smtp.SendMail(net.JoinHostPort(host, strconv.Itoa(config.Smtp.Port)), auth, from.Address, rcpt, msg)
+}
+
+// mailDeliver sends until the relay accepts the mail or the attempts run out.
+func mailDeliver(d MailDelivery) {
+	mailDeliveries.Run(d.Id, fmt.Sprintf("to%v", d.To), &d.DeliveryState, &d, func() error {
+		if d.JobId != "" {
+			job, err := faxStoreGet(d.JobId)
+			if err != nil {
+				return err
+			}
+			return mailSend(d.To, mailStatusMessage(d, job))
+		}
+		fax, err := faxInboundGet(d.InboundId)
+		if err != nil {
+			return err
+		}
+		msg, err := mailMessage(d, fax)
+		if err != nil {
+			return err
+		}
+		return mailSend(d.To, msg)
+	})
+}
+
+// mailInboundEvent queues a mail for every mailbox rule matching the DID of the fax.
+func mailInboundEvent(fax FaxInbound) {
+	boxes, err := mailboxList()
+	if err != nil {
+		fmt.Printf("mailbox list error [%s]\n", err)
+		return
+	}
+	for _, box := range boxes {
+		if box.Did != MAIL_DID_ANY && box.Did != fax.Did && box.Id != fax.Mailbox {
+			continue
+		}
+		if box.Account != ACCOUNT_ADMIN && box.Account != fax.Account {
+			continue
+		}
+		subject := box.Subject
+		if subject == "" {
+			subject = "Fax from " + fax.Caller
+		}
+		mailQueue(MailDelivery{Account: fax.Account, MailboxId: box.Id, InboundId: fax.Id, To: box.To, Subject: subject})
+	}
+}
+
+func mailQueue(d MailDelivery) {
+	d.Id = uuid.NewString()
+	d.NextAttempt = time.Now()
+	d.Created = time.Now()
+	if err := storePut(mailDeliveryBucket, d.Id, d); err != nil {
+		fmt.Printf("mail delivery[%s] store error [%s]\n", d.Id, err)
+	}
+	mailDeliveries.Go(func() { mailDeliver(d) })
+}
+
+// mailJobEvent answers the sender of an email-to-fax job when it ends.
+func mailJobEvent(job FaxJob) {
+	if job.Request.Email == nil || !faxStateTerminal(job.State) {
+		return
+	}
+	subject := job.Request.Email.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	mailQueue(MailDelivery{Account: job.Account, JobId: job.Id, To: []string{job.Request.Email.From},
+	                       InReplyTo: job.Request.Email.MessageId,
+	                       Subject: fmt.Sprintf("%s [fax %s]", subject, job.State)})
+}
+
+func mailDeliveryList() ([]MailDelivery, error) {
+	pending := []MailDelivery{}
+	err := storeEach(mailDeliveryBucket, func(b []byte) error {
+		var d MailDelivery
+		if err := json.Unmarshal(b, &d); err == nil {
+			pending = append(pending, d)
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// mailResume restarts the mails pending when the controller stopped.
+func mailResume() {
+	pending, err := mailDeliveryList()
+	if err != nil {
+		fmt.Printf("mail resume error [%s]\n", err)
+	}
+	for _, d := range pending {
+		fmt.Printf("mail delivery[%s] to%v resuming\n", d.Id, d.To)
+		d := d
+		mailDeliveries.Go(func() { mailDeliver(d) })
+	}
+}
+
+// mailboxesHandler serves /mailboxes (GET list, POST create), DELETE /mailboxes/{id}
+// and GET /mailboxes/queue, the mails waiting for a retry.
+func mailboxesHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "mailboxes"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/mailboxes"), "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		boxes, err := mailboxList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := []Mailbox{}
+		for _, box := range boxes {
+			if accountVisible(r, box.Account) {
+				res = append(res, box)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	case id == "queue" && r.Method == "GET":
+		pending, err := mailDeliveryList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := []MailDelivery{}
+		for _, d := range pending {
+			if accountVisible(r, d.Account) {
+				res = append(res, d)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	case id == "" && r.Method == "POST":
+		var box Mailbox
+		if err := json.NewDecoder(r.Body).Decode(&box); err != nil {
+			http.Error(w, fmt.Sprintf("invalid mailbox [%s]", err), http.StatusBadRequest)
+			return
+		}
+		if err := mailboxCheck(box); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		box.Id = uuid.NewString()
+		box.Account = accountOf(r)
+		box.Created = time.Now()
+		if err := storePut(mailboxBucket, box.Id, box); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("mailbox[%s] did[%s] to%v\n", box.Id, box.Did, box.To)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(box)
+	case id != "" && r.Method == "DELETE":
+		if box, err := mailboxGet(id); err != nil || !accountVisible(r, box.Account) {
+			http.Error(w, "mailbox not found ["+id+"]", http.StatusNotFound)
+			return
+		}
+		if err := storeDelete(mailboxBucket, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
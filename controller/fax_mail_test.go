@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mailTestMessage is a message accepted by mailTestServer.
+type mailTestMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// mailTestServer is the SMTP relay stand-in, it accepts every message and
+// hands it on the channel.
+func mailTestServer(t *testing.T) (string, int, <-chan mailTestMessage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	messages := make(chan mailTestMessage, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go mailTestSession(conn, messages)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, messages
+}
+
+func mailTestSession(conn net.Conn, messages chan<- mailTestMessage) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+	var msg mailTestMessage
+	reply("220 mail.test ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 mail.test")
+		case "MAIL":
+			msg = mailTestMessage{From: line[len("MAIL FROM:"):]}
+			reply("250 ok")
+		case "RCPT":
+			msg.To = append(msg.To, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data bytes.Buffer
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg.Data = data.Bytes()
+			messages <- msg
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// mailTestStore opens a fax store for the test, the settings it changes are
+// put back and its deliveries stopped before the store closes.
+func mailTestStore(t *testing.T) string {
+	dir := testStore(t)
+	testConfig(t)
+	t.Cleanup(mailDeliveries.Stop)
+	return dir
+}
+
+func TestMailInboundEvent(t *testing.T) {
+	dir := mailTestStore(t)
+	host, port, messages := mailTestServer(t)
+	config.Smtp = ConfigSmtp{Host: host, Port: port, From: "fax@hct.test"}
+	config.Net.LocalIp = "127.0.0.1"
+
+	pdf := filepath.Join(dir, "rx.pdf")
+	pdfData := []byte("%PDF-1.4 test fax")
+	if err := os.WriteFile(pdf, pdfData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	box := Mailbox{Id: "box-1", Did: "15145550100", To: []string{"Front Desk <desk@example.com>"},
+	               Created: time.Now()}
+	if err := storePut(mailboxBucket, box.Id, box); err != nil {
+		t.Fatal(err)
+	}
+	other := Mailbox{Id: "box-2", Did: "15145550199", To: []string{"other@example.com"}, Created: time.Now()}
+	if err := storePut(mailboxBucket, other.Id, other); err != nil {
+		t.Fatal(err)
+	}
+	fax := FaxInbound{Id: "fax-1", Caller: "15145550111", Did: "15145550100", Pdf: pdf, Received: time.Now(),
+	                  Report: FaxReport{Result: "success", ResultCode: 0, ResultText: "OK", PagesTransferred: 2,
+	                                    TransferRate: 14400}}
+	if err := faxInboundPut(&fax); err != nil {
+		t.Fatal(err)
+	}
+
+	mailInboundEvent(fax)
+
+	var msg mailTestMessage
+	select {
+	case msg = <-messages:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no mail received by the relay")
+	}
+	if len(msg.To) != 1 || msg.To[0] != "desk@example.com" {
+		t.Fatalf("recipients %v, expected [desk@example.com]", msg.To)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msg.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Fax from 15145550111" {
+		t.Fatalf("subject [%s], expected [Fax from 15145550111]", subject)
+	}
+	if m.Header.Get("X-Fax-Id") != fax.Id {
+		t.Fatalf("X-Fax-Id [%s], expected [%s]", m.Header.Get("X-Fax-Id"), fax.Id)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type [%s] [%v]", m.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	var text string
+	var attachment []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "application/pdf") {
+			if part.FileName() != "rx.pdf" {
+				t.Fatalf("attachment name [%s], expected [rx.pdf]", part.FileName())
+			}
+			attachment, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(b), "\r\n", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			text = string(b)
+		}
+	}
+	if !bytes.Equal(attachment, pdfData) {
+		t.Fatalf("attachment %q, expected %q", attachment, pdfData)
+	}
+	for _, s := range []string{"15145550111", "Pages:         2", "success (0 OK)"} {
+		if !strings.Contains(text, s) {
+			t.Fatalf("body misses [%s]:\n%s", s, text)
+		}
+	}
+	select {
+	case msg = <-messages:
+		t.Fatalf("unexpected mail to %v", msg.To)
+	case <-time.After(200 * time.Millisecond):
+	}
+	waitMailQueueEmpty(t)
+}
+
+func waitMailQueueEmpty(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := mailDeliveryList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries left in the queue %+v", pending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMailDeliverRetry(t *testing.T) {
+	mailTestStore(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close() // nothing listens, the relay is down
+	config.Smtp = ConfigSmtp{Host: "127.0.0.1", Port: port, From: "fax@hct.test"}
+
+	fax := FaxInbound{Id: "fax-2", Caller: "15145550111", Did: "15145550100", Error: "no image received",
+	                  Received: time.Now()}
+	if err := faxInboundPut(&fax); err != nil {
+		t.Fatal(err)
+	}
+	mailQueue(MailDelivery{InboundId: fax.Id, To: []string{"desk@example.com"}, Subject: "Fax from 15145550111"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := mailDeliveryList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 1 && pending[0].Attempts == 1 {
+			d := pending[0]
+			if d.LastError == "" || !strings.Contains(d.LastError, strconv.Itoa(port)) {
+				t.Fatalf("last error [%s], expected the connection error", d.LastError)
+			}
+			if wait := time.Until(d.NextAttempt); wait < mailBackoff[0]-time.Second || wait > mailBackoff[0] {
+				t.Fatalf("next attempt in %s, expected %s", wait, mailBackoff[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed delivery not queued for retry %+v", pending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"github.com/google/uuid"
+)
+
+// Fax interoperability matrix (Cmd.Type "fax_matrix"), the test document is
+// faxed once per combination of transport, ECM, V.17 and rate cap, each call
+// carrying its own spandsp channel variables.
+
+type FaxMatrix struct {
+	Transports []string `json:"transports"` // PCMU, PCMA (G.711 passthrough) or T38
+	Ecm        []bool   `json:"ecm"`
+	V17        []bool   `json:"v17"`
+	MaxRates   []int    `json:"max_rates"`  // 0 (no cap), 14400 or 9600
+}
+
+type FaxMatrixCell struct {
+	Transport        string `json:"transport"`
+	Ecm              bool   `json:"ecm"`
+	V17              bool   `json:"v17"`
+	MaxRate          int    `json:"max_rate"`
+	JobId            string `json:"job_id"`
+	Result           string `json:"result"`
+	TransferRate     int32  `json:"transfer_rate"`
+	EcmUsed          bool   `json:"ecm_used"`
+	T38Status        string `json:"t38_status"`
+	Duration         int32  `json:"duration"`
+	PagesTransferred int32  `json:"pages_transferred"`
+	PagesTotal       int32  `json:"pages_total"`
+	ResultText       string `json:"fax_result_text"`
+	Error            string `json:"error,omitempty"`
+}
+
+type FaxMatrixReport struct {
+	Uuid        string          `json:"uuid"`
+	Account     string          `json:"account,omitempty"`
+	Label       string          `json:"label"`
+	Action      string          `json:"action"`
+	Destination string          `json:"destination"`
+	Document    string          `json:"document"`
+	Passed      int             `json:"passed"`
+	Failed      int             `json:"failed"`
+	Cells       []FaxMatrixCell `json:"cells"`
+}
+
+func faxMatrixDefaults(m *FaxMatrix) {
+	if len(m.Transports) == 0 {
+		m.Transports = []string{"PCMU", "PCMA", "T38"}
+	}
+	if len(m.Ecm) == 0 {
+		m.Ecm = []bool{true, false}
+	}
+	if len(m.V17) == 0 {
+		m.V17 = []bool{true, false}
+	}
+	if len(m.MaxRates) == 0 {
+		m.MaxRates = []int{0}
+	}
+}
+
+// faxMatrixCells expands the matrix, V.17 with a 9600 cap is skipped as it can not be negotiated.
+func faxMatrixCells(m FaxMatrix) ([]FaxMatrixCell, error) {
+	faxMatrixDefaults(&m)
+	var cells []FaxMatrixCell
+	for _, transport := range m.Transports {
+		transport = strings.ToUpper(strings.Replace(transport, ".", "", -1))
+		if transport != "PCMU" && transport != "PCMA" && transport != "T38" {
+			return nil, fmt.Errorf("invalid transport [%s], expected PCMU, PCMA or T38", transport)
+		}
+		for _, ecm := range m.Ecm {
+			for _, v17 := range m.V17 {
+				for _, rate := range m.MaxRates {
+					if v17 && rate == 9600 {
+						continue
+					}
+					cells = append(cells, FaxMatrixCell{Transport: transport, Ecm: ecm, V17: v17, MaxRate: rate})
+				}
+			}
+		}
+	}
+	return cells, nil
+}
+
+func faxMatrixRequest(c Call, cell FaxMatrixCell) FaxRequest {
+	t38 := cell.Transport == "T38"
+	ecm := cell.Ecm
+	v17 := cell.V17
+	req := FaxRequest{Destination: c.Ruri, CallerIdNumber: c.From, Codec: cell.Transport, T38: &t38, Ecm: &ecm, V17: &v17,
+	                  MaxRate: cell.MaxRate}
+	if t38 {
+		req.Codec = "PCMU"
+	}
+	return req
+}
+
+func faxMatrixRun(cmd Cmd, c Call, document string, cell *FaxMatrixCell) {
+	cell.JobId = uuid.NewString()
+	req := faxMatrixRequest(c, *cell)
+	req.Tag = cell.JobId
+	job, err := faxTestJob(cmd.Uuid, cell.JobId, cmd.Account, document, req)
+	if job.Report != nil {
+		cell.TransferRate = job.Report.TransferRate
+		cell.EcmUsed = job.Report.EcmUsed
+		cell.T38Status = job.Report.T38Status
+		cell.Duration = job.Report.Duration
+		cell.PagesTransferred = job.Report.PagesTransferred
+		cell.PagesTotal = job.Report.PagesTotal
+		cell.ResultText = job.Report.ResultText
+	}
+	if err != nil {
+		cell.Error = err.Error()
+	} else if job.State != FAX_COMPLETED {
+		cell.Error = job.Error
+	}
+	if cell.Error == "" {
+		cell.Result = "PASS"
+	} else {
+		cell.Result = "FAIL"
+	}
+}
+
+func faxMatrixGrid(report FaxMatrixReport) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "transport\tecm\tv17\tmax_rate\tresult\trate\tecm_used\tt38\tduration\tpages\t")
+	for _, c := range report.Cells {
+		maxRate := "-"
+		if c.MaxRate > 0 {
+			maxRate = fmt.Sprintf("%d", c.MaxRate)
+		}
+		fmt.Fprintf(w, "%s\t%t\t%t\t%s\t%s\t%d\t%t\t%s\t%d\t%d/%d\t\n", c.Transport, c.Ecm, c.V17, maxRate, c.Result,
+		            c.TransferRate, c.EcmUsed, c.T38Status, c.Duration, c.PagesTransferred, c.PagesTotal)
+	}
+	w.Flush()
+	return b.String()
+}
+
+func cmdFaxMatrix(cmd Cmd, c Call, idx int) {
+	report := FaxMatrixReport{Uuid: cmd.Uuid, Account: cmd.Account, Label: uuid.NewString(), Action: "fax_matrix",
+	                          Destination: c.Ruri,
+	                          Document: cmd.Document, Cells: []FaxMatrixCell{}}
+	if report.Document == "" {
+		report.Document = FAX_TEST_DOCUMENT
+	}
+	cells, err := faxMatrixCells(cmd.Matrix)
+	if err != nil {
+		fmt.Printf("cmdFaxMatrix: uuid[%s] idx[%d] %s\n", cmd.Uuid, idx, err)
+	}
+	fmt.Printf("cmdFaxMatrix: uuid[%s] idx[%d] destination[%s] cells[%d]\n", cmd.Uuid, idx, c.Ruri, len(cells))
+	// one call at a time, cells must not compete for the same endpoints
+	for i := range cells {
+		if cmdJobCancelled(cmd.Uuid) {
+			break
+		}
+		faxMatrixRun(cmd, c, report.Document, &cells[i])
+		if cells[i].Result == "PASS" {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.Cells = append(report.Cells, cells[i])
+	}
+	fmt.Print(faxMatrixGrid(report))
+	reportJson, _ := json.Marshal(report)
+	rmqPublish(string(reportJson), config.Rmq.PubKeySummary)
+	x := cmdDecCallLeft(cmd.Uuid, 1)
+	fmt.Printf("uuid[%s] idx[%d] fax matrix completed left[%d] passed[%d] failed[%d]\n", cmd.Uuid, idx, x,
+	           report.Passed, report.Failed)
+	if x == 0 {
+		cmdJobState(cmd.Uuid, CMD_JOB_DONE, "")
+	}
+}
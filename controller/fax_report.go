@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// FaxReport is the outcome of a txfax/rxfax call, built from the spandsp
+// result channel variables found on the CHANNEL_HANGUP_COMPLETE event.
+type FaxReport struct {
+	Label            string `json:"label"`
+	Account          string `json:"account,omitempty"`
+	Start            string `json:"start"`
+	End              string `json:"end"`
+	Action           string `json:"action"`
+	From             string `json:"from"`
+	To               string `json:"to"`
+	Result           string `json:"result"`
+	CallId           string `json:"callid"`
+	CauseCode        int32  `json:"cause_code"`
+	HangupCause      string `json:"hangup_cause"`
+	Duration         int32  `json:"duration"`
+	Success          bool   `json:"fax_success"`
+	ResultCode       int32  `json:"fax_result_code"`
+	ResultText       string `json:"fax_result_text"`
+	PagesTransferred int32  `json:"pages_transferred"`
+	PagesTotal       int32  `json:"pages_total"`
+	TransferRate     int32  `json:"transfer_rate"`
+	EcmUsed          bool   `json:"ecm_used"`
+	T38Status        string `json:"t38_status"`
+	LocalStationId   string `json:"local_station_id"`
+	RemoteStationId  string `json:"remote_station_id"`
+	BadRows          int32  `json:"bad_rows"`
+	ImageResolution  string `json:"image_resolution"`
+}
+
+func faxAtoi(s string) int32 {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return int32(i)
+}
+
+// faxVariable reads a channel variable from the hangup event, falling back
+// to the header of the spandsp result event (fax_result_code -> fax-result-code).
+func faxVariable(hangup EslEvent, result EslEvent, name string) string {
+	if v := hangup.Get("variable_"+name); v != "" {
+		return v
+	}
+	if result.Headers == nil {
+		return ""
+	}
+	b := []byte(name)
+	for i := range b {
+		if b[i] == '_' {
+			b[i] = '-'
+		}
+	}
+	return result.Get(string(b))
+}
+
+func faxReportCreate(label string, action string, hangup EslEvent, result EslEvent) FaxReport {
+	v := func(name string) string { return faxVariable(hangup, result, name) }
+	report := FaxReport{
+		Label:            label,
+		Start:            hangup.Get("variable_start_stamp"),
+		End:              hangup.Get("variable_end_stamp"),
+		Action:           action,
+		From:             hangup.Get("Caller-Caller-ID-Number"),
+		To:               hangup.Get("Caller-Destination-Number"),
+		CallId:           hangup.Get("variable_sip_call_id"),
+		CauseCode:        faxAtoi(hangup.Get("variable_sip_term_status")),
+		HangupCause:      hangup.Get("Hangup-Cause"),
+		Duration:         faxAtoi(hangup.Get("variable_billsec")),
+		Success:          v("fax_success") == "1",
+		ResultCode:       faxAtoi(v("fax_result_code")),
+		ResultText:       v("fax_result_text"),
+		PagesTransferred: faxAtoi(v("fax_document_transferred_pages")),
+		PagesTotal:       faxAtoi(v("fax_document_total_pages")),
+		TransferRate:     faxAtoi(v("fax_transfer_rate")),
+		EcmUsed:          v("fax_ecm_used") == "on" || v("fax_ecm_used") == "1",
+		T38Status:        v("fax_t38_status"),
+		LocalStationId:   v("fax_local_station_id"),
+		RemoteStationId:  v("fax_remote_station_id"),
+		BadRows:          faxAtoi(v("fax_bad_rows")),
+		ImageResolution:  v("fax_image_resolution"),
+	}
+	if report.Success {
+		report.Result = "SUCCESS"
+	} else {
+		report.Result = "FAILED"
+	}
+	return report
+}
+
+func faxReportPublish(report FaxReport) {
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		fmt.Printf("invalid fax report [%s]\n", err)
+		return
+	}
+	rmqPublish(string(reportJson), config.Rmq.PubKeyFax)
+}
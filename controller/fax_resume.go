@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Resume of a partially delivered fax, a retry only sends the pages spandsp
+// did not confirm. The remaining pages are split out of the converted TIFF and
+// the first one can be stamped with a "continued" marker.
+
+// faxTiffSplit writes the pages of src from index first on to dst, the header
+// is pointed at the IFD of that page, the IFD chain after it is kept as is.
+func faxTiffSplit(src string, dst string, first int) error {
+	info, err := faxTiffInspect(src)
+	if err != nil {
+		return err
+	}
+	if first < 0 || first >= info.Pages {
+		return fmt.Errorf("page %d out of range, %d pages", first+1, info.Pages)
+	}
+	t, _, err := faxTiffOpen(src)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, len(t.b))
+	copy(b, t.b)
+	t.order.PutUint32(b[4:], info.PageList[first].ifdOffset)
+	return os.WriteFile(dst, b, 0666)
+}
+
+// faxBitmapText draws the text with the 7x13 basic font, each font pixel is
+// sx by sy page pixels, over a white box. x is the right edge of the text.
+func faxBitmapText(page *faxBitmap, x int, y int, text string, sx int, sy int) {
+	face := basicfont.Face7x13
+	width := len([]rune(text)) * face.Advance * sx
+	x -= width
+	margin := 2 * sx
+	for py := y - margin; py < y+face.Height*sy+margin; py++ {
+		for px := x - margin; px < x+width+margin; px++ {
+			page.Clear(px, py)
+		}
+	}
+	dot := fixed.P(0, face.Ascent)
+	for _, r := range text {
+		dr, mask, mp, advance, ok := face.Glyph(dot, r)
+		if ok {
+			for gy := 0; gy < dr.Dy(); gy++ {
+				for gx := 0; gx < dr.Dx(); gx++ {
+					_, _, _, a := mask.At(mp.X+gx, mp.Y+gy).RGBA()
+					if a < 0x8000 {
+						continue
+					}
+					for i := 0; i < sx; i++ {
+						for j := 0; j < sy; j++ {
+							page.Set(x+(dr.Min.X+gx)*sx+i, y+(dr.Min.Y+gy)*sy+j)
+						}
+					}
+				}
+			}
+		}
+		dot.X += advance
+	}
+}
+
+// faxTiffMarkContinued writes src to dst with the text stamped in the top
+// right corner of the first page, the pages are G4 encoded again by tiffcp.
+func faxTiffMarkContinued(src string, dst string, text string) error {
+	info, err := faxTiffInspect(src)
+	if err != nil {
+		return err
+	}
+	if info.Pages == 0 {
+		return errors.New("no page")
+	}
+	t, _, err := faxTiffOpen(src)
+	if err != nil {
+		return err
+	}
+	p := info.PageList[0]
+	img, err := faxTiffDecodePage(t, p)
+	if err != nil {
+		return err
+	}
+	page := faxBitmapNew(img.Bounds().Dx(), img.Bounds().Dy())
+	for y := 0; y < page.Height; y++ {
+		for x := 0; x < page.Width; x++ {
+			if faxLuminance(img, img.Bounds().Min.X+x, img.Bounds().Min.Y+y) < 0.5 {
+				page.Set(x, y)
+			}
+		}
+	}
+	// about 3.5 mm per character, a quarter inch from the top right corner
+	sx := int(math.Max(1, math.Round(p.XRes/50)))
+	sy := int(math.Max(1, math.Round(p.YRes/50)))
+	faxBitmapText(page, page.Width-int(p.XRes/4), int(p.YRes/4), text, sx, sy)
+	raw := dst+".raw"
+	defer os.Remove(raw)
+	if err := faxTiffWrite(raw, []*faxBitmap{page}, int(math.Round(p.XRes)), int(math.Round(p.YRes))); err != nil {
+		return err
+	}
+	if info.Pages == 1 {
+		return faxExec("tiffcp", "-c", "g4", raw, dst)
+	}
+	rest := dst+".rest"
+	defer os.Remove(rest)
+	if err := faxTiffSplit(src, rest, 1); err != nil {
+		return err
+	}
+	return faxExec("tiffcp", "-c", "g4", raw, rest, dst)
+}
+
+// faxPagesDelivered returns the number of pages of the document confirmed by
+// the previous attempts, each attempt counts the pages of the file it sent.
+func faxPagesDelivered(job FaxJob) int {
+	n := 0
+	for _, a := range job.Attempts {
+		n += int(a.Pages)
+	}
+	return n
+}
+
+// faxResumeTiff returns the TIFF to send for the attempt starting at page index first.
+func faxResumeTiff(job FaxJob, first int, total int) (string, error) {
+	if first == 0 {
+		return job.Tiff, nil
+	}
+	fn := filepath.Join(filepath.Dir(job.Tiff), fmt.Sprintf("%s-p%d.tiff", job.Id, first+1))
+	if !job.Request.ContinuedMarker {
+		return fn, faxTiffSplit(job.Tiff, fn, first)
+	}
+	rest := fn+".split"
+	defer os.Remove(rest)
+	if err := faxTiffSplit(job.Tiff, rest, first); err != nil {
+		return "", err
+	}
+	text := fmt.Sprintf("CONTINUED - PAGE %d OF %d", first+1, total)
+	return fn, faxTiffMarkContinued(rest, fn, text)
+}
+
+// faxAttemptPages fills the page range the attempt sent and the document pages it delivered.
+func faxAttemptPages(attempt *FaxAttempt, first int, total int) {
+	attempt.FirstPage = first + 1
+	attempt.LastPage = total
+	attempt.PagesDelivered = []int{}
+	for i := 0; i < int(attempt.Pages) && first+i < total; i++ {
+		attempt.PagesDelivered = append(attempt.PagesDelivered, first+i+1)
+	}
+}
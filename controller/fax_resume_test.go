@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFaxTiffSplit(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.tiff")
+	heights := []int{100, 200, 300}
+	var pages []*faxBitmap
+	for _, h := range heights {
+		pages = append(pages, faxBitmapNew(1728, h))
+	}
+	if err := faxTiffWrite(src, pages, 204, 196); err != nil {
+		t.Fatal(err)
+	}
+
+	for first := range heights {
+		dst := filepath.Join(dir, "dst.tiff")
+		if err := faxTiffSplit(src, dst, first); err != nil {
+			t.Fatalf("split from page %d: %s", first+1, err)
+		}
+		info, err := faxTiffInspect(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Pages != len(heights)-first {
+			t.Fatalf("split from page %d: %d pages, expected %d", first+1, info.Pages, len(heights)-first)
+		}
+		for i, p := range info.PageList {
+			if p.Height != heights[first+i] {
+				t.Errorf("split from page %d: page %d height %d, expected %d", first+1, i+1, p.Height,
+				         heights[first+i])
+			}
+		}
+	}
+	for _, first := range []int{-1, len(heights)} {
+		if err := faxTiffSplit(src, filepath.Join(dir, "out.tiff"), first); err == nil {
+			t.Errorf("split from page %d of %d accepted", first+1, len(heights))
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+// Retry policy of a fax job, each attempt is a new call. The outcome of a
+// failed attempt is classified from the SIP status, the hangup cause and the
+// spandsp T.30 result code, only the classes listed in the policy are retried.
+// Document errors happen before the first call and are never retried.
+
+const (
+	FAX_OUTCOME_SUCCESS     = "success"
+	FAX_OUTCOME_BUSY        = "busy"        // 486, 600, USER_BUSY
+	FAX_OUTCOME_NO_ANSWER   = "no_answer"   // 480, 408, NO_ANSWER
+	FAX_OUTCOME_UNAVAILABLE = "unavailable" // 503, 502, 500, network errors
+	FAX_OUTCOME_NOT_FOUND   = "not_found"   // 404, 484, 604, UNALLOCATED_NUMBER
+	FAX_OUTCOME_REJECTED    = "rejected"    // 403, 603, other 4xx-6xx
+	FAX_OUTCOME_TRAINING    = "training"    // T.30 no CED, timeouts, cannot train
+	FAX_OUTCOME_TRANSFER    = "transfer"    // T.30 failure after training, page not confirmed
+	FAX_OUTCOME_OTHER       = "other"
+)
+
+var faxOutcomes = []string{FAX_OUTCOME_BUSY, FAX_OUTCOME_NO_ANSWER, FAX_OUTCOME_UNAVAILABLE, FAX_OUTCOME_NOT_FOUND,
+                           FAX_OUTCOME_REJECTED, FAX_OUTCOME_TRAINING, FAX_OUTCOME_TRANSFER, FAX_OUTCOME_OTHER}
+
+const FAX_RETRY_MAX_ATTEMPTS = 10
+
+type FaxRetryPolicy struct {
+	MaxAttempts int      `json:"max_attempts"` // including the first call, 1 disables retries
+	Backoff     []int    `json:"backoff"`      // seconds before each retry, the last one repeats
+	RetryOn     []string `json:"retry_on"`     // outcome classes or SIP status codes
+}
+
+type FaxAttempt struct {
+	Attempt        int       `json:"attempt"`
+	CallUuid       string    `json:"call_uuid"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Outcome        string    `json:"outcome"`
+	CauseCode      int32     `json:"cause_code"`
+	HangupCause    string    `json:"hangup_cause,omitempty"`
+	ResultCode     int32     `json:"fax_result_code"`
+	ResultText     string    `json:"fax_result_text,omitempty"`
+	Pages          int32     `json:"pages_transferred"`
+	FirstPage      int       `json:"first_page"`      // document page the attempt started with
+	LastPage       int       `json:"last_page"`
+	PagesDelivered []int     `json:"pages_delivered"` // document pages confirmed during the attempt
+	Error          string    `json:"error,omitempty"`
+	Retry          bool      `json:"retry"`
+}
+
+// faxRetryPolicyDefault applies the defaults, a job without policy is sent once.
+func faxRetryPolicyDefault(p *FaxRetryPolicy) FaxRetryPolicy {
+	if p == nil {
+		return FaxRetryPolicy{MaxAttempts: 1}
+	}
+	policy := *p
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = 3
+	}
+	if len(policy.Backoff) == 0 {
+		policy.Backoff = []int{60, 300, 900}
+	}
+	if len(policy.RetryOn) == 0 {
+		policy.RetryOn = []string{FAX_OUTCOME_BUSY, FAX_OUTCOME_NO_ANSWER, FAX_OUTCOME_UNAVAILABLE, FAX_OUTCOME_TRAINING}
+	}
+	return policy
+}
+
+func faxRetryPolicyCheck(p *FaxRetryPolicy) error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxAttempts < 0 || p.MaxAttempts > FAX_RETRY_MAX_ATTEMPTS {
+		return fmt.Errorf("invalid max_attempts [%d], expected 1 to %d", p.MaxAttempts, FAX_RETRY_MAX_ATTEMPTS)
+	}
+	for _, s := range p.Backoff {
+		if s < 0 {
+			return fmt.Errorf("invalid backoff [%d]", s)
+		}
+	}
+	for i, r := range p.RetryOn {
+		r = strings.ToLower(strings.TrimSpace(r))
+		p.RetryOn[i] = r
+		if code, err := strconv.Atoi(r); err == nil && code >= 400 && code < 700 {
+			continue
+		}
+		found := false
+		for _, o := range faxOutcomes {
+			found = found || o == r
+		}
+		if !found {
+			return fmt.Errorf("invalid retry_on [%s], expected a SIP status code or one of %s", r,
+			                  strings.Join(faxOutcomes, ", "))
+		}
+	}
+	return nil
+}
+
+// faxRetryPolicyForm reads the policy from the max_attempts, backoff and
+// retry_on form values (lists are comma separated).
+func faxRetryPolicyForm(attempts string, backoff string, retryOn string) (*FaxRetryPolicy, error) {
+	if attempts == "" && backoff == "" && retryOn == "" {
+		return nil, nil
+	}
+	p := FaxRetryPolicy{}
+	if attempts != "" {
+		n, err := strconv.Atoi(attempts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_attempts [%s]", attempts)
+		}
+		p.MaxAttempts = n
+	}
+	for _, s := range strings.Split(backoff, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid backoff [%s]", backoff)
+		}
+		p.Backoff = append(p.Backoff, n)
+	}
+	for _, s := range strings.Split(retryOn, ",") {
+		if strings.TrimSpace(s) != "" {
+			p.RetryOn = append(p.RetryOn, s)
+		}
+	}
+	return &p, nil
+}
+
+// faxRetryDelay returns the wait before the retry following the attempt.
+func faxRetryDelay(p FaxRetryPolicy, attempt int) time.Duration {
+	if len(p.Backoff) == 0 {
+		return 0
+	}
+	i := attempt - 1
+	if i >= len(p.Backoff) {
+		i = len(p.Backoff) - 1
+	}
+	return time.Duration(p.Backoff[i]) * time.Second
+}
+
+func faxRetryable(p FaxRetryPolicy, attempt FaxAttempt) bool {
+	code := fmt.Sprintf("%d", attempt.CauseCode)
+	for _, r := range p.RetryOn {
+		if r == attempt.Outcome || r == code {
+			return true
+		}
+	}
+	return false
+}
+
+// faxOutcome classifies a failed attempt. The T.30 codes are the spandsp
+// T30_ERR_* values: 1-6 no CED, T0/T1/T3 expiry, HDLC carrier, cannot train.
+func faxOutcome(report FaxReport, err error) string {
+	if err == nil {
+		return FAX_OUTCOME_SUCCESS
+	}
+	switch report.CauseCode {
+	case 486, 600:
+		return FAX_OUTCOME_BUSY
+	case 480, 408, 487:
+		return FAX_OUTCOME_NO_ANSWER
+	case 500, 502, 503, 504:
+		return FAX_OUTCOME_UNAVAILABLE
+	case 404, 484, 604:
+		return FAX_OUTCOME_NOT_FOUND
+	}
+	if report.CauseCode >= 400 {
+		return FAX_OUTCOME_REJECTED
+	}
+	switch report.HangupCause {
+	case "USER_BUSY":
+		return FAX_OUTCOME_BUSY
+	case "NO_ANSWER", "NO_USER_RESPONSE", "RECOVERY_ON_TIMER_EXPIRE":
+		return FAX_OUTCOME_NO_ANSWER
+	case "UNUSED", "NETWORK_OUT_OF_ORDER", "DESTINATION_OUT_OF_ORDER", "NORMAL_TEMPORARY_FAILURE", "GATEWAY_DOWN":
+		return FAX_OUTCOME_UNAVAILABLE
+	case "UNALLOCATED_NUMBER", "NO_ROUTE_DESTINATION", "INVALID_NUMBER_FORMAT":
+		return FAX_OUTCOME_NOT_FOUND
+	case "CALL_REJECTED":
+		return FAX_OUTCOME_REJECTED
+	}
+	if report.ResultCode >= 1 && report.ResultCode <= 6 {
+		return FAX_OUTCOME_TRAINING
+	}
+	if report.ResultCode > 6 {
+		return FAX_OUTCOME_TRANSFER
+	}
+	if report.Action == "" && strings.HasPrefix(err.Error(), "originate failed") {
+		// no call, the cause is only in the originate reply (-ERR USER_BUSY)
+		for _, o := range []struct{ cause, outcome string }{
+			{"USER_BUSY", FAX_OUTCOME_BUSY}, {"NO_ANSWER", FAX_OUTCOME_NO_ANSWER},
+			{"NO_USER_RESPONSE", FAX_OUTCOME_NO_ANSWER}, {"RECOVERY_ON_TIMER_EXPIRE", FAX_OUTCOME_NO_ANSWER},
+			{"UNALLOCATED_NUMBER", FAX_OUTCOME_NOT_FOUND}, {"CALL_REJECTED", FAX_OUTCOME_REJECTED},
+			{"DESTINATION_OUT_OF_ORDER", FAX_OUTCOME_UNAVAILABLE}, {"NORMAL_TEMPORARY_FAILURE", FAX_OUTCOME_UNAVAILABLE},
+		} {
+			if strings.Contains(err.Error(), o.cause) {
+				return o.outcome
+			}
+		}
+	}
+	return FAX_OUTCOME_OTHER
+}
+
+func faxAttemptCreate(n int, callUuid string, start time.Time, report FaxReport, err error) FaxAttempt {
+	attempt := FaxAttempt{
+		Attempt:     n,
+		CallUuid:    callUuid,
+		Start:       start,
+		End:         time.Now(),
+		Outcome:     faxOutcome(report, err),
+		CauseCode:   report.CauseCode,
+		HangupCause: report.HangupCause,
+		ResultCode:  report.ResultCode,
+		ResultText:  report.ResultText,
+		Pages:       report.PagesTransferred,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	return attempt
+}
+
+// faxJobSend dials until the fax goes through, the policy gives up or the job
+// is cancelled. A job found retrying (restart) waits for its next attempt time.
+func faxJobSend(id string) {
+	for {
+		job, err := faxStoreGet(id)
+		if err != nil {
+			fmt.Printf("fax job[%s] %s\n", id, err)
+			return
+		}
+		// wait for the retry delay, the not before time or the delivery window
+		if faxJobHold(job) {
+			continue
+		}
+		policy := faxRetryPolicyDefault(job.Request.Retry)
+		n := len(job.Attempts) + 1
+		total := 0
+		if job.TiffInfo != nil {
+			total = job.TiffInfo.Pages
+		}
+		// a retry resumes from the first page not confirmed
+		first := faxPagesDelivered(job)
+		tiff, err := faxResumeTiff(job, first, total)
+		if err != nil {
+			faxJobEnd(id, FAX_FAILED, fmt.Sprintf("resume from page %d failed [%s]", first+1, err))
+			return
+		}
+		// the channel uuid is chosen here so every event can be tied back to this job
+		callUuid := uuid.NewString()
+		job, err = faxJobUpdate(id, func(job *FaxJob) error {
+			if !faxTransitionAllowed(job.State, FAX_DIALING) {
+				return fmt.Errorf("fax job[%s] %s, not dialing", id, job.State)
+			}
+			job.State = FAX_DIALING
+			job.CallUuid = callUuid
+			job.History = append(job.History, FaxJobEvent{State: FAX_DIALING, Time: time.Now(),
+			                     Detail: fmt.Sprintf("attempt %d/%d pages %d-%d %s", n, policy.MaxAttempts, first+1, total,
+			                                         callUuid)})
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return
+		}
+		start := time.Now()
+		report, err := eslSendFax(id, job.Request, tiff, callUuid, func(ev EslEvent) { faxJobProgress(id, ev, first, total) })
+		if report.Action != "" {
+			report.Account = job.Account
+			faxReportPublish(report)
+		}
+		attempt := faxAttemptCreate(n, callUuid, start, report, err)
+		faxAttemptPages(&attempt, first, total)
+		if err != nil && total > 0 && first+int(attempt.Pages) >= total {
+			// every page was confirmed, the call failed afterwards
+			fmt.Printf("fax job[%s] all pages confirmed, ignoring [%s]\n", id, err)
+			err = nil
+		}
+		attempt.Retry = err != nil && n < policy.MaxAttempts && faxRetryable(policy, attempt)
+		delay := faxRetryDelay(policy, n)
+		_, uerr := faxJobUpdate(id, func(job *FaxJob) error {
+			if report.Action != "" {
+				job.Report = &report
+			}
+			job.Attempts = append(job.Attempts, attempt)
+			if !attempt.Retry || faxStateTerminal(job.State) {
+				return nil
+			}
+			detail := fmt.Sprintf("attempt %d %s [%d][%s], next in %s", n, attempt.Outcome, attempt.CauseCode,
+			                      attempt.Error, delay)
+			fmt.Printf("fax job[%s] %s -> %s %s\n", id, job.State, FAX_RETRYING, detail)
+			job.State = FAX_RETRYING
+			job.NextAttempt = time.Now().Add(delay)
+			job.History = append(job.History, FaxJobEvent{State: FAX_RETRYING, Time: time.Now(), Detail: detail})
+			return nil
+		})
+		if uerr != nil {
+			fmt.Printf("fax job[%s] %s\n", id, uerr)
+			return
+		}
+		if err == nil {
+			faxJobEnd(id, FAX_COMPLETED, "")
+			return
+		}
+		if !attempt.Retry {
+			if n > 1 {
+				err = fmt.Errorf("%s, attempt %d/%d %s", err, n, policy.MaxAttempts, attempt.Outcome)
+			}
+			faxJobEnd(id, FAX_FAILED, err.Error())
+			return
+		}
+	}
+}
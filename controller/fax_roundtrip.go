@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+	xtiff "golang.org/x/image/tiff"
+)
+
+// Fax round-trip test (Cmd.Type "fax"), the test document is faxed to the
+// destination, the image received on the other side is fetched back and
+// compared page by page with the transmitted one.
+
+const FAX_TEST_DOCUMENT = "T38_TEST_PAGES.pdf"
+const FAX_TEST_MIN_SIMILARITY = 0.9
+const FAX_TEST_RX_TIMEOUT = 60 * time.Second
+const FAX_TEST_HTTP_TIMEOUT = 60 * time.Second // one request to the receiving controller
+
+// comparison grid, in blocks across the page width
+const FAX_COMPARE_COLS = 108
+
+type FaxPageCompare struct {
+	Page       int     `json:"page"`
+	Similarity float64 `json:"similarity"`
+	TxWidth    int     `json:"tx_width"`
+	TxHeight   int     `json:"tx_height"`
+	RxWidth    int     `json:"rx_width"`
+	RxHeight   int     `json:"rx_height"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type FaxTestReport struct {
+	Uuid          string           `json:"uuid"`
+	Account       string           `json:"account,omitempty"`
+	Label         string           `json:"label"`
+	Action        string           `json:"action"`
+	Destination   string           `json:"destination"`
+	Document      string           `json:"document"`
+	Result        string           `json:"result"`
+	Similarity    float64          `json:"similarity"`
+	PagesSent     int              `json:"pages_sent"`
+	PagesReceived int              `json:"pages_received"`
+	MissingPages  []int            `json:"missing_pages"`
+	BadRows       int32            `json:"bad_rows"`
+	Pages         []FaxPageCompare `json:"pages"`
+	Tx            *FaxReport       `json:"tx"`
+	Rx            *FaxReport       `json:"rx"`
+	Error         string           `json:"error,omitempty"`
+}
+
+// faxTiffDecodePage decodes one page, the header of a copy of the file is
+// pointed at the IFD of the page since the decoder only reads the first one.
+func faxTiffDecodePage(t tiffReader, p FaxTiffPage) (image.Image, error) {
+	b := make([]byte, len(t.b))
+	copy(b, t.b)
+	t.order.PutUint32(b[4:], p.ifdOffset)
+	return xtiff.Decode(bytes.NewReader(b))
+}
+
+func faxTiffDecodePages(fn string) ([]image.Image, []FaxTiffPage, error) {
+	info, err := faxTiffInspect(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, _, err := faxTiffOpen(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	var images []image.Image
+	for i, p := range info.PageList {
+		img, err := faxTiffDecodePage(t, p)
+		if err != nil {
+			info.PageList[i].Error = fmt.Sprintf("decode error [%s]", err)
+		}
+		images = append(images, img)
+	}
+	return images, info.PageList, nil
+}
+
+// faxDensityGrid returns the ratio of black pixels of each block of a
+// cols x rows grid laid over the image.
+func faxDensityGrid(img image.Image, top int, cols int, rows int) []float64 {
+	b := img.Bounds()
+	grid := make([]float64, cols*rows)
+	count := make([]int, cols*rows)
+	h := b.Dy() - top
+	if h <= 0 {
+		return grid
+	}
+	for y := 0; y < h; y++ {
+		gy := y * rows / h
+		for x := 0; x < b.Dx(); x++ {
+			gx := x * cols / b.Dx()
+			i := gy*cols + gx
+			count[i]++
+			if faxLuminance(img, b.Min.X+x, b.Min.Y+top+y) < 0.5 {
+				grid[i]++
+			}
+		}
+	}
+	for i := range grid {
+		if count[i] > 0 {
+			grid[i] /= float64(count[i])
+		}
+	}
+	return grid
+}
+
+// faxPageSimilarity compares the black pixel density of both pages block by
+// block, 1 is identical. Rows the receiver has in excess at the top of the
+// page (the fax header line) are ignored.
+func faxPageSimilarity(tx image.Image, txPage FaxTiffPage, rx image.Image, rxPage FaxTiffPage) float64 {
+	top := 0
+	if txPage.YRes > 0 && rxPage.YRes > 0 {
+		expected := int(float64(tx.Bounds().Dy()) * rxPage.YRes / txPage.YRes)
+		if rx.Bounds().Dy() > expected {
+			top = rx.Bounds().Dy() - expected
+		}
+	}
+	cols := FAX_COMPARE_COLS
+	rows := int(float64(cols) * float64(tx.Bounds().Dy()) / float64(tx.Bounds().Dx()) * txPage.XRes / math.Max(txPage.YRes, 1))
+	if rows < 1 {
+		rows = 1
+	}
+	a := faxDensityGrid(tx, 0, cols, rows)
+	b := faxDensityGrid(rx, top, cols, rows)
+	diff := 0.0
+	total := 0.0
+	for i := range a {
+		diff += math.Abs(a[i] - b[i])
+		total += math.Max(a[i], b[i])
+	}
+	if total == 0 {
+		return 1
+	}
+	return math.Round((1-diff/total)*1000) / 1000
+}
+
+func faxTestCompare(report *FaxTestReport, txTiff string, rxTiff string) error {
+	tx, txPages, err := faxTiffDecodePages(txTiff)
+	if err != nil {
+		return fmt.Errorf("transmitted image [%s]", err)
+	}
+	rx, rxPages, err := faxTiffDecodePages(rxTiff)
+	if err != nil {
+		return fmt.Errorf("received image [%s]", err)
+	}
+	report.PagesSent = len(tx)
+	report.PagesReceived = len(rx)
+	sum := 0.0
+	for i := range tx {
+		if i >= len(rx) {
+			report.MissingPages = append(report.MissingPages, i+1)
+			continue
+		}
+		c := FaxPageCompare{Page: i+1}
+		if tx[i] == nil || rx[i] == nil {
+			c.Error = txPages[i].Error + rxPages[i].Error
+		} else {
+			c.TxWidth, c.TxHeight = tx[i].Bounds().Dx(), tx[i].Bounds().Dy()
+			c.RxWidth, c.RxHeight = rx[i].Bounds().Dx(), rx[i].Bounds().Dy()
+			c.Similarity = faxPageSimilarity(tx[i], txPages[i], rx[i], rxPages[i])
+		}
+		sum += c.Similarity
+		report.Pages = append(report.Pages, c)
+	}
+	if len(tx) > 0 {
+		report.Similarity = math.Round(sum/float64(len(tx))*1000) / 1000
+	}
+	return nil
+}
+
+// faxTestReceiver tells if the receiver is RECEIVER_URL.
+func faxTestReceiver(receiver string) bool {
+	return config.Receiver != "" && strings.TrimSuffix(receiver, "/") == strings.TrimSuffix(config.Receiver, "/")
+}
+
+// faxTestReceiverCheck validates the receiver of a command, an account only
+// uses RECEIVER_URL, the admin may name another controller.
+func faxTestReceiverCheck(receiver string, account string) error {
+	if receiver == "" || faxTestReceiver(receiver) {
+		return nil
+	}
+	if account != ACCOUNT_ADMIN {
+		return fmt.Errorf("invalid receiver [%s], expected RECEIVER_URL or none", receiver)
+	}
+	u, err := url.Parse(receiver)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid receiver [%s]", receiver)
+	}
+	return nil
+}
+
+// faxTestGet requests the receiving controller, RECEIVER_API_KEY only goes
+// to RECEIVER_URL.
+func faxTestGet(receiver string, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(receiver, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.ReceiverKey != "" && faxTestReceiver(receiver) {
+		req.Header.Set("X-API-Key", config.ReceiverKey)
+	}
+	client := http.Client{Timeout: FAX_TEST_HTTP_TIMEOUT}
+	return client.Do(req)
+}
+
+// faxTestFetch finds the fax received with the tag, on the receiving
+// controller or in the local store, and returns its TIFF file name.
+func faxTestFetch(receiver string, account string, tag string) (string, FaxInbound, error) {
+	var fax FaxInbound
+	deadline := time.Now().Add(FAX_TEST_RX_TIMEOUT)
+	for {
+		var faxes []FaxInbound
+		var err error
+		if receiver == "" {
+			faxes, err = faxInboundList()
+		} else {
+			var res *http.Response
+			res, err = faxTestGet(receiver, "/faxes/inbound?tag="+url.QueryEscape(tag))
+			if err == nil {
+				if res.StatusCode != http.StatusOK {
+					err = fmt.Errorf("received fax list failed [%s]", res.Status)
+				} else {
+					err = json.NewDecoder(res.Body).Decode(&faxes)
+				}
+				res.Body.Close()
+			}
+		}
+		if err != nil {
+			fmt.Printf("faxTestFetch: tag[%s] error [%s]\n", tag, err)
+		}
+		for _, f := range faxes {
+			if f.Tag == tag {
+				fax = f
+			}
+		}
+		if fax.Id != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return "", fax, errors.New("received fax not found")
+		}
+		time.Sleep(2 * time.Second)
+	}
+	if receiver == "" {
+		if !checkFileExists(fax.Tiff) {
+			return "", fax, fmt.Errorf("received image not found [%s]", fax.Error)
+		}
+		return fax.Tiff, fax, nil
+	}
+	res, err := faxTestGet(receiver, "/faxes/inbound/"+fax.Id+"/tiff")
+	if err != nil {
+		return "", fax, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fax, fmt.Errorf("received image download failed [%s]", res.Status)
+	}
+	fn := accountOutputDir(account)+"/"+tag+"-rx.tiff"
+	dst, err := os.Create(fn)
+	if err != nil {
+		return "", fax, err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, res.Body); err != nil {
+		return "", fax, err
+	}
+	return fn, fax, nil
+}
+
+// faxTestJob sends the test document from paths.files with the request for the
+// command and returns the job once it has ended.
+func faxTestJob(cmdUuid string, id string, account string, document string, req FaxRequest) (FaxJob, error) {
+	job := FaxJob{Id: id, Account: account, Request: req}
+	if err := faxTransportCheck(&job.Request); err != nil {
+		return job, err
+	}
+	b, err := os.ReadFile(filepath.Join(config.Paths.Files, filepath.Base(document)))
+	if err != nil {
+		return job, err
+	}
+	job.Request.DocumentName = document
+	// each test converts its own copy of the document
+	job.Document = accountDir(config.Paths.Upload, account)+"/"+job.Id+"-"+filepath.Base(document)
+	if err := os.WriteFile(job.Document, b, 0666); err != nil {
+		return job, err
+	}
+	if err := faxJobCreate(&job); err != nil {
+		return job, err
+	}
+	if cmdJobFaxAdd(cmdUuid, job.Id) {
+		faxJobRun(job.Id)
+	} else {
+		faxJobCancel(job.Id, "command cancelled")
+	}
+	return faxStoreGet(job.Id)
+}
+
+func faxTestRun(cmd Cmd, c Call, report *FaxTestReport) error {
+	req := FaxRequest{Destination: c.Ruri, CallerIdNumber: c.From, Tag: report.Label}
+	job, err := faxTestJob(cmd.Uuid, report.Label, cmd.Account, report.Document, req)
+	if err != nil {
+		return err
+	}
+	report.Tx = job.Report
+	if job.State != FAX_COMPLETED {
+		return fmt.Errorf("fax job %s [%s]", job.State, job.Error)
+	}
+	rxTiff, fax, err := faxTestFetch(cmd.Receiver, cmd.Account, job.Id)
+	report.Rx = &fax.Report
+	if err != nil {
+		return err
+	}
+	report.BadRows = fax.Report.BadRows
+	return faxTestCompare(report, job.Tiff, rxTiff)
+}
+
+func cmdFaxTest(cmd Cmd, c Call, idx int) {
+	report := FaxTestReport{Uuid: cmd.Uuid, Account: cmd.Account, Label: uuid.NewString(), Action: "fax", Destination: c.Ruri,
+	                        Document: cmd.Document, MissingPages: []int{}}
+	if report.Document == "" {
+		report.Document = FAX_TEST_DOCUMENT
+	}
+	fmt.Printf("cmdFaxTest: uuid[%s] idx[%d] label[%s] destination[%s] document[%s]\n", cmd.Uuid, idx, report.Label,
+	           c.Ruri, report.Document)
+	err := faxTestRun(cmd, c, &report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if err == nil && len(report.MissingPages) == 0 && report.Similarity >= FAX_TEST_MIN_SIMILARITY {
+		report.Result = "PASS"
+	} else {
+		report.Result = "FAIL"
+	}
+	for _, p := range report.Pages {
+		if p.Error != "" || p.Similarity < FAX_TEST_MIN_SIMILARITY {
+			report.Result = "FAIL"
+		}
+	}
+	reportJson, _ := json.Marshal(report)
+	fmt.Println(string(reportJson))
+	rmqPublish(string(reportJson), config.Rmq.PubKeySummary)
+	x := cmdDecCallLeft(cmd.Uuid, 1)
+	fmt.Printf("uuid[%s] idx[%d] fax test completed left[%d] result[%s]\n", cmd.Uuid, idx, x, report.Result)
+	if x == 0 {
+		cmdJobState(cmd.Uuid, CMD_JOB_DONE, "")
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Inbound routing, FreeSWITCH mod_xml_curl asks /dialplan for every call
+// reaching the public context and the controller answers with an rxfax
+// extension built from the route of the DID: T.38/ECM/V.17 settings, ident,
+// header, storage directory and mailbox. A DID without a route gets "not
+// found" and FreeSWITCH falls back to the static dialplan (00_inbound_did.xml).
+// The admin key gives a DID to an account, the account can then change the
+// settings of its route, its faxes are stored in its own directory.
+
+const FAX_ROUTE_CONTEXT = "public"
+
+var faxRouteBucket = []byte("routes")
+
+var faxRouteDidRe = regexp.MustCompile(`^\+?[0-9A-Za-z_.*#-]{1,64}$`)
+
+// the directory goes in the dialplan, no FreeSWITCH variable or API expansion
+var faxRouteDirRe = regexp.MustCompile(`^/[0-9A-Za-z_./-]+$`)
+
+type FaxRoute struct {
+	Did     string    `json:"did"`
+	Account string    `json:"account,omitempty"` // account receiving the faxes of the DID
+	T38     *bool     `json:"t38"` // spandsp.conf default when not set
+	Ecm     *bool     `json:"ecm"`
+	V17     *bool     `json:"v17"`
+	Ident   string    `json:"ident,omitempty"`   // fax.conf default when empty
+	Header  string    `json:"header,omitempty"`
+	Dir     string    `json:"dir"`               // set by the admin, under paths.files, paths.inbound[/account] when empty
+	Mailbox string    `json:"mailbox,omitempty"` // id of the mailbox the faxes are mailed to
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func faxRouteDid(did string) string {
+	return strings.TrimPrefix(strings.TrimSpace(did), "+")
+}
+
+func faxRouteGet(did string) (FaxRoute, error) {
+	var route FaxRoute
+	found, err := storeGet(faxRouteBucket, faxRouteDid(did), &route)
+	if err == nil && !found {
+		err = fmt.Errorf("route not found [%s]", did)
+	}
+	return route, err
+}
+
+func faxRouteList() ([]FaxRoute, error) {
+	routes := []FaxRoute{}
+	err := storeEach(faxRouteBucket, func(b []byte) error {
+		var route FaxRoute
+		if err := json.Unmarshal(b, &route); err != nil {
+			fmt.Printf("invalid route record [%s]\n", err)
+			return nil
+		}
+		routes = append(routes, route)
+		return nil
+	})
+	return routes, err
+}
+
+func faxRouteDirUnder(dir string, root string) bool {
+	root = filepath.Clean(root)
+	return dir == root || strings.HasPrefix(dir, root+"/")
+}
+
+// faxRouteCheck validates the route and creates its storage directory, the
+// faxes of an account stay in its directory.
+func faxRouteCheck(route *FaxRoute) error {
+	route.Did = faxRouteDid(route.Did)
+	if !faxRouteDidRe.MatchString(route.Did) {
+		return fmt.Errorf("invalid did [%s]", route.Did)
+	}
+	root := config.Paths.Files
+	if route.Account != ACCOUNT_ADMIN {
+		if _, err := accountGet(route.Account); err != nil {
+			return err
+		}
+		root = filepath.Join(config.Paths.Inbound, route.Account)
+	}
+	if route.Dir == "" {
+		route.Dir = filepath.Join(config.Paths.Inbound, route.Account)
+	}
+	route.Dir = filepath.Clean(route.Dir)
+	if !faxRouteDirRe.MatchString(route.Dir) {
+		return fmt.Errorf("invalid dir [%s], expected letters, digits and _ . / -", route.Dir)
+	}
+	if !faxRouteDirUnder(route.Dir, root) && (route.Account != ACCOUNT_ADMIN ||
+	                                           !faxRouteDirUnder(route.Dir, config.Paths.Inbound)) {
+		return fmt.Errorf("invalid dir [%s], expected under %s", route.Dir, root)
+	}
+	if route.Mailbox != "" {
+		box, err := mailboxGet(route.Mailbox)
+		if err != nil {
+			return err
+		}
+		if route.Account != ACCOUNT_ADMIN && box.Account != route.Account {
+			return fmt.Errorf("mailbox not found [%s]", route.Mailbox)
+		}
+	}
+	if strings.ContainsAny(route.Ident+route.Header, "{}$") {
+		return errors.New("ident and header can not contain variables")
+	}
+	return os.MkdirAll(route.Dir, 0777)
+}
+
+func faxXmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// faxRouteDocument is the dialplan answer, one extension for the DID running
+// the actions, each an application and its data.
+func faxRouteDocument(did string, actions [][2]string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"no\"?>\n")
+	buf.WriteString("<document type=\"freeswitch/xml\">\n")
+	buf.WriteString("  <section name=\"dialplan\" description=\"fax routes\">\n")
+	fmt.Fprintf(&buf, "    <context name=\"%s\">\n", FAX_ROUTE_CONTEXT)
+	fmt.Fprintf(&buf, "      <extension name=\"fax_route_%s\">\n", faxXmlEscape(did))
+	fmt.Fprintf(&buf, "        <condition field=\"destination_number\" expression=\"^\\+?%s$\">\n",
+	            faxXmlEscape(regexp.QuoteMeta(did)))
+	for _, a := range actions {
+		if a[1] == "" {
+			fmt.Fprintf(&buf, "          <action application=\"%s\"/>\n", a[0])
+		} else {
+			fmt.Fprintf(&buf, "          <action application=\"%s\" data=\"%s\"/>\n", a[0], faxXmlEscape(a[1]))
+		}
+	}
+	buf.WriteString("        </condition>\n")
+	buf.WriteString("      </extension>\n")
+	buf.WriteString("    </context>\n")
+	buf.WriteString("  </section>\n")
+	buf.WriteString("</document>\n")
+	return buf.String()
+}
+
+// faxRouteXml is the rxfax extension of the route, same steps as the static
+// dialplan.
+func faxRouteXml(route FaxRoute) string {
+	var actions [][2]string
+	action := func(app string, data string) {
+		actions = append(actions, [2]string{app, data})
+	}
+	action("answer", "")
+	action("set", "fax_verbose=true")
+	if route.T38 != nil {
+		action("set", fmt.Sprintf("fax_enable_t38=%t", *route.T38))
+		action("set", fmt.Sprintf("fax_enable_t38_request=%t", *route.T38))
+	}
+	if route.Ecm != nil {
+		action("set", fmt.Sprintf("fax_use_ecm=%t", *route.Ecm))
+	}
+	if route.V17 != nil {
+		action("set", fmt.Sprintf("fax_disable_v17=%t", !*route.V17))
+	}
+	if route.Ident != "" {
+		action("set", "fax_ident="+route.Ident)
+	}
+	if route.Header != "" {
+		action("set", "fax_header="+route.Header)
+	}
+	if route.Mailbox != "" {
+		action("set", "fax_mailbox="+route.Mailbox)
+	}
+	if route.Account != ACCOUNT_ADMIN {
+		action("set", "fax_account="+route.Account)
+	}
+	action("set", "fax_rx_file="+route.Dir+"/${uuid}.tiff")
+	action("playback", "silence_stream://2000")
+	action("rxfax", "${fax_rx_file}")
+	action("hangup", "")
+	return faxRouteDocument(route.Did, actions)
+}
+
+const faxRouteNotFound = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<document type="freeswitch/xml">
+  <section name="result">
+    <result status="not found"/>
+  </section>
+</document>
+`
+
+// faxDialplanNets reads dialplan.allow, IPs or CIDRs comma separated.
+func faxDialplanNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if ip := net.ParseIP(a); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("expected an IP or a CIDR [%s]", a)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// faxDialplanAllowed tells if the lookup comes from FreeSWITCH: an address of
+// dialplan.allow and, with dialplan.secret, the xml_curl credentials.
+func faxDialplanAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	nets, _ := faxDialplanNets(config.Dialplan.Allow)
+	allowed := false
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if config.Dialplan.Secret == "" {
+		return true
+	}
+	_, pass, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(config.Dialplan.Secret)) == 1
+}
+
+// faxDialplanHandler answers the mod_xml_curl dialplan lookups.
+func faxDialplanHandler(w http.ResponseWriter, r *http.Request) {
+	if !faxDialplanAllowed(r) {
+		fmt.Printf("dialplan lookup refused from [%s]\n", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	context := r.FormValue("Hunt-Context")
+	if context == "" {
+		context = r.FormValue("Caller-Context")
+	}
+	did := r.FormValue("Hunt-Destination-Number")
+	if did == "" {
+		did = r.FormValue("Caller-Destination-Number")
+	}
+	if r.FormValue("section") != "dialplan" || context != FAX_ROUTE_CONTEXT || did == "" {
+		fmt.Fprint(w, faxRouteNotFound)
+		return
+	}
+	route, err := faxRouteGet(did)
+	if err != nil {
+		fmt.Fprint(w, faxRouteNotFound)
+		return
+	}
+	fmt.Printf("dialplan did[%s] caller[%s] uuid[%s] -> account[%s] dir[%s] mailbox[%s]\n", did,
+	           r.FormValue("Caller-Caller-ID-Number"), r.FormValue("Unique-ID"), route.Account, route.Dir, route.Mailbox)
+	if err := accountAdmit(route.Account, 0); err != nil {
+		fmt.Printf("dialplan did[%s] account[%s] refused [%s]\n", did, route.Account, err)
+		// over its storage quota, the call is turned down
+		fmt.Fprint(w, faxRouteDocument(route.Did, [][2]string{{"hangup", "NORMAL_TEMPORARY_FAILURE"}}))
+		return
+	}
+	fmt.Fprint(w, faxRouteXml(route))
+}
+
+// faxRoutesHandler serves /routes (GET list, POST add or replace the route of
+// a DID) and GET, DELETE /routes/{did}. Only the admin key adds and deletes
+// routes, an account key changes the routes given to its account.
+func faxRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "routes"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	did := strings.Trim(strings.TrimPrefix(r.URL.Path, "/routes"), "/")
+	switch {
+	case did == "" && r.Method == "GET":
+		routes, err := faxRouteList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := []FaxRoute{}
+		for _, route := range routes {
+			if accountVisible(r, route.Account) {
+				res = append(res, route)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	case did == "" && r.Method == "POST":
+		var route FaxRoute
+		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+			http.Error(w, fmt.Sprintf("invalid route [%s]", err), http.StatusBadRequest)
+			return
+		}
+		old, err := faxRouteGet(route.Did)
+		if account := accountOf(r); account != ACCOUNT_ADMIN {
+			if err != nil || old.Account != account {
+				http.Error(w, "route not found ["+route.Did+"], given to the account by the admin", http.StatusForbidden)
+				return
+			}
+			route.Account = account
+			route.Dir = old.Dir // only the admin chooses the directory
+		}
+		if err := faxRouteCheck(&route); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		route.Created = time.Now()
+		if err == nil {
+			route.Created = old.Created
+		}
+		route.Updated = time.Now()
+		if err := storePut(faxRouteBucket, route.Did, route); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("route did[%s] account[%s] dir[%s] mailbox[%s]\n", route.Did, route.Account, route.Dir, route.Mailbox)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(route)
+	case did != "" && r.Method == "GET":
+		route, err := faxRouteGet(did)
+		if err != nil || !accountVisible(r, route.Account) {
+			http.Error(w, "route not found ["+did+"]", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(route)
+	case did != "" && r.Method == "DELETE" && accountOf(r) == ACCOUNT_ADMIN:
+		if _, err := faxRouteGet(did); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := storeDelete(faxRouteBucket, faxRouteDid(did)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case did != "" && r.Method == "DELETE":
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFaxDialplanAllowed(t *testing.T) {
+	testConfig(t)
+	config.Dialplan = ConfigDialplan{Allow: "127.0.0.1,::1,10.1.0.0/16"}
+	for _, c := range []struct {
+		remote  string
+		user    string
+		pass    string
+		secret  string
+		allowed bool
+	}{
+		{"127.0.0.1:40000", "", "", "", true},
+		{"[::1]:40000", "", "", "", true},
+		{"10.1.2.3:40000", "", "", "", true},
+		{"10.2.0.1:40000", "", "", "", false},
+		{"203.0.113.9:40000", "", "", "", false},
+		{"127.0.0.1:40000", "", "", "s3cret", false},
+		{"127.0.0.1:40000", "freeswitch", "wrong", "s3cret", false},
+		{"127.0.0.1:40000", "freeswitch", "s3cret", "s3cret", true},
+		{"203.0.113.9:40000", "freeswitch", "s3cret", "s3cret", false},
+	} {
+		config.Dialplan.Secret = c.secret
+		r := httptest.NewRequest("POST", "/dialplan", nil)
+		r.RemoteAddr = c.remote
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.pass)
+		}
+		if allowed := faxDialplanAllowed(r); allowed != c.allowed {
+			t.Errorf("%s [%s:%s] secret [%s]: allowed %t, expected %t", c.remote, c.user, c.pass, c.secret, allowed,
+			         c.allowed)
+		}
+	}
+
+	config.Dialplan.Secret = ""
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/dialplan", nil)
+	r.RemoteAddr = "203.0.113.9:40000"
+	faxDialplanHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("lookup from outside: status %d, expected 403", w.Code)
+	}
+}
+
+func TestFaxDialplanNets(t *testing.T) {
+	if nets, err := faxDialplanNets("127.0.0.1, ::1,10.0.0.0/8,"); err != nil || len(nets) != 3 {
+		t.Errorf("valid list: %v %v", nets, err)
+	}
+	for _, s := range []string{"localhost", "10.0.0.0/33", "127.0.0.1;10.0.0.1"} {
+		if _, err := faxDialplanNets(s); err == nil {
+			t.Errorf("[%s] accepted", s)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+// Scheduled delivery, a job is not dialed before NotBefore and only inside
+// its delivery window, e.g. 08:00-18:00 on weekdays in the time zone of the
+// recipient. A job held back is in the scheduled state with the next time it
+// may be dialed in NextAttempt, a retry that would fall outside the window is
+// carried over to the next one.
+
+var faxWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type FaxWindow struct {
+	Start    string   `json:"start"`     // HH:MM
+	End      string   `json:"end"`       // HH:MM, before Start for a window over midnight
+	Days     []string `json:"days"`      // sun to sat, every day when empty
+	TimeZone string   `json:"time_zone"` // IANA name, UTC when empty
+}
+
+func faxClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time [%s], expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func faxWeekday(s string) int {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, d := range faxWeekdays {
+		if len(s) >= 3 && strings.HasPrefix(s, d) {
+			return i
+		}
+	}
+	return -1
+}
+
+// faxWindowDays reads "mon-fri", "sat,sun", "weekdays" or "all".
+func faxWindowDays(s string) ([]string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "", "all":
+		return nil, nil
+	case "weekdays":
+		s = "mon-fri"
+	case "weekend":
+		s = "sat,sun"
+	}
+	days := []string{}
+	for _, part := range strings.Split(s, ",") {
+		r := strings.SplitN(part, "-", 2)
+		from := faxWeekday(r[0])
+		to := from
+		if len(r) == 2 {
+			to = faxWeekday(r[1])
+		}
+		if from < 0 || to < 0 {
+			return nil, fmt.Errorf("invalid days [%s], expected e.g. mon-fri or sat,sun", part)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days = append(days, faxWeekdays[d])
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func faxWindowCheck(w *FaxWindow) error {
+	if w == nil {
+		return nil
+	}
+	start, err := faxClock(w.Start)
+	if err != nil {
+		return err
+	}
+	end, err := faxClock(w.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("empty delivery window [%s-%s]", w.Start, w.End)
+	}
+	for i, d := range w.Days {
+		n := faxWeekday(d)
+		if n < 0 {
+			return fmt.Errorf("invalid day [%s]", d)
+		}
+		w.Days[i] = faxWeekdays[n]
+	}
+	if _, err := time.LoadLocation(w.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone [%s]", w.TimeZone)
+	}
+	return nil
+}
+
+// faxWindowForm reads window=HH:MM-HH:MM, window_days and time_zone.
+func faxWindowForm(window string, days string, tz string) (*FaxWindow, error) {
+	if window == "" {
+		return nil, nil
+	}
+	r := strings.SplitN(window, "-", 2)
+	if len(r) != 2 {
+		return nil, fmt.Errorf("invalid window [%s], expected HH:MM-HH:MM", window)
+	}
+	w := FaxWindow{Start: strings.TrimSpace(r[0]), End: strings.TrimSpace(r[1]), TimeZone: tz}
+	var err error
+	if w.Days, err = faxWindowDays(days); err != nil {
+		return nil, err
+	}
+	return &w, faxWindowCheck(&w)
+}
+
+func faxNotBeforeForm(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid not_before [%s], expected RFC 3339 or unix time", s)
+}
+
+func faxWindowDay(w FaxWindow, day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == faxWeekdays[day] {
+			return true
+		}
+	}
+	return false
+}
+
+// faxWindowNext returns t if it is inside the window, else the next opening.
+func faxWindowNext(w FaxWindow, t time.Time) time.Time {
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	start, _ := faxClock(w.Start)
+	end, _ := faxClock(w.End)
+	lt := t.In(loc)
+	// from the day before, its window can run over midnight
+	for d := -1; d <= 8; d++ {
+		day := time.Date(lt.Year(), lt.Month(), lt.Day()+d, 0, 0, 0, 0, loc)
+		if !faxWindowDay(w, day.Weekday()) {
+			continue
+		}
+		open := time.Date(day.Year(), day.Month(), day.Day(), start/60, start%60, 0, 0, loc)
+		close := time.Date(day.Year(), day.Month(), day.Day(), end/60, end%60, 0, 0, loc)
+		if end < start {
+			close = close.AddDate(0, 0, 1)
+		}
+		if !lt.Before(open) && lt.Before(close) {
+			return t
+		}
+		if open.After(lt) {
+			return open
+		}
+	}
+	return t
+}
+
+// faxScheduleNext returns the first time from t on the job may be dialed.
+func faxScheduleNext(req FaxRequest, t time.Time) time.Time {
+	if t.Before(req.NotBefore) {
+		t = req.NotBefore
+	}
+	if req.Window == nil {
+		return t
+	}
+	return faxWindowNext(*req.Window, t)
+}
+
+// faxScheduleDetail describes why the job waits.
+func faxScheduleDetail(req FaxRequest, next time.Time) string {
+	if req.Window == nil {
+		return "not before " + next.Format(time.RFC3339)
+	}
+	loc, err := time.LoadLocation(req.Window.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	days := "every day"
+	if len(req.Window.Days) > 0 {
+		days = strings.Join(req.Window.Days, ",")
+	}
+	return fmt.Sprintf("window %s-%s %s %s, next %s", req.Window.Start, req.Window.End, days, loc,
+	                   next.In(loc).Format(time.RFC3339))
+}
+
+// faxJobHold keeps the job in the scheduled state until it may be dialed,
+// returns false when it can be dialed now.
+func faxJobHold(job FaxJob) bool {
+	at := time.Now()
+	if (job.State == FAX_RETRYING || job.State == FAX_SCHEDULED) && job.NextAttempt.After(at) {
+		at = job.NextAttempt
+	}
+	next := faxScheduleNext(job.Request, at)
+	if !next.After(time.Now()) {
+		return false
+	}
+	// a retry due inside the window waits in the retrying state
+	if (job.State != FAX_RETRYING && job.State != FAX_SCHEDULED) || !next.Equal(job.NextAttempt) {
+		_, err := faxJobUpdate(job.Id, func(job *FaxJob) error {
+			if job.State != FAX_SCHEDULED && !faxTransitionAllowed(job.State, FAX_SCHEDULED) {
+				return fmt.Errorf("fax job[%s] %s, not scheduled", job.Id, job.State)
+			}
+			detail := faxScheduleDetail(job.Request, next)
+			if job.State != FAX_SCHEDULED {
+				fmt.Printf("fax job[%s] %s -> %s %s\n", job.Id, job.State, FAX_SCHEDULED, detail)
+				job.State = FAX_SCHEDULED
+				job.History = append(job.History, FaxJobEvent{State: FAX_SCHEDULED, Time: time.Now(), Detail: detail})
+			}
+			job.NextAttempt = next
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return false
+		}
+	}
+	time.Sleep(time.Until(next))
+	return true
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+// Email-to-fax gateway, an SMTP listener started when FAXMAIL_LISTEN is set
+// (e.g. ":2525"). A message to <number>@FAXMAIL_DOMAIN becomes a fax job to
+// that number through FAXMAIL_GATEWAY: the PDF, TIFF and image attachments are
+// the pages, the text body an optional cover page in front of them. The
+// sender gets a status reply through the SMTP relay of fax-to-email when the
+// job ends. With accounts a session must authenticate (AUTH PLAIN or LOGIN,
+// the account id and one of its API keys) and faxes for the account, AUTH is
+// only offered after STARTTLS (FAXMAIL_TLS_CERT and FAXMAIL_TLS_KEY) unless
+// FAXMAIL_INSECURE_AUTH is set. Without accounts the senders must be in
+// FAXMAIL_SENDERS (addresses or @domains), nobody is allowed when it is empty.
+
+const SMTP_MAX_SIZE = 16 << 20
+const SMTP_MAX_RECIPIENTS = 20
+const SMTP_TIMEOUT = 5 * time.Minute
+
+var smtpNumberRe = regexp.MustCompile(`^\+?[0-9]{3,20}$`)
+
+var smtpTls *tls.Config // STARTTLS, nil when no certificate is set
+
+// FaxEmail is the message a job came from.
+type FaxEmail struct {
+	From      string `json:"from"`
+	Subject   string `json:"subject"`
+	MessageId string `json:"message_id,omitempty"`
+}
+
+type smtpAttachment struct {
+	Name string
+	Data []byte
+}
+
+type smtpMessage struct {
+	From        string
+	Subject     string
+	MessageId   string
+	Body        string
+	Attachments []smtpAttachment
+	Skipped     []string // attachments that can not be faxed
+}
+
+// smtpRecipient returns the fax number of a recipient address of the domain.
+func smtpRecipient(addr string) (string, error) {
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address [%s]", addr)
+	}
+	i := strings.LastIndex(a.Address, "@")
+	if i < 0 || !strings.EqualFold(a.Address[i+1:], config.Faxmail.Domain) {
+		return "", fmt.Errorf("relay not permitted [%s]", a.Address)
+	}
+	number := strings.NewReplacer("-", "", ".", "", " ", "").Replace(a.Address[:i])
+	if !smtpNumberRe.MatchString(number) {
+		return "", fmt.Errorf("invalid fax number [%s]", a.Address[:i])
+	}
+	return number, nil
+}
+
+var errSmtpAuthRequired = errors.New("authentication required")
+
+// smtpSender returns the account billed for the faxes of the sender: the
+// account of the session, which may limit its senders with email_senders.
+// With accounts every session authenticates, nothing is billed to the admin
+// for a sender that only claims an address, FAXMAIL_SENDERS is the list of
+// the senders when there are no accounts.
+func smtpSender(from string, authed bool, account string) (string, error) {
+	if accountEnabled() {
+		if !authed {
+			return "", errSmtpAuthRequired
+		}
+		if account == ACCOUNT_ADMIN {
+			return account, nil
+		}
+		a, err := accountGet(account)
+		if err != nil {
+			return "", err
+		}
+		if len(a.EmailSenders) > 0 && !accountSenderMatch(from, a.EmailSenders) {
+			return "", errors.New("sender not allowed for the account")
+		}
+		return account, nil
+	}
+	if accountSenderMatch(from, strings.Split(config.Faxmail.Senders, ",")) {
+		return ACCOUNT_ADMIN, nil
+	}
+	return "", errors.New("sender not allowed")
+}
+
+// smtpAuthOffered tells if AUTH is possible in the session, the API keys are
+// only taken over TLS unless FAXMAIL_INSECURE_AUTH is set.
+func smtpAuthOffered(secure bool) bool {
+	return accountEnabled() && (secure || config.Faxmail.InsecureAuth)
+}
+
+// smtpAuth checks the AUTH PLAIN or LOGIN credentials, the account id (any
+// user with the admin key) and an API key, and returns the account.
+func smtpAuth(tp *textproto.Conn, arg string) (string, error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return "", errors.New("syntax: AUTH PLAIN|LOGIN")
+	}
+	read := func(prompt string) (string, error) {
+		tp.PrintfLine("334 %s", prompt)
+		line, err := tp.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if line == "*" {
+			return "", errors.New("authentication cancelled")
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		return string(b), err
+	}
+	var user, pass string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		var resp string
+		var err error
+		if len(fields) > 1 {
+			b, derr := base64.StdEncoding.DecodeString(fields[1])
+			resp, err = string(b), derr
+		} else {
+			resp, err = read("")
+		}
+		if err != nil {
+			return "", err
+		}
+		parts := strings.Split(resp, "\x00")
+		if len(parts) != 3 {
+			return "", errors.New("invalid PLAIN response")
+		}
+		user, pass = parts[1], parts[2]
+	case "LOGIN":
+		var err error
+		if user, err = read(base64.StdEncoding.EncodeToString([]byte("Username:"))); err != nil {
+			return "", err
+		}
+		if pass, err = read(base64.StdEncoding.EncodeToString([]byte("Password:"))); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported mechanism [%s]", fields[0])
+	}
+	account, err := accountForKey(pass)
+	if err != nil || (account != ACCOUNT_ADMIN && account != user) {
+		return "", errors.New("invalid credentials")
+	}
+	return account, nil
+}
+
+// smtpPath returns the address of a "FROM:<addr>" or "TO:<addr>" argument.
+func smtpPath(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if i := strings.Index(arg, ">"); i >= 0 {
+		arg = arg[:i+1]
+	}
+	return strings.Trim(arg, "<>"), true
+}
+
+func smtpDecode(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// smtpPart walks the MIME parts, keeps the first text/plain body and the attachments.
+func smtpPart(msg *smtpMessage, header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := smtpPart(msg, p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := io.ReadAll(smtpDecode(body, header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return err
+	}
+	_, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	dec := new(mime.WordDecoder)
+	if decoded, err := dec.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if mediaType == "text/plain" && name == "" {
+		if msg.Body == "" {
+			msg.Body = strings.TrimSpace(string(data))
+		}
+		return nil
+	}
+	if mediaType == "application/pdf" || strings.HasPrefix(mediaType, "image/") ||
+	   (mediaType == "application/octet-stream" && name != "") {
+		if name == "" {
+			name = fmt.Sprintf("attachment%d", len(msg.Attachments)+1)
+		}
+		msg.Attachments = append(msg.Attachments, smtpAttachment{Name: filepath.Base(name), Data: data})
+	} else if name != "" {
+		msg.Skipped = append(msg.Skipped, name)
+	}
+	return nil
+}
+
+func smtpParse(from string, data []byte) (smtpMessage, error) {
+	msg := smtpMessage{From: from}
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return msg, err
+	}
+	dec := new(mime.WordDecoder)
+	msg.Subject, err = dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		msg.Subject = m.Header.Get("Subject")
+	}
+	msg.MessageId = m.Header.Get("Message-Id")
+	if a, err := mail.ParseAddress(m.Header.Get("From")); err == nil && from == "" {
+		msg.From = a.Address
+	}
+	header := textproto.MIMEHeader(m.Header)
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/plain")
+	}
+	return msg, smtpPart(&msg, header, m.Body)
+}
+
+// smtpFaxJobs writes the documents of the message and creates a job per
+// recipient, all of them or none: the jobs are started once every one is
+// stored, so the message is accepted or refused as a whole.
+func smtpFaxJobs(msg smtpMessage, account string, numbers []string) ([]string, error) {
+	cover := msg.Body != "" && config.Faxmail.Cover
+	if len(msg.Attachments) == 0 && !cover {
+		return nil, errors.New("nothing to fax, no PDF, TIFF or image attached")
+	}
+	if err := accountAdmit(account, len(numbers)); err != nil {
+		return nil, err
+	}
+	dir := accountDir(config.Paths.Upload, account)
+	ids := []string{}
+	refuse := func(err error) ([]string, error) {
+		for _, id := range ids {
+			faxJobEnd(id, FAX_CANCELLED, "email refused ["+err.Error()+"]")
+		}
+		return nil, err
+	}
+	for _, number := range numbers {
+		id := uuid.NewString()
+		var docs []string
+		if cover {
+			fn := dir+"/"+id+"-cover.txt"
+			text := fmt.Sprintf("From: %s\nTo: %s\nSubject: %s\nDate: %s\n\n%s\n", msg.From, number, msg.Subject,
+			                    time.Now().Format(time.RFC1123), msg.Body)
+			if err := os.WriteFile(fn, []byte(text), 0666); err != nil {
+				return refuse(err)
+			}
+			docs = append(docs, fn)
+		}
+		for _, a := range msg.Attachments {
+			fn := dir+"/"+id+"-"+a.Name
+			if err := os.WriteFile(fn, a.Data, 0666); err != nil {
+				return refuse(err)
+			}
+			if _, err := faxDocumentCheck(fn); err != nil {
+				return refuse(fmt.Errorf("%s: %s", a.Name, err))
+			}
+			docs = append(docs, fn)
+		}
+		req := smtpFaxRequest(number)
+		req.Header = msg.Subject
+		req.DocumentName = filepath.Base(docs[0])
+		req.Email = &FaxEmail{From: msg.From, Subject: msg.Subject, MessageId: msg.MessageId}
+		job := FaxJob{Id: id, Account: account, Request: req, Document: docs[0], Parts: docs[1:]}
+		if err := faxJobCreate(&job); err != nil {
+			return refuse(err)
+		}
+		fmt.Printf("fax job[%s] email from[%s] account[%s] destination[%s] documents%v\n", id, msg.From, account, number,
+		           docs)
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		go faxJobRun(id)
+	}
+	return ids, nil
+}
+
+// smtpFaxRequest is the request of a recipient, its dial string is checked at RCPT.
+func smtpFaxRequest(number string) FaxRequest {
+	return FaxRequest{Destination: number, Gateway: config.Faxmail.Gateway}
+}
+
+// smtpSession speaks enough SMTP for mail clients and relays to hand over a message.
+func smtpSession(conn net.Conn) {
+	defer func() { conn.Close() }()
+	remote := conn.RemoteAddr().String()
+	tp := textproto.NewConn(conn)
+	domain := config.Faxmail.Domain
+	tp.PrintfLine("220 %s ESMTP hct-controller fax gateway", domain)
+	from := ""
+	account := ACCOUNT_ADMIN // billed for the message
+	authed := false
+	secure := false
+	var numbers []string
+	reset := func() {
+		from = ""
+		numbers = nil
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			tp.PrintfLine("250 %s", domain)
+		case "EHLO":
+			tp.PrintfLine("250-%s", domain)
+			tp.PrintfLine("250-SIZE %d", SMTP_MAX_SIZE)
+			if smtpTls != nil && !secure {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			if smtpAuthOffered(secure) {
+				tp.PrintfLine("250-AUTH PLAIN LOGIN")
+			}
+			tp.PrintfLine("250 8BITMIME")
+		case "STARTTLS":
+			if smtpTls == nil || secure {
+				tp.PrintfLine("502 command not implemented")
+				continue
+			}
+			if tp.R.Buffered() > 0 {
+				// commands sent ahead in clear would be taken as sent over TLS
+				tp.PrintfLine("501 data after STARTTLS")
+				return
+			}
+			tp.PrintfLine("220 ready to start TLS")
+			tc := tls.Server(conn, smtpTls)
+			if err := tc.Handshake(); err != nil {
+				fmt.Printf("smtp[%s] tls handshake error [%s]\n", remote, err)
+				return
+			}
+			// the session starts over, RFC 3207
+			conn = tc
+			tp = textproto.NewConn(conn)
+			secure = true
+			authed = false
+			account = ACCOUNT_ADMIN
+			reset()
+		case "AUTH":
+			if !accountEnabled() {
+				tp.PrintfLine("502 command not implemented")
+				continue
+			}
+			if !smtpAuthOffered(secure) {
+				tp.PrintfLine("538 encryption required, STARTTLS first")
+				continue
+			}
+			if authed {
+				tp.PrintfLine("503 already authenticated")
+				continue
+			}
+			id, err := smtpAuth(tp, arg)
+			if err != nil {
+				fmt.Printf("smtp[%s] authentication failed [%s]\n", remote, err)
+				tp.PrintfLine("535 %s", err)
+				continue
+			}
+			authed = true
+			account = id
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			addr, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				tp.PrintfLine("501 syntax: MAIL FROM:<address>")
+				continue
+			}
+			billed, err := smtpSender(addr, authed, account)
+			if err == errSmtpAuthRequired {
+				tp.PrintfLine("530 %s", err)
+			} else if err != nil {
+				fmt.Printf("smtp[%s] sender refused [%s] %s\n", remote, addr, err)
+				tp.PrintfLine("550 %s", err)
+			} else {
+				reset()
+				from = addr
+				account = billed
+				tp.PrintfLine("250 OK")
+			}
+		case "RCPT":
+			addr, ok := smtpPath(arg, "TO:")
+			if !ok {
+				tp.PrintfLine("501 syntax: RCPT TO:<address>")
+				continue
+			}
+			if from == "" {
+				tp.PrintfLine("503 MAIL first")
+				continue
+			}
+			if len(numbers) >= SMTP_MAX_RECIPIENTS {
+				tp.PrintfLine("452 too many recipients")
+				continue
+			}
+			number, err := smtpRecipient(addr)
+			if err == nil {
+				_, err = faxDialString(smtpFaxRequest(number))
+			}
+			if err != nil {
+				tp.PrintfLine("550 %s", err)
+				continue
+			}
+			if err := accountAdmit(account, len(numbers)+1); err != nil {
+				tp.PrintfLine("452 %s", err)
+				continue
+			}
+			numbers = append(numbers, number)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			if len(numbers) == 0 {
+				tp.PrintfLine("503 RCPT first")
+				continue
+			}
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			dr := tp.DotReader()
+			data, err := io.ReadAll(io.LimitReader(dr, SMTP_MAX_SIZE+1))
+			if err != nil {
+				return
+			}
+			if len(data) > SMTP_MAX_SIZE {
+				io.Copy(io.Discard, dr)
+				tp.PrintfLine("552 message too large")
+				reset()
+				continue
+			}
+			msg, err := smtpParse(from, data)
+			if err != nil {
+				tp.PrintfLine("554 invalid message [%s]", err)
+				reset()
+				continue
+			}
+			ids, err := smtpFaxJobs(msg, account, numbers)
+			if err != nil {
+				fmt.Printf("smtp[%s] from[%s] refused [%s]\n", remote, from, err)
+				tp.PrintfLine("554 %s", err)
+				reset()
+				continue
+			}
+			if len(msg.Skipped) > 0 {
+				fmt.Printf("smtp[%s] from[%s] attachments skipped %v\n", remote, from, msg.Skipped)
+			}
+			tp.PrintfLine("250 OK fax jobs %s", strings.Join(ids, " "))
+			reset()
+		case "RSET":
+			reset()
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// smtpRun accepts the SMTP connections when FAXMAIL_LISTEN is set.
+func smtpRun() {
+	addr := config.Faxmail.Listen
+	if addr == "" {
+		return
+	}
+	if config.Faxmail.Domain == "" {
+		fmt.Printf("smtp listener not started, FAXMAIL_DOMAIN not set\n")
+		return
+	}
+	if config.Faxmail.TlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Faxmail.TlsCert, config.Faxmail.TlsKey)
+		if err != nil {
+			fmt.Printf("smtp listener not started, certificate error [%s]\n", err)
+			return
+		}
+		smtpTls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	} else if accountEnabled() && !config.Faxmail.InsecureAuth {
+		fmt.Printf("smtp no FAXMAIL_TLS_CERT, AUTH not offered, no mail is accepted with accounts\n")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("smtp listener error [%s]\n", err)
+		return
+	}
+	fmt.Printf("smtp listening on %s for *@%s tls[%t]\n", addr, config.Faxmail.Domain, smtpTls != nil)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Printf("smtp accept error [%s]\n", err)
+			continue
+		}
+		go smtpSession(conn)
+	}
+}
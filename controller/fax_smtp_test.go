@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSmtpSender(t *testing.T) {
+	testStore(t)
+	testConfig(t)
+	config.Faxmail.Senders = "@example.com"
+	if err := storePut(accountBucket, "acme", Account{Id: "acme", EmailSenders: []string{"@acme.example"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// without accounts FAXMAIL_SENDERS are the senders
+	config.AdminApiKey = ""
+	if account, err := smtpSender("ops@example.com", false, ACCOUNT_ADMIN); err != nil || account != ACCOUNT_ADMIN {
+		t.Errorf("listed sender: [%s] %v", account, err)
+	}
+	if _, err := smtpSender("ops@other.example", false, ACCOUNT_ADMIN); err == nil {
+		t.Errorf("unlisted sender accepted")
+	}
+
+	// with accounts every session authenticates, FAXMAIL_SENDERS bills nobody
+	config.AdminApiKey = "admin-secret"
+	if _, err := smtpSender("ops@example.com", false, ACCOUNT_ADMIN); err != errSmtpAuthRequired {
+		t.Errorf("unauthenticated listed sender: %v, expected %v", err, errSmtpAuthRequired)
+	}
+	if account, err := smtpSender("bob@acme.example", true, "acme"); err != nil || account != "acme" {
+		t.Errorf("account sender: [%s] %v", account, err)
+	}
+	if _, err := smtpSender("bob@other.example", true, "acme"); err == nil {
+		t.Errorf("sender outside email_senders accepted")
+	}
+	if account, err := smtpSender("ops@anything.example", true, ACCOUNT_ADMIN); err != nil || account != ACCOUNT_ADMIN {
+		t.Errorf("admin sender: [%s] %v", account, err)
+	}
+}
+
+// smtpTestTls sets a self-signed certificate for STARTTLS.
+func smtpTestTls(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fax.test"},
+	                         NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := smtpTls
+	smtpTls = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	t.Cleanup(func() { smtpTls = old })
+}
+
+// smtpTestCmd sends a command and returns the reply lines.
+func smtpTestCmd(t *testing.T, tp *textproto.Conn, cmd string) (int, string) {
+	if err := tp.PrintfLine("%s", cmd); err != nil {
+		t.Fatal(err)
+	}
+	code, msg, err := tp.ReadResponse(0)
+	if err != nil && code == 0 {
+		t.Fatal(err)
+	}
+	return code, msg
+}
+
+func TestSmtpSessionAuthTls(t *testing.T) {
+	testStore(t)
+	testConfig(t)
+	smtpTestTls(t)
+	config.AdminApiKey = "admin-secret"
+	config.Faxmail.Domain = "fax.test"
+	if err := storePut(accountBucket, "acme", Account{Id: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	k, err := accountKeyCreate("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go smtpSession(server)
+
+	tp := textproto.NewConn(client)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	code, msg := smtpTestCmd(t, tp, "EHLO client.test")
+	if code != 250 || !strings.Contains(msg, "STARTTLS") || strings.Contains(msg, "AUTH") {
+		t.Fatalf("EHLO in clear: %d [%s], expected STARTTLS and no AUTH", code, msg)
+	}
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00acme\x00" + k.Key))
+	if code, _ := smtpTestCmd(t, tp, "AUTH PLAIN "+plain); code != 538 {
+		t.Fatalf("AUTH in clear: %d, expected 538", code)
+	}
+	if code, _ := smtpTestCmd(t, tp, "MAIL FROM:<bob@acme.example>"); code != 530 {
+		t.Fatalf("MAIL without AUTH: %d, expected 530", code)
+	}
+	if code, _ := smtpTestCmd(t, tp, "STARTTLS"); code != 220 {
+		t.Fatalf("STARTTLS: %d, expected 220", code)
+	}
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tp = textproto.NewConn(tc)
+	code, msg = smtpTestCmd(t, tp, "EHLO client.test")
+	if code != 250 || strings.Contains(msg, "STARTTLS") || !strings.Contains(msg, "AUTH PLAIN LOGIN") {
+		t.Fatalf("EHLO over TLS: %d [%s], expected AUTH", code, msg)
+	}
+	if code, _ := smtpTestCmd(t, tp, "AUTH PLAIN "+plain); code != 235 {
+		t.Fatalf("AUTH over TLS: %d, expected 235", code)
+	}
+	if code, _ := smtpTestCmd(t, tp, "MAIL FROM:<bob@acme.example>"); code != 250 {
+		t.Fatalf("MAIL after AUTH: %d, expected 250", code)
+	}
+	smtpTestCmd(t, tp, "QUIT")
+}
+
+func TestSmtpSessionInsecureAuth(t *testing.T) {
+	testStore(t)
+	testConfig(t)
+	config.AdminApiKey = "admin-secret"
+	config.Faxmail.Domain = "fax.test"
+	config.Faxmail.InsecureAuth = true
+	client, server := net.Pipe()
+	defer client.Close()
+	go smtpSession(server)
+
+	tp := textproto.NewConn(client)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	code, msg := smtpTestCmd(t, tp, "EHLO client.test")
+	if code != 250 || !strings.Contains(msg, "AUTH PLAIN LOGIN") {
+		t.Fatalf("EHLO with insecure_auth: %d [%s], expected AUTH", code, msg)
+	}
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00admin\x00admin-secret"))
+	if code, _ := smtpTestCmd(t, tp, "AUTH PLAIN "+plain); code != 235 {
+		t.Fatalf("AUTH with insecure_auth: %d, expected 235", code)
+	}
+	smtpTestCmd(t, tp, "QUIT")
+}
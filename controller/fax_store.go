@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Fax job lifecycle, jobs are persisted in an embedded bbolt database so they
+// survive a controller restart.
+
+const (
+	FAX_QUEUED       = "queued"
+	FAX_CONVERTING   = "converting"
+	FAX_SCHEDULED    = "scheduled"
+	FAX_DIALING      = "dialing"
+	FAX_NEGOTIATING  = "negotiating"
+	FAX_TRANSMITTING = "transmitting"
+	FAX_RETRYING     = "retrying"
+	FAX_COMPLETED    = "completed"
+	FAX_FAILED       = "failed"
+	FAX_CANCELLED    = "cancelled"
+)
+
+var faxBucket = []byte("faxes")
+
+// allowed transitions, terminal states have no entry
+var faxTransitions = map[string][]string{
+	FAX_QUEUED:       {FAX_CONVERTING, FAX_FAILED, FAX_CANCELLED},
+	FAX_CONVERTING:   {FAX_SCHEDULED, FAX_DIALING, FAX_FAILED, FAX_CANCELLED},
+	FAX_SCHEDULED:    {FAX_DIALING, FAX_FAILED, FAX_CANCELLED},
+	FAX_DIALING:      {FAX_NEGOTIATING, FAX_RETRYING, FAX_FAILED, FAX_CANCELLED},
+	FAX_NEGOTIATING:  {FAX_TRANSMITTING, FAX_RETRYING, FAX_FAILED, FAX_CANCELLED},
+	FAX_TRANSMITTING: {FAX_COMPLETED, FAX_RETRYING, FAX_FAILED, FAX_CANCELLED},
+	FAX_RETRYING:     {FAX_SCHEDULED, FAX_DIALING, FAX_FAILED, FAX_CANCELLED},
+}
+
+var (
+	faxDb *bolt.DB
+	faxJobsMu sync.Mutex
+)
+
+type FaxJobEvent struct {
+	State  string    `json:"state"`
+	Time   time.Time `json:"time"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func faxStateTerminal(state string) bool {
+	_, found := faxTransitions[state]
+	return !found
+}
+
+func faxTransitionAllowed(from string, to string) bool {
+	for _, s := range faxTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func faxStoreOpen(path string) error {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(faxBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	faxDb = db
+	return nil
+}
+
+// storePut keeps v as JSON under the id, the fax store also holds the
+// records of the other features, one bucket each.
+func storePut(bucket []byte, id string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return faxDb.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return bk.Put([]byte(id), b)
+	})
+}
+
+// storeGet reads the record of the id into v, false when there is none.
+func storeGet(bucket []byte, id string, v interface{}) (bool, error) {
+	found := false
+	err := faxDb.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(bucket)
+		if bk == nil {
+			return nil
+		}
+		b := bk.Get([]byte(id))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, v)
+	})
+	return found, err
+}
+
+func storeDelete(bucket []byte, id string) error {
+	return faxDb.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(bucket)
+		if bk == nil {
+			return nil
+		}
+		return bk.Delete([]byte(id))
+	})
+}
+
+// storeEach calls f with every record of the bucket.
+func storeEach(bucket []byte, f func(b []byte) error) error {
+	return faxDb.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(bucket)
+		if bk == nil {
+			return nil
+		}
+		return bk.ForEach(func(k, v []byte) error {
+			return f(v)
+		})
+	})
+}
+
+func faxStorePut(job *FaxJob) error {
+	return storePut(faxBucket, job.Id, job)
+}
+
+func faxStoreGet(id string) (FaxJob, error) {
+	var job FaxJob
+	found, err := storeGet(faxBucket, id, &job)
+	if err == nil && !found {
+		err = fmt.Errorf("fax job not found [%s]", id)
+	}
+	return job, err
+}
+
+func faxStoreList() ([]FaxJob, error) {
+	var jobs []FaxJob
+	err := storeEach(faxBucket, func(b []byte) error {
+		var job FaxJob
+		if err := json.Unmarshal(b, &job); err != nil {
+			fmt.Printf("invalid fax job record [%s]\n", err)
+			return nil
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	return jobs, err
+}
+
+// faxJobCreate stores a new job in the queued state.
+func faxJobCreate(job *FaxJob) error {
+	faxJobsMu.Lock()
+	defer faxJobsMu.Unlock()
+	now := time.Now()
+	job.State = FAX_QUEUED
+	job.Created = now
+	job.Updated = now
+	job.History = []FaxJobEvent{{State: FAX_QUEUED, Time: now}}
+	return faxStorePut(job)
+}
+
+// faxJobUpdate reads, modifies and writes back a job under the store lock.
+func faxJobUpdate(id string, update func(job *FaxJob) error) (FaxJob, error) {
+	faxJobsMu.Lock()
+	defer faxJobsMu.Unlock()
+	job, err := faxStoreGet(id)
+	if err != nil {
+		return job, err
+	}
+	state := job.State
+	if err := update(&job); err != nil {
+		return job, err
+	}
+	job.Updated = time.Now()
+	if err := faxStorePut(&job); err != nil {
+		return job, err
+	}
+	if job.State != state {
+		faxProgressState(job)
+		webhookJobEvent(job) // queued in order, posted by the stream goroutines
+		go mailJobEvent(job)
+		go faxBroadcastJobEvent(job)
+	}
+	return job, nil
+}
+
+func faxJobTransition(id string, state string, detail string) (FaxJob, error) {
+	return faxJobUpdate(id, func(job *FaxJob) error {
+		if !faxTransitionAllowed(job.State, state) {
+			return fmt.Errorf("fax job[%s] invalid transition %s -> %s", id, job.State, state)
+		}
+		fmt.Printf("fax job[%s] %s -> %s %s\n", id, job.State, state, detail)
+		job.State = state
+		job.History = append(job.History, FaxJobEvent{State: state, Time: time.Now(), Detail: detail})
+		return nil
+	})
+}
+
+// faxJobsResume restarts queued jobs, waits again for the next attempt of the
+// retrying ones and fails the ones interrupted by a restart.
+func faxJobsResume() error {
+	if faxDb == nil {
+		return errors.New("fax store not open")
+	}
+	jobs, err := faxStoreList()
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		job := jobs[i]
+		if job.State == FAX_QUEUED {
+			fmt.Printf("fax job[%s] resuming\n", job.Id)
+			go faxJobRun(job.Id)
+		} else if job.State == FAX_RETRYING || job.State == FAX_SCHEDULED {
+			fmt.Printf("fax job[%s] next attempt at %s\n", job.Id, job.NextAttempt.Format(time.RFC3339))
+			go faxJobSend(job.Id)
+		} else if !faxStateTerminal(job.State) {
+			faxJobTransition(job.Id, FAX_FAILED, "interrupted by controller restart")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testStore opens a fax store in a temporary directory for the test, the
+// previous one is put back after it.
+func testStore(t *testing.T) string {
+	dir := t.TempDir()
+	old := faxDb
+	if err := faxStoreOpen(filepath.Join(dir, "fax.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		faxDb.Close()
+		faxDb = old
+	})
+	return dir
+}
+
+// testConfig lets the test change the settings, they are put back after it.
+func testConfig(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+}
+
+func TestStoreHelpers(t *testing.T) {
+	testStore(t)
+	bucket := []byte("test")
+	var v map[string]int
+	if found, err := storeGet(bucket, "a", &v); found || err != nil {
+		t.Fatalf("get from a missing bucket: found %t, %v", found, err)
+	}
+	if err := storePut(bucket, "a", map[string]int{"x": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storePut(bucket, "b", map[string]int{"x": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := storeGet(bucket, "a", &v); !found || err != nil || v["x"] != 1 {
+		t.Fatalf("get a: found %t, %v, %v", found, v, err)
+	}
+	n := 0
+	storeEach(bucket, func(b []byte) error {
+		n++
+		return nil
+	})
+	if n != 2 {
+		t.Fatalf("%d records, expected 2", n)
+	}
+	if err := storeDelete(bucket, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := storeGet(bucket, "a", &v); found {
+		t.Fatal("a still there after delete")
+	}
+}
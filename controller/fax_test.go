@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFaxDialString(t *testing.T) {
+	valid := []struct {
+		req  FaxRequest
+		dial string
+	}{
+		{FaxRequest{Destination: "sip:fax@15.222.241.45:5062"}, "sofia/external/fax@15.222.241.45:5062"},
+		{FaxRequest{Destination: " +15145550100 ", Gateway: "carrier_1"}, "sofia/gateway/carrier_1/+15145550100"},
+		{FaxRequest{Destination: "fax@1.2.3.4", Profile: "internal"}, "sofia/internal/fax@1.2.3.4"},
+		{FaxRequest{Destination: "sofia/gateway/carrier1/15145550100"}, "sofia/gateway/carrier1/15145550100"},
+	}
+	for _, c := range valid {
+		dial, err := faxDialString(c.req)
+		if err != nil || dial != c.dial {
+			t.Errorf("faxDialString(%+v) = [%s] %v, expected [%s]", c.req, dial, err, c.dial)
+		}
+	}
+	invalid := []FaxRequest{
+		{},
+		{Destination: "15145550100"}, // a number needs a gateway
+		{Destination: "fax@1.2.3.4\nJob-UUID: x"},
+		{Destination: "fax@1.2.3.4\r\nbgapi hupall"},
+		{Destination: "fax@1.2.3.4 &park()"},
+		{Destination: "{absolute_codec_string=PCMA}fax@1.2.3.4"},
+		{Destination: "fax@1.2.3.4'"},
+		{Destination: "fax@1.2.3.4\t"},
+		{Destination: "sofia/external/fax@1.2.3.4 &bridge(x)"},
+		{Destination: "sofia/external/fax@1.2.3.4\n"},
+		{Destination: "fax/@1.2.3.4"},
+		{Destination: "15145550100", Gateway: "carrier1\nJob-UUID: x"},
+		{Destination: "15145550100", Gateway: "carrier1/x"},
+		{Destination: "15145550100", Gateway: "c 1"},
+		{Destination: "fax@1.2.3.4", Profile: "external\r\n"},
+		{Destination: "fax@1.2.3.4", Profile: "{x=1}"},
+	}
+	for _, req := range invalid {
+		if dial, err := faxDialString(req); err == nil {
+			t.Errorf("faxDialString(%+v) = [%s], expected an error", req, dial)
+		}
+	}
+}
+
+func TestFaxBroadcastRecipientGateway(t *testing.T) {
+	b := FaxBroadcast{Request: FaxRequest{Gateway: "carrier1"}}
+	for _, gw := range []string{"carrier2\nbgapi hupall", "carrier 2", "a/b"} {
+		req := faxBroadcastRequest(b, FaxRecipient{Destination: "15145550100", Gateway: gw})
+		if _, err := faxDialString(req); err == nil {
+			t.Errorf("recipient gateway [%q] accepted", gw)
+		}
+	}
+	req := faxBroadcastRequest(b, FaxRecipient{Destination: "15145550100"})
+	if dial, err := faxDialString(req); err != nil || dial != "sofia/gateway/carrier1/15145550100" {
+		t.Errorf("recipient without gateway [%s] %v", dial, err)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strings"
+)
+
+// Bi-level page images and an uncompressed TIFF writer, the output is turned
+// into G4 with tiffcp before it is handed to spandsp.
+
+type faxBitmap struct {
+	Width  int
+	Height int
+	Stride int
+	Bits   []byte // rows packed MSB first, 1 is black
+}
+
+func faxBitmapNew(width int, height int) *faxBitmap {
+	stride := (width + 7) / 8
+	return &faxBitmap{Width: width, Height: height, Stride: stride, Bits: make([]byte, stride*height)}
+}
+
+func (b *faxBitmap) Set(x int, y int) {
+	if x < 0 || y < 0 || x >= b.Width || y >= b.Height {
+		return
+	}
+	b.Bits[y*b.Stride+x/8] |= 0x80 >> uint(x%8)
+}
+
+func (b *faxBitmap) Clear(x int, y int) {
+	if x < 0 || y < 0 || x >= b.Width || y >= b.Height {
+		return
+	}
+	b.Bits[y*b.Stride+x/8] &^= 0x80 >> uint(x%8)
+}
+
+// faxLuminance returns the gray level 0 (black) .. 1 (white) of a pixel,
+// transparent pixels are on a white background.
+func faxLuminance(img image.Image, x int, y int) float64 {
+	r, g, b, a := img.At(x, y).RGBA()
+	white := float64(0xffff - a)
+	return (0.299*(float64(r)+white) + 0.587*(float64(g)+white) + 0.114*(float64(b)+white)) / 0xffff
+}
+
+// faxBitmapFromImage scales the image to fit the page, keeping its aspect
+// ratio on the non square fax pixels, and dithers it (Floyd-Steinberg).
+func faxBitmapFromImage(img image.Image, pageWidth int, pageHeight int, xres float64, yres float64) *faxBitmap {
+	page := faxBitmapNew(pageWidth, pageHeight)
+	bounds := img.Bounds()
+	iw := float64(bounds.Dx())
+	ih := float64(bounds.Dy())
+	if iw == 0 || ih == 0 {
+		return page
+	}
+	// inches per source pixel to fit the page
+	scale := float64(pageWidth) / xres / iw
+	if s := float64(pageHeight) / yres / ih; s < scale {
+		scale = s
+	}
+	w := int(iw * scale * xres)
+	h := int(ih * scale * yres)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	offX := (pageWidth - w) / 2
+	// box average of the source pixels covered by each output pixel
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		sy0 := bounds.Min.Y + int(float64(y)*ih/float64(h))
+		sy1 := bounds.Min.Y + int(float64(y+1)*ih/float64(h))
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < w; x++ {
+			sx0 := bounds.Min.X + int(float64(x)*iw/float64(w))
+			sx1 := bounds.Min.X + int(float64(x+1)*iw/float64(w))
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			sum := 0.0
+			n := 0
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					sum += faxLuminance(img, sx, sy)
+					n++
+				}
+			}
+			gray[y*w+x] = sum / float64(n)
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			old := gray[y*w+x]
+			v := 1.0
+			if old < 0.5 {
+				v = 0.0
+				page.Set(offX+x, y)
+			}
+			e := old - v
+			if x+1 < w {
+				gray[y*w+x+1] += e * 7 / 16
+			}
+			if y+1 < h {
+				if x > 0 {
+					gray[(y+1)*w+x-1] += e * 3 / 16
+				}
+				gray[(y+1)*w+x] += e * 5 / 16
+				if x+1 < w {
+					gray[(y+1)*w+x+1] += e * 1 / 16
+				}
+			}
+		}
+	}
+	return page
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value uint32
+}
+
+const (
+	TIFF_SHORT    = 3
+	TIFF_LONG     = 4
+	TIFF_RATIONAL = 5
+)
+
+// faxTiffWrite writes the pages as an uncompressed little endian multi-page TIFF.
+func faxTiffWrite(fn string, pages []*faxBitmap, xres int, yres int) error {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0})
+	nextPtr := 4 // where the offset of the next IFD goes
+	for i, p := range pages {
+		dataOffset := buf.Len()
+		buf.Write(p.Bits)
+		if buf.Len()%2 == 1 {
+			buf.WriteByte(0)
+		}
+		resOffset := buf.Len()
+		binary.Write(&buf, le, []uint32{uint32(xres), 1, uint32(yres), 1})
+		entries := []tiffEntry{
+			{256, TIFF_LONG, 1, uint32(p.Width)},
+			{257, TIFF_LONG, 1, uint32(p.Height)},
+			{258, TIFF_SHORT, 1, 1},                      // BitsPerSample
+			{259, TIFF_SHORT, 1, 1},                      // Compression: none
+			{262, TIFF_SHORT, 1, 0},                      // Photometric: WhiteIsZero
+			{266, TIFF_SHORT, 1, 1},                      // FillOrder: MSB first
+			{273, TIFF_LONG, 1, uint32(dataOffset)},      // StripOffsets
+			{277, TIFF_SHORT, 1, 1},                      // SamplesPerPixel
+			{278, TIFF_LONG, 1, uint32(p.Height)},        // RowsPerStrip
+			{279, TIFF_LONG, 1, uint32(len(p.Bits))},     // StripByteCounts
+			{282, TIFF_RATIONAL, 1, uint32(resOffset)},   // XResolution
+			{283, TIFF_RATIONAL, 1, uint32(resOffset+8)}, // YResolution
+			{296, TIFF_SHORT, 1, 2},                      // ResolutionUnit: inch
+			{297, TIFF_SHORT, 2, uint32(i) | uint32(len(pages))<<16}, // PageNumber
+		}
+		ifdOffset := buf.Len()
+		le.PutUint32(buf.Bytes()[nextPtr:], uint32(ifdOffset))
+		binary.Write(&buf, le, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&buf, le, e.tag)
+			binary.Write(&buf, le, e.typ)
+			binary.Write(&buf, le, e.count)
+			binary.Write(&buf, le, e.value)
+		}
+		nextPtr = buf.Len()
+		binary.Write(&buf, le, uint32(0))
+	}
+	return os.WriteFile(fn, buf.Bytes(), 0666)
+}
+
+// TIFF inspection, checks the pages the way spandsp will read them so a
+// document it would reject or rescale fails before anything is dialed.
+
+type FaxTiffPage struct {
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Compression string  `json:"compression"`
+	XRes        float64 `json:"x_resolution"`
+	YRes        float64 `json:"y_resolution"`
+	FillOrder   int     `json:"fill_order"`
+	Bytes       int64   `json:"bytes"`
+	Error       string  `json:"error,omitempty"`
+	ifdOffset   uint32
+}
+
+type FaxTiffInfo struct {
+	Pages            int           `json:"pages"`
+	Bytes            int64         `json:"bytes"`
+	EstimatedSeconds int           `json:"estimated_seconds"`
+	Valid            bool          `json:"valid"`
+	PageList         []FaxTiffPage `json:"page_list"`
+}
+
+// page widths spandsp accepts for each horizontal resolution (dpi)
+var faxTiffWidths = map[int][]int{
+	204: {1728, 2048, 2432},
+	300: {2592, 3072, 3648},
+	408: {3456, 4096, 4864},
+}
+
+var faxTiffYRes = []float64{98, 196, 391, 100, 200, 300, 400, 600, 800, 1200}
+
+const (
+	FAX_TIFF_BPS           = 14400 // V.17
+	FAX_TIFF_PAGE_OVERHEAD = 6     // seconds of T.30 signaling per page
+	FAX_TIFF_CALL_OVERHEAD = 15    // seconds of call setup and training
+)
+
+type tiffReader struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+func (t tiffReader) u16(off uint32) (uint16, error) {
+	if int(off)+2 > len(t.b) {
+		return 0, errors.New("offset out of range")
+	}
+	return t.order.Uint16(t.b[off:]), nil
+}
+
+func (t tiffReader) u32(off uint32) (uint32, error) {
+	if int(off)+4 > len(t.b) {
+		return 0, errors.New("offset out of range")
+	}
+	return t.order.Uint32(t.b[off:]), nil
+}
+
+// values reads the values of an IFD entry as integers (rationals as num/den pairs).
+func (t tiffReader) values(entry uint32) ([]uint32, error) {
+	typ, _ := t.u16(entry + 2)
+	count, err := t.u32(entry + 4)
+	if err != nil {
+		return nil, err
+	}
+	size := map[uint16]uint32{1: 1, TIFF_SHORT: 2, TIFF_LONG: 4, TIFF_RATIONAL: 8}[typ]
+	if size == 0 || count > 1<<20 {
+		return nil, fmt.Errorf("unsupported entry type %d count %d", typ, count)
+	}
+	off := entry + 8
+	if size*count > 4 {
+		if off, err = t.u32(entry + 8); err != nil {
+			return nil, err
+		}
+	}
+	var vals []uint32
+	for i := uint32(0); i < count; i++ {
+		var v uint32
+		switch typ {
+		case 1:
+			if int(off+i) >= len(t.b) {
+				return nil, errors.New("offset out of range")
+			}
+			v = uint32(t.b[off+i])
+		case TIFF_SHORT:
+			s, err := t.u16(off + i*2)
+			if err != nil {
+				return nil, err
+			}
+			v = uint32(s)
+		case TIFF_LONG:
+			if v, err = t.u32(off + i*4); err != nil {
+				return nil, err
+			}
+		case TIFF_RATIONAL:
+			num, err := t.u32(off + i*8)
+			if err != nil {
+				return nil, err
+			}
+			den, err := t.u32(off + i*8 + 4)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, num, den)
+			continue
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+func faxTiffOpen(fn string) (tiffReader, uint32, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return tiffReader{}, 0, err
+	}
+	t := tiffReader{b: b}
+	switch {
+	case bytes.HasPrefix(b, []byte("II*\x00")):
+		t.order = binary.LittleEndian
+	case bytes.HasPrefix(b, []byte("MM\x00*")):
+		t.order = binary.BigEndian
+	default:
+		return t, 0, errors.New("not a TIFF file")
+	}
+	first, err := t.u32(4)
+	return t, first, err
+}
+
+func faxTiffRational(v []uint32) float64 {
+	if len(v) < 2 || v[1] == 0 {
+		return 0
+	}
+	return float64(v[0]) / float64(v[1])
+}
+
+func faxTiffParsePage(t tiffReader, ifd uint32) (FaxTiffPage, uint32, error) {
+	page := FaxTiffPage{ifdOffset: ifd, FillOrder: 1}
+	n, err := t.u16(ifd)
+	if err != nil {
+		return page, 0, err
+	}
+	compression := uint32(1)
+	t4Options := uint32(0)
+	unit := uint32(2)
+	bps := uint32(1)
+	spp := uint32(1)
+	for i := uint32(0); i < uint32(n); i++ {
+		entry := ifd + 2 + i*12
+		tag, err := t.u16(entry)
+		if err != nil {
+			return page, 0, err
+		}
+		v, err := t.values(entry)
+		if err != nil || len(v) == 0 {
+			continue
+		}
+		switch tag {
+		case 256:
+			page.Width = int(v[0])
+		case 257:
+			page.Height = int(v[0])
+		case 258:
+			bps = v[0]
+		case 259:
+			compression = v[0]
+		case 266:
+			page.FillOrder = int(v[0])
+		case 277:
+			spp = v[0]
+		case 279:
+			for _, c := range v {
+				page.Bytes += int64(c)
+			}
+		case 282:
+			page.XRes = faxTiffRational(v)
+		case 283:
+			page.YRes = faxTiffRational(v)
+		case 292:
+			t4Options = v[0]
+		case 296:
+			unit = v[0]
+		}
+	}
+	if unit == 3 {
+		page.XRes *= 2.54
+		page.YRes *= 2.54
+	}
+	switch {
+	case compression == 1:
+		page.Compression = "none"
+	case compression == 3 && t4Options&1 == 0:
+		page.Compression = "MH"
+	case compression == 3:
+		page.Compression = "MR"
+	case compression == 4:
+		page.Compression = "MMR"
+	default:
+		page.Compression = fmt.Sprintf("unsupported(%d)", compression)
+	}
+	page.Error = faxTiffPageCheck(page, bps, spp)
+	next, err := t.u32(ifd + 2 + uint32(n)*12)
+	return page, next, err
+}
+
+func faxTiffNear(v float64, ref float64) bool {
+	return math.Abs(v-ref) <= ref*0.02
+}
+
+// faxTiffPageCheck returns why spandsp would reject or rescale the page.
+func faxTiffPageCheck(page FaxTiffPage, bps uint32, spp uint32) string {
+	if bps != 1 || spp != 1 {
+		return fmt.Sprintf("not bi-level, %d bits per sample %d samples per pixel", bps, spp)
+	}
+	if strings.HasPrefix(page.Compression, "unsupported") {
+		return "compression " + page.Compression + ", expected MH, MR or MMR"
+	}
+	if page.FillOrder != 1 && page.FillOrder != 2 {
+		return fmt.Sprintf("invalid fill order %d", page.FillOrder)
+	}
+	if page.Width == 0 || page.Height == 0 {
+		return "missing image size"
+	}
+	xres := 0
+	for r := range faxTiffWidths {
+		if faxTiffNear(page.XRes, float64(r)) || (r == 204 && faxTiffNear(page.XRes, 200)) || (r == 408 && faxTiffNear(page.XRes, 400)) {
+			xres = r
+		}
+	}
+	if xres == 0 {
+		return fmt.Sprintf("horizontal resolution %.0f dpi not supported", page.XRes)
+	}
+	widthOk := false
+	for _, w := range faxTiffWidths[xres] {
+		if page.Width == w {
+			widthOk = true
+		}
+	}
+	if !widthOk {
+		return fmt.Sprintf("page width %d pixels at %.0f dpi would be rescaled, expected one of %v", page.Width, page.XRes, faxTiffWidths[xres])
+	}
+	yresOk := false
+	for _, r := range faxTiffYRes {
+		if faxTiffNear(page.YRes, r) {
+			yresOk = true
+		}
+	}
+	if !yresOk {
+		return fmt.Sprintf("vertical resolution %.0f dpi not supported", page.YRes)
+	}
+	return ""
+}
+
+// faxTiffInspect parses every page of the TIFF and estimates its transmission time.
+func faxTiffInspect(fn string) (FaxTiffInfo, error) {
+	var info FaxTiffInfo
+	t, ifd, err := faxTiffOpen(fn)
+	if err != nil {
+		return info, err
+	}
+	seen := make(map[uint32]bool)
+	for ifd != 0 {
+		if seen[ifd] {
+			return info, errors.New("IFD loop")
+		}
+		seen[ifd] = true
+		page, next, err := faxTiffParsePage(t, ifd)
+		if err != nil {
+			return info, fmt.Errorf("page %d: %s", len(info.PageList)+1, err)
+		}
+		info.PageList = append(info.PageList, page)
+		ifd = next
+	}
+	info.Pages = len(info.PageList)
+	if info.Pages == 0 {
+		return info, errors.New("no page")
+	}
+	info.Valid = true
+	seconds := float64(FAX_TIFF_CALL_OVERHEAD)
+	for _, p := range info.PageList {
+		if p.Error != "" {
+			info.Valid = false
+		}
+		size := p.Bytes
+		if p.Compression == "none" {
+			size = size / 15 // typical G4 ratio on text pages
+		}
+		info.Bytes += p.Bytes
+		seconds += float64(size*8)/FAX_TIFF_BPS + FAX_TIFF_PAGE_OVERHEAD
+	}
+	info.EstimatedSeconds = int(math.Ceil(seconds))
+	return info, nil
+}
+
+// faxTiffCheck returns an error describing the first page spandsp would not send as is.
+func faxTiffCheck(info FaxTiffInfo) error {
+	for i, p := range info.PageList {
+		if p.Error != "" {
+			return fmt.Errorf("page %d: %s", i+1, p.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"github.com/google/uuid"
+)
+
+// HTTP callbacks on fax job state changes and received faxes, for the ones
+// who can not consume RMQ_PUB_KEY_FAX. A callback is either given with the job
+// (webhook_url, signed with the webhook secret of the account, WEBHOOK_SECRET
+// for the admin) or registered on /webhooks with its own secret. Deliveries
+// are kept in the fax store until the receiver answers 2xx, so they are
+// retried after a controller restart too. The deliveries of a job (or of a
+// received fax) to a receiver are posted one at a time, in order.
+//
+// Every delivery is signed: X-Fax-Signature: t=<unix time>,v1=<hex>, where
+// hex is the HMAC-SHA256 of "<unix time>.<body>" with the secret, a delivery
+// without a secret is not posted. The callbacks of an account only reach
+// public addresses.
+
+const WEBHOOK_EVENT_RECEIVED = "received"
+const WEBHOOK_MAX_ATTEMPTS = 8
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+var webhookBackoff = []time.Duration{10 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute,
+                                     30 * time.Minute, time.Hour}
+
+var webhookEvents = []string{FAX_QUEUED, FAX_CONVERTING, FAX_SCHEDULED, FAX_DIALING, FAX_NEGOTIATING, FAX_TRANSMITTING,
+                             FAX_RETRYING, FAX_COMPLETED, FAX_FAILED, FAX_CANCELLED, WEBHOOK_EVENT_RECEIVED}
+
+var webhookDefaultEvents = []string{FAX_DIALING, FAX_COMPLETED, FAX_FAILED, FAX_CANCELLED, WEBHOOK_EVENT_RECEIVED}
+
+var webhookBucket = []byte("webhooks")
+var webhookDeliveryBucket = []byte("webhook_deliveries")
+
+var webhookDeliveries = deliveryQueueNew("webhook delivery", webhookDeliveryBucket, webhookBackoff,
+                                         WEBHOOK_MAX_ATTEMPTS)
+
+// not public, the callbacks of an account can not reach them
+var webhookPrivateNets = webhookNets("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+                                     "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+                                     "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8")
+
+var (
+	webhookStreamsMu sync.Mutex
+	webhookStreams = make(map[string][]WebhookDelivery) // waiting behind the delivery being posted
+)
+
+type Webhook struct {
+	Id        string    `json:"id"`
+	Account   string    `json:"account,omitempty"` // only called for the jobs and faxes of the account
+	Url       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	AttachPdf bool      `json:"attach_pdf"` // received faxes are posted as multipart with the PDF
+	Created   time.Time `json:"created"`
+}
+
+type WebhookEvent struct {
+	Event   string      `json:"event"`
+	Time    time.Time   `json:"time"`
+	Job     *FaxJob     `json:"job,omitempty"`
+	Inbound *FaxInbound `json:"inbound,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id          string          `json:"id"`
+	WebhookId   string          `json:"webhook_id,omitempty"` // empty for the webhook_url of a job
+	Account     string          `json:"account,omitempty"`    // owner of the webhook or of the job
+	Stream      string          `json:"stream"`               // receiver and job (or received fax), posted in order
+	Url         string          `json:"url"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Pdf         string          `json:"pdf,omitempty"`
+	LastStatus  int             `json:"last_status"`
+	Created     time.Time       `json:"created"`
+	DeliveryState
+}
+
+func webhookNets(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func webhookIpPublic(ip net.IP) bool {
+	for _, n := range webhookPrivateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookUrlCheck validates the url, the host of an account callback must
+// resolve to public addresses only.
+func webhookUrlCheck(s string, account string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url [%s]", s)
+	}
+	if account == ACCOUNT_ADMIN {
+		return nil
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return fmt.Errorf("invalid webhook url [%s] %s", s, err)
+	}
+	for _, ip := range ips {
+		if !webhookIpPublic(ip) {
+			return fmt.Errorf("invalid webhook url [%s], %s is not a public address", s, ip)
+		}
+	}
+	return nil
+}
+
+// webhookClient returns the HTTP client of the deliveries, the connections of
+// an account callback are refused to non public addresses when they are made,
+// the name may resolve differently than when it was checked.
+func webhookClient(account string) *http.Client {
+	if account == ACCOUNT_ADMIN {
+		return &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	}
+	dialer := &net.Dialer{Timeout: WEBHOOK_TIMEOUT, Control: func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !webhookIpPublic(ip) {
+			return fmt.Errorf("webhook to %s refused, not a public address", host)
+		}
+		return nil
+	}}
+	transport := &http.Transport{Proxy: nil, DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}}
+	return &http.Client{Timeout: WEBHOOK_TIMEOUT, Transport: transport}
+}
+
+// webhookSecret returns the secret signing the webhook_url deliveries of the
+// account, WEBHOOK_SECRET for the admin. The secret of an account is created
+// with it, or on first use for an account created before.
+func webhookSecret(account string) (string, error) {
+	if account == ACCOUNT_ADMIN {
+		return config.WebhookSecret, nil
+	}
+	a, err := accountGet(account)
+	if err != nil {
+		return "", err
+	}
+	if a.WebhookSecret == "" {
+		if a.WebhookSecret, err = webhookSecretNew(); err != nil {
+			return "", err
+		}
+		if err := storePut(accountBucket, a.Id, a); err != nil {
+			return "", err
+		}
+	}
+	return a.WebhookSecret, nil
+}
+
+func webhookSecretNew() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhookJobUrlCheck checks the webhook_url of a job, refused when its
+// deliveries could not be signed.
+func webhookJobUrlCheck(s string, account string) error {
+	if err := webhookUrlCheck(s, account); err != nil {
+		return err
+	}
+	secret, err := webhookSecret(account)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return errors.New("webhook_url refused, WEBHOOK_SECRET not set")
+	}
+	return nil
+}
+
+func webhookEventsCheck(events []string) error {
+	for _, e := range events {
+		if !webhookHasEvent(webhookEvents, e) {
+			return fmt.Errorf("invalid webhook event [%s], expected one of %s", e, strings.Join(webhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+func webhookHasEvent(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookList() ([]Webhook, error) {
+	hooks := []Webhook{}
+	err := storeEach(webhookBucket, func(b []byte) error {
+		var hook Webhook
+		if err := json.Unmarshal(b, &hook); err != nil {
+			fmt.Printf("invalid webhook record [%s]\n", err)
+			return nil
+		}
+		hooks = append(hooks, hook)
+		return nil
+	})
+	return hooks, err
+}
+
+func webhookGet(id string) (Webhook, error) {
+	var hook Webhook
+	found, err := storeGet(webhookBucket, id, &hook)
+	if err == nil && !found {
+		err = fmt.Errorf("webhook not found [%s]", id)
+	}
+	return hook, err
+}
+
+func webhookSign(secret string, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBody returns the JSON payload, or a multipart form with the payload
+// and the PDF when the delivery has one.
+func webhookBody(d WebhookDelivery) ([]byte, string, error) {
+	if d.Pdf == "" {
+		return d.Payload, "application/json", nil
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="payload"`)
+	h.Set("Content-Type", "application/json")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(d.Payload)
+	f, err := os.Open(d.Pdf)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="pdf"; filename="%s"`, filepath.Base(d.Pdf)))
+	h.Set("Content-Type", "application/pdf")
+	part, err = w.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, "", err
+	}
+	w.Close()
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+func webhookPost(d WebhookDelivery, secret string) (int, error) {
+	if secret == "" {
+		return 0, errors.New("no secret to sign the delivery")
+	}
+	body, contentType, err := webhookBody(d)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", d.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := fmt.Sprintf("%d", time.Now().Unix())
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "hct-controller")
+	req.Header.Set("X-Fax-Event", d.Event)
+	req.Header.Set("X-Fax-Delivery", d.Id)
+	req.Header.Set("X-Fax-Signature", "t="+ts+",v1="+webhookSign(secret, ts, body))
+	res, err := webhookClient(d.Account).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook receiver answered [%s]", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// webhookDeliver posts until the receiver accepts the delivery or the attempts run out.
+func webhookDeliver(d WebhookDelivery) {
+	webhookDeliveries.Run(d.Id, d.Event+" "+d.Url, &d.DeliveryState, &d, func() error {
+		secret, err := webhookSecret(d.Account)
+		if d.WebhookId != "" {
+			var hook Webhook
+			hook, err = webhookGet(d.WebhookId)
+			secret = hook.Secret
+		}
+		if err == nil && secret == "" {
+			err = errors.New("no secret to sign the delivery")
+		}
+		if err != nil {
+			return deliveryDrop(err)
+		}
+		status, err := webhookPost(d, secret)
+		d.LastStatus = status
+		return err
+	})
+}
+
+// webhookStreamPush queues the delivery behind the ones of its stream, a
+// goroutine posts them one at a time while the stream has some.
+func webhookStreamPush(d WebhookDelivery) {
+	webhookStreamsMu.Lock()
+	defer webhookStreamsMu.Unlock()
+	pending, running := webhookStreams[d.Stream]
+	webhookStreams[d.Stream] = append(pending, d)
+	if !running {
+		webhookDeliveries.Go(func() { webhookStreamRun(d.Stream) })
+	}
+}
+
+func webhookStreamRun(stream string) {
+	for {
+		webhookStreamsMu.Lock()
+		pending := webhookStreams[stream]
+		if len(pending) == 0 {
+			delete(webhookStreams, stream)
+			webhookStreamsMu.Unlock()
+			return
+		}
+		d := pending[0]
+		webhookStreams[stream] = pending[1:]
+		webhookStreamsMu.Unlock()
+		webhookDeliver(d)
+	}
+}
+
+func webhookQueue(webhookId string, account string, u string, subject string, event string, payload []byte,
+                  pdf string) {
+	target := webhookId
+	if target == "" {
+		target = u
+	}
+	d := WebhookDelivery{Id: uuid.NewString(), WebhookId: webhookId, Account: account, Stream: target+" "+subject, Url: u,
+	                     Event: event, Payload: payload, Pdf: pdf, Created: time.Now(),
+	                     DeliveryState: DeliveryState{NextAttempt: time.Now()}}
+	if err := storePut(webhookDeliveryBucket, d.Id, d); err != nil {
+		fmt.Printf("webhook delivery[%s] store error [%s]\n", d.Id, err)
+	}
+	webhookStreamPush(d)
+}
+
+// webhookNotify queues the event for the webhooks registered for it by the
+// account or the admin, and for the webhook_url of the job. subject is the
+// job or received fax, its deliveries to a receiver are kept in order.
+func webhookNotify(ev WebhookEvent, account string, subject string, jobUrl string, pdf string) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Printf("invalid webhook event [%s]\n", err)
+		return
+	}
+	if jobUrl != "" && webhookHasEvent(webhookDefaultEvents, ev.Event) {
+		webhookQueue("", account, jobUrl, subject, ev.Event, payload, "")
+	}
+	hooks, err := webhookList()
+	if err != nil {
+		fmt.Printf("webhook list error [%s]\n", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !webhookHasEvent(hook.Events, ev.Event) || (hook.Account != ACCOUNT_ADMIN && hook.Account != account) {
+			continue
+		}
+		attach := ""
+		if hook.AttachPdf && pdf != "" && checkFileExists(pdf) {
+			attach = pdf
+		}
+		webhookQueue(hook.Id, hook.Account, hook.Url, subject, ev.Event, payload, attach)
+	}
+}
+
+func webhookJobEvent(job FaxJob) {
+	webhookNotify(WebhookEvent{Event: job.State, Time: job.Updated, Job: &job}, job.Account, job.Id,
+	              job.Request.WebhookUrl, "")
+}
+
+func webhookInboundEvent(fax FaxInbound) {
+	webhookNotify(WebhookEvent{Event: WEBHOOK_EVENT_RECEIVED, Time: fax.Received, Inbound: &fax}, fax.Account, fax.Id,
+	              "", fax.Pdf)
+}
+
+// webhookResume restarts the deliveries pending when the controller stopped.
+func webhookResume() {
+	var pending []WebhookDelivery
+	err := storeEach(webhookDeliveryBucket, func(b []byte) error {
+		var d WebhookDelivery
+		if err := json.Unmarshal(b, &d); err == nil {
+			pending = append(pending, d)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("webhook resume error [%s]\n", err)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Created.Before(pending[j].Created) })
+	for _, d := range pending {
+		fmt.Printf("webhook delivery[%s] %s resuming\n", d.Id, d.Event)
+		if d.Stream == "" {
+			d.Stream = d.Id
+		}
+		webhookStreamPush(d)
+	}
+}
+
+func webhookCreate(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, fmt.Sprintf("invalid webhook [%s]", err), http.StatusBadRequest)
+		return
+	}
+	if err := webhookUrlCheck(hook.Url, accountOf(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(hook.Events) == 0 {
+		hook.Events = webhookDefaultEvents
+	}
+	if err := webhookEventsCheck(hook.Events); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hook.Secret == "" {
+		secret, err := webhookSecretNew()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hook.Secret = secret
+	}
+	hook.Id = uuid.NewString()
+	hook.Account = accountOf(r)
+	hook.Created = time.Now()
+	if err := storePut(webhookBucket, hook.Id, hook); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("webhook[%s] %s events%v\n", hook.Id, hook.Url, hook.Events)
+	// the secret is only returned here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// webhooksHandler serves /webhooks (GET list, POST register) and DELETE /webhooks/{id}
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "webhooks"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		hooks, err := webhookList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := []Webhook{}
+		for _, hook := range hooks {
+			if accountVisible(r, hook.Account) {
+				hook.Secret = ""
+				res = append(res, hook)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	case id == "" && r.Method == "POST":
+		webhookCreate(w, r)
+	case id != "" && r.Method == "DELETE":
+		if hook, err := webhookGet(id); err != nil || !accountVisible(r, hook.Account) {
+			http.Error(w, "webhook not found ["+id+"]", http.StatusNotFound)
+			return
+		}
+		if err := storeDelete(webhookBucket, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
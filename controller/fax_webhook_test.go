@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type webhookTestRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// webhookTestReceiver answers status to every delivery and hands them on the channel.
+func webhookTestReceiver(t *testing.T, status int) (string, <-chan webhookTestRequest) {
+	requests := make(chan webhookTestRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- webhookTestRequest{Header: r.Header, Body: b}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests
+}
+
+// webhookTestQueue stops the deliveries of the test before its store closes.
+func webhookTestQueue(t *testing.T) {
+	testStore(t)
+	testConfig(t)
+	t.Cleanup(webhookDeliveries.Stop)
+}
+
+func webhookTestWait(t *testing.T, requests <-chan webhookTestRequest) webhookTestRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(10 * time.Second):
+		t.Fatal("no delivery received")
+	}
+	return webhookTestRequest{}
+}
+
+func TestWebhookSign(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(`1700000000.{"event":"completed"}`))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if sig := webhookSign("s3cret", "1700000000", []byte(`{"event":"completed"}`)); sig != expected {
+		t.Errorf("signature %s, expected %s", sig, expected)
+	}
+	if webhookSign("other", "1700000000", []byte(`{"event":"completed"}`)) == expected {
+		t.Errorf("same signature with another secret")
+	}
+}
+
+func TestWebhookDeliverSigned(t *testing.T) {
+	webhookTestQueue(t)
+	config.WebhookSecret = "s3cret"
+	u, requests := webhookTestReceiver(t, http.StatusOK)
+	payload, _ := json.Marshal(WebhookEvent{Event: FAX_COMPLETED, Time: time.Now()})
+	webhookQueue("", ACCOUNT_ADMIN, u, "job-1", FAX_COMPLETED, payload, "")
+
+	r := webhookTestWait(t, requests)
+	if r.Header.Get("X-Fax-Event") != FAX_COMPLETED {
+		t.Errorf("X-Fax-Event [%s], expected [%s]", r.Header.Get("X-Fax-Event"), FAX_COMPLETED)
+	}
+	var ts, sig string
+	for _, f := range strings.Split(r.Header.Get("X-Fax-Signature"), ",") {
+		if strings.HasPrefix(f, "t=") {
+			ts = f[2:]
+		} else if strings.HasPrefix(f, "v1=") {
+			sig = f[3:]
+		}
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(ts + "."))
+	mac.Write(r.Body)
+	if ts == "" || !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		t.Errorf("invalid signature [%s]", r.Header.Get("X-Fax-Signature"))
+	}
+	if string(r.Body) != string(payload) {
+		t.Errorf("body %s, expected %s", r.Body, payload)
+	}
+}
+
+func TestWebhookDeliverRetry(t *testing.T) {
+	webhookTestQueue(t)
+	config.WebhookSecret = "s3cret"
+	u, requests := webhookTestReceiver(t, http.StatusServiceUnavailable)
+	webhookQueue("", ACCOUNT_ADMIN, u, "job-1", FAX_FAILED, []byte(`{}`), "")
+	webhookTestWait(t, requests)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var pending []WebhookDelivery
+		storeEach(webhookDeliveryBucket, func(b []byte) error {
+			var d WebhookDelivery
+			if err := json.Unmarshal(b, &d); err == nil {
+				pending = append(pending, d)
+			}
+			return nil
+		})
+		if len(pending) == 1 && pending[0].Attempts == 1 {
+			d := pending[0]
+			if d.LastStatus != http.StatusServiceUnavailable || d.LastError == "" {
+				t.Fatalf("last status %d [%s], expected 503", d.LastStatus, d.LastError)
+			}
+			if wait := time.Until(d.NextAttempt); wait < webhookBackoff[0]-time.Second || wait > webhookBackoff[0] {
+				t.Fatalf("next attempt in %s, expected %s", wait, webhookBackoff[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed delivery not queued for retry %+v", pending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliverNoSecret(t *testing.T) {
+	webhookTestQueue(t)
+	config.WebhookSecret = ""
+	u, requests := webhookTestReceiver(t, http.StatusOK)
+	webhookQueue("", ACCOUNT_ADMIN, u, "job-1", FAX_COMPLETED, []byte(`{}`), "")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := 0
+		storeEach(webhookDeliveryBucket, func(b []byte) error {
+			n++
+			return nil
+		})
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d deliveries left, expected the unsigned one dropped", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-requests:
+		t.Fatal("delivery posted without a secret")
+	default:
+	}
+}
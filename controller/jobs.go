@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job status of the commands, kept in memory from cmdCreate to the report.
+// The calls left come from cmdCallLeftCount, the execs are the voip_patrol
+// processes running in the hct_client container, one per batch of calls.
+
+const (
+	CMD_JOB_QUEUED    = "queued"
+	CMD_JOB_RUNNING   = "running"
+	CMD_JOB_REPORTING = "reporting"
+	CMD_JOB_DONE      = "done"
+	CMD_JOB_FAILED    = "failed"
+	CMD_JOB_CANCELLED = "cancelled"
+)
+
+const CMD_JOBS_KEEP = 500 // ended jobs kept for GET /jobs
+
+type CmdExec struct {
+	Idx     int       `json:"idx"`
+	Calls   int       `json:"calls"`
+	PortSip uint16    `json:"port_sip"`
+	PortRtp uint16    `json:"port_rtp"`
+	Pid     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Elapsed float64   `json:"elapsed"` // seconds
+}
+
+type CmdJob struct {
+	Uuid      string     `json:"uuid"`
+	Type      string     `json:"type"`
+	Account   string     `json:"account,omitempty"`
+	Context   string     `json:"context,omitempty"`
+	Priority  int        `json:"priority"`
+	State     string     `json:"state"`
+	Position  int        `json:"position,omitempty"` // in the queue while queued
+	Calls     int        `json:"calls"`
+	Completed int        `json:"completed"`
+	Remaining int        `json:"remaining"`
+	Dropped   int        `json:"dropped,omitempty"` // not made, the job was cancelled
+	Cancelled bool       `json:"cancelled,omitempty"` // stopping, the state is cancelled once the report is out
+	Error     string     `json:"error,omitempty"`
+	Execs     []CmdExec  `json:"execs"`
+	FaxJobs   []string   `json:"fax_jobs,omitempty"` // of a fax or fax_matrix command
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Ended     *time.Time `json:"ended,omitempty"`
+}
+
+var (
+	cmdJobsMu sync.Mutex
+	cmdJobs = make(map[string]*CmdJob)
+)
+
+func cmdJobEnded(state string) bool {
+	return state == CMD_JOB_DONE || state == CMD_JOB_FAILED || state == CMD_JOB_CANCELLED
+}
+
+func cmdJobCreate(cmd Cmd, calls int) {
+	cmdJobsMu.Lock()
+	defer cmdJobsMu.Unlock()
+	cmdJobs[cmd.Uuid] = &CmdJob{Uuid: cmd.Uuid, Type: cmd.Type, Account: cmd.Account, Context: cmd.Context,
+	                            Priority: cmd.Priority, State: CMD_JOB_QUEUED, Calls: calls, Execs: []CmdExec{},
+	                            Created: time.Now()}
+	cmdJobsPrune()
+}
+
+// cmdJobsPrune drops the oldest ended jobs over CMD_JOBS_KEEP.
+func cmdJobsPrune() {
+	var ended []*CmdJob
+	for _, job := range cmdJobs {
+		if cmdJobEnded(job.State) {
+			ended = append(ended, job)
+		}
+	}
+	if len(ended) <= CMD_JOBS_KEEP {
+		return
+	}
+	sort.Slice(ended, func(i, j int) bool { return ended[i].Ended.Before(*ended[j].Ended) })
+	for _, job := range ended[:len(ended)-CMD_JOBS_KEEP] {
+		delete(cmdJobs, job.Uuid)
+	}
+}
+
+// cmdJobState moves the job to the state, a failed job stays failed and a
+// cancelled job ends cancelled.
+func cmdJobState(uuid string, state string, detail string) {
+	cmdJobsMu.Lock()
+	defer cmdJobsMu.Unlock()
+	job, found := cmdJobs[uuid]
+	if !found || cmdJobEnded(job.State) {
+		return
+	}
+	if state == CMD_JOB_DONE && job.Cancelled {
+		state = CMD_JOB_CANCELLED
+	}
+	now := time.Now()
+	if state == CMD_JOB_RUNNING && job.Started == nil {
+		job.Started = &now
+	}
+	if cmdJobEnded(state) {
+		job.Ended = &now
+	}
+	if detail != "" {
+		job.Error = detail
+	}
+	job.State = state
+	fmt.Printf("job[%s] %s %s\n", uuid, state, detail)
+}
+
+func cmdJobExecStart(uuid string, exec CmdExec) {
+	cmdJobsMu.Lock()
+	defer cmdJobsMu.Unlock()
+	if job, found := cmdJobs[uuid]; found {
+		job.Execs = append(job.Execs, exec)
+	}
+}
+
+// cmdJobExecEnd removes the exec using the SIP port, ports are not shared
+// while it runs.
+func cmdJobExecEnd(uuid string, portSip uint16) {
+	cmdJobsMu.Lock()
+	defer cmdJobsMu.Unlock()
+	job, found := cmdJobs[uuid]
+	if !found {
+		return
+	}
+	for i, exec := range job.Execs {
+		if exec.PortSip == portSip {
+			job.Execs = append(job.Execs[:i], job.Execs[i+1:]...)
+			return
+		}
+	}
+}
+
+// cmdJobGet returns a copy of the job with the calls left and elapsed times.
+func cmdJobGet(uuid string) (CmdJob, bool) {
+	cmdJobsMu.Lock()
+	job, found := cmdJobs[uuid]
+	if !found {
+		cmdJobsMu.Unlock()
+		return CmdJob{}, false
+	}
+	res := *job
+	res.Execs = append([]CmdExec{}, job.Execs...)
+	cmdJobsMu.Unlock()
+
+	cmdCallLeftCountMu.Lock()
+	res.Remaining = cmdCallLeftCount[uuid]
+	cmdCallLeftCountMu.Unlock()
+	res.Completed = res.Calls - res.Remaining - res.Dropped
+	if res.State == CMD_JOB_QUEUED {
+		res.Position = cmdQ.Position(uuid)
+	}
+	for i := range res.Execs {
+		res.Execs[i].Elapsed = time.Since(res.Execs[i].Started).Round(time.Millisecond).Seconds()
+	}
+	return res, true
+}
+
+// cmdJobList returns the jobs, the most recent first.
+func cmdJobList() []CmdJob {
+	cmdJobsMu.Lock()
+	uuids := make([]string, 0, len(cmdJobs))
+	for uuid := range cmdJobs {
+		uuids = append(uuids, uuid)
+	}
+	cmdJobsMu.Unlock()
+	jobs := []CmdJob{}
+	for _, uuid := range uuids {
+		if job, found := cmdJobGet(uuid); found {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.After(jobs[j].Created) })
+	return jobs
+}
+
+// cmdJobDrop counts the calls of a cancelled job that will not be made.
+func cmdJobDrop(uuid string, calls int) {
+	cmdJobsMu.Lock()
+	defer cmdJobsMu.Unlock()
+	if job, found := cmdJobs[uuid]; found {
+		job.Dropped += calls
+	}
+}
+
+func cmdJobCancelled(uuid string) bool {
+	cmdJobsMu.Lock()
+	defer cmdJobsMu.Unlock()
+	job, found := cmdJobs[uuid]
+	return found && job.Cancelled
+}
+
+// cmdJobFaxAdd records a fax job sent by the command, false when the command
+// is cancelled and the job must not run.
+func cmdJobFaxAdd(uuid string, id string) bool {
+	cmdJobsMu.Lock()
+	defer cmdJobsMu.Unlock()
+	job, found := cmdJobs[uuid]
+	if !found {
+		return true
+	}
+	if job.Cancelled {
+		return false
+	}
+	job.FaxJobs = append(job.FaxJobs, id)
+	return true
+}
+
+var errJobEnded = errors.New("job ended or cancelled")
+
+// cmdJobCancel stops the command: a queued command leaves the queue, a running
+// one launches no more calls, its fax jobs still running are cancelled and its
+// voip_patrol execs are terminated. The partial report, marked cancelled, is
+// published when the last exec or fax job ends.
+func cmdJobCancel(uuid string, detail string) (CmdJob, error) {
+	cmdJobsMu.Lock()
+	job, found := cmdJobs[uuid]
+	if !found {
+		cmdJobsMu.Unlock()
+		return CmdJob{}, fmt.Errorf("job not found [%s]", uuid)
+	}
+	if cmdJobEnded(job.State) || job.Cancelled {
+		state := job.State
+		if job.Cancelled {
+			state = "cancelling"
+		}
+		cmdJobsMu.Unlock()
+		return CmdJob{}, fmt.Errorf("%w [%s] %s", errJobEnded, uuid, state)
+	}
+	job.Cancelled = true
+	job.Error = detail
+	account := job.Account
+	faxJobs := append([]string(nil), job.FaxJobs...)
+	cmdJobsMu.Unlock()
+	fmt.Printf("job[%s] cancel %s\n", uuid, detail)
+
+	if cmd, queued := cmdQ.Remove(uuid); queued {
+		cmdJobDrop(uuid, cmdCount(&cmd))
+		cmdCallLeftDelete(uuid)
+		cmdReport(uuid, account)
+	} else {
+		for _, id := range faxJobs {
+			if fax, err := faxStoreGet(id); err != nil || faxStateTerminal(fax.State) {
+				continue
+			}
+			if _, err := faxJobCancel(id, "command cancelled"); err != nil {
+				fmt.Printf("job[%s] fax job[%s] cancel error [%s]\n", uuid, id, err)
+			}
+		}
+		if err := cmdDockerKill(uuid); err != nil {
+			fmt.Printf("job[%s] cancel error [%s]\n", uuid, err)
+		}
+	}
+	res, _ := cmdJobGet(uuid)
+	return res, nil
+}
+
+// cmdCancelMessage reads an AMQP cancel message, {"type":"cancel","uuid":"..."}.
+func cmdCancelMessage(b []byte) (string, bool) {
+	var msg struct {
+		Type string `json:"type"`
+		Uuid string `json:"uuid"`
+	}
+	if err := json.Unmarshal(b, &msg); err != nil || msg.Type != "cancel" {
+		return "", false
+	}
+	return msg.Uuid, true
+}
+
+// cmdJobsHandler serves GET /jobs, GET and DELETE /jobs/{uuid}. The list
+// takes the filters state (comma separated), type, account (admin key), since
+// (RFC 3339) and limit, 100 by default.
+func cmdJobsHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "jobs"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	uuid := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if (uuid == "" && r.Method != "GET") || (r.Method != "GET" && r.Method != "DELETE") {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if uuid != "" {
+		job, found := cmdJobGet(uuid)
+		if !found || !accountVisible(r, job.Account) {
+			http.Error(w, "job not found ["+uuid+"]", http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			var err error
+			job, err = cmdJobCancel(uuid, "cancelled by request")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+	q := r.URL.Query()
+	var states []string
+	if q.Get("state") != "" {
+		states = strings.Split(q.Get("state"), ",")
+	}
+	var since time.Time
+	if q.Get("since") != "" {
+		t, err := time.Parse(time.RFC3339, q.Get("since"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid since [%s]", q.Get("since")), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	limit := 100
+	if q.Get("limit") != "" {
+		n, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid limit [%s]", q.Get("limit")), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	res := []CmdJob{}
+	for _, job := range cmdJobList() {
+		if !accountVisible(r, job.Account) || (q.Get("account") != "" && job.Account != q.Get("account")) {
+			continue
+		}
+		if q.Get("type") != "" && job.Type != q.Get("type") {
+			continue
+		}
+		if !since.IsZero() && job.Created.Before(since) {
+			continue
+		}
+		if states != nil && !cmdJobStateIn(job.State, states) {
+			continue
+		}
+		if len(res) == limit {
+			break
+		}
+		res = append(res, job)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func cmdJobStateIn(state string, states []string) bool {
+	for _, s := range states {
+		if strings.TrimSpace(s) == state {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCmdJobCancelFax(t *testing.T) {
+	testStore(t)
+	oldQ, oldJobs := cmdQ, cmdJobs
+	cmdQ = cmdQueueNew()
+	cmdJobs = make(map[string]*CmdJob)
+	t.Cleanup(func() { cmdQ, cmdJobs = oldQ, oldJobs })
+
+	uuid := "5b0e7a52-6f0c-4a8e-9a43-2f0c1d3e4b5a"
+	cmdJobCreate(Cmd{Uuid: uuid, Type: "fax"}, 2)
+	cmdJobState(uuid, CMD_JOB_RUNNING, "")
+	running := FaxJob{Id: "fax-running"}
+	ended := FaxJob{Id: "fax-ended"}
+	for _, job := range []*FaxJob{&running, &ended} {
+		if err := faxJobCreate(job); err != nil {
+			t.Fatal(err)
+		}
+		if !cmdJobFaxAdd(uuid, job.Id) {
+			t.Fatalf("fax job %s refused by a running command", job.Id)
+		}
+	}
+	if _, err := faxJobCancel(ended.Id, "ended before"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cmdJobCancel(uuid, "cancelled by request"); err != nil {
+		t.Fatal(err)
+	}
+	job, err := faxStoreGet(running.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != FAX_CANCELLED || job.History[len(job.History)-1].Detail != "command cancelled" {
+		t.Errorf("fax job of the command %s [%+v], expected cancelled by the command", job.State, job.History)
+	}
+	job, err = faxStoreGet(ended.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.History[len(job.History)-1].Detail != "ended before" {
+		t.Errorf("ended fax job cancelled again [%+v]", job.History)
+	}
+	// a fax job created after the cancel does not run
+	if cmdJobFaxAdd(uuid, "fax-late") {
+		t.Errorf("fax job accepted by a cancelled command")
+	}
+}
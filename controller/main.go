@@ -9,8 +9,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
 	"io"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
@@ -25,16 +25,17 @@ import (
 var (
 	runners int
 	runnersMu sync.Mutex
-	cmdQ []Cmd
+	cmdQ = cmdQueueNew()
 	tested bool
 	cmdCallLeftCountMu sync.Mutex
 	cmdCallLeftCount map[string]int
+	cmdCallLeftAccount map[string]string
+	cmdCallLeftActive map[string]int // calls of a running command counted as active at most
 	totalActiveCalls int
 	cmdActiveCalls int
 	maxCalls int
 	ports Ports
 	portsMu sync.Mutex
-	count int
 )
 
 func cmdIsCallsLeft(uuid string) (bool){
@@ -50,31 +51,106 @@ func cmdIsCallsLeft(uuid string) (bool){
 	return false
 }
 
-func cmdIncCallLeft(uuid string, x int) (int){
+func cmdIncCallLeft(uuid string, account string, x int) (int){
 	cmdCallLeftCountMu.Lock()
 	defer cmdCallLeftCountMu.Unlock()
 	cmdCallLeftCount[uuid] = x
+	cmdCallLeftAccount[uuid] = account
+	return x
+}
+
+// cmdActiveCallsAdd counts x calls of a command leaving the queue as active,
+// false when they do not fit under maxCalls. x is cmdConcurrentCalls, the
+// command holds them until its calls left go below. A command larger than
+// maxCalls holds all of them and sends its calls in batches as they end, see
+// cmdBatchWait.
+func cmdActiveCallsAdd(uuid string, x int) bool {
+	cmdCallLeftCountMu.Lock()
+	defer cmdCallLeftCountMu.Unlock()
+	if x > maxCalls {
+		x = maxCalls
+	}
+	if totalActiveCalls + x > maxCalls {
+		return false
+	}
 	totalActiveCalls = totalActiveCalls + x
+	cmdCallLeftActive[uuid] = x
+	return true
+}
+
+func cmdActiveCallsHeld(uuid string, left int) int {
+	active := cmdCallLeftActive[uuid]
+	if left < active {
+		return left
+	}
+	return active
+}
+
+// cmdBatchWait waits until n more calls of the command fit under the calls it
+// holds, launched is the calls sent so far, count all its calls.
+func cmdBatchWait(uuid string, count int, launched int, n int) {
+	for !cmdJobCancelled(uuid) {
+		cmdCallLeftCountMu.Lock()
+		left, found := cmdCallLeftCount[uuid]
+		held := cmdCallLeftActive[uuid]
+		cmdCallLeftCountMu.Unlock()
+		if !found || launched - (count - left) + n <= held {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func cmdActiveCallsCount() int {
+	cmdCallLeftCountMu.Lock()
+	defer cmdCallLeftCountMu.Unlock()
 	return totalActiveCalls
 }
 
 func cmdDecCallLeft(uuid string, x int) (int){
+	defer cmdQ.Signal() // calls ended, the held command may fit now
 	cmdCallLeftCountMu.Lock()
 	defer cmdCallLeftCountMu.Unlock()
 	i, found := cmdCallLeftCount[uuid]
 	if !found {
 		return -1
 	}
+	held := cmdActiveCallsHeld(uuid, i)
 	i = i - x
-	totalActiveCalls = totalActiveCalls - x
 	if i < 1 {
+		totalActiveCalls = totalActiveCalls - held
 		delete(cmdCallLeftCount, uuid)
+		delete(cmdCallLeftAccount, uuid)
+		delete(cmdCallLeftActive, uuid)
 	} else {
+		totalActiveCalls = totalActiveCalls - (held - cmdActiveCallsHeld(uuid, i))
 		cmdCallLeftCount[uuid] = i
 	}
 	return i
 }
 
+// cmdCallLeftDelete forgets the calls of a command that never ran.
+func cmdCallLeftDelete(uuid string) {
+	cmdCallLeftCountMu.Lock()
+	defer cmdCallLeftCountMu.Unlock()
+	delete(cmdCallLeftCount, uuid)
+	delete(cmdCallLeftAccount, uuid)
+	delete(cmdCallLeftActive, uuid)
+}
+
+// cmdAccountCalls returns the calls left of the commands of the account.
+func cmdAccountCalls(account string) int {
+	cmdCallLeftCountMu.Lock()
+	defer cmdCallLeftCountMu.Unlock()
+	n := 0
+	for uuid, i := range cmdCallLeftCount {
+		if cmdCallLeftAccount[uuid] == account {
+			n += i
+		}
+	}
+	return n
+}
+
 func runnersActive() bool {
 	runnersMu.Lock()
 	defer runnersMu.Unlock()
@@ -132,6 +208,8 @@ type CallParams struct {
 	IpAddr string
 	BoundAddr string
 	ExpectedCauseCode int16
+	Account string
+	Batch int // exec of the command, names its files
 }
 
 type Cmd struct {
@@ -143,6 +221,12 @@ type Cmd struct {
 	Type string    `json:"type"`
 	Cps int        `json:"cps"`
 	CallCount int
+	Document string `json:"document"` // fax: test document in /files
+	Receiver string `json:"receiver"` // fax: controller of the receiving side, RECEIVER_URL for an account, local store when empty
+	Matrix FaxMatrix `json:"matrix"`   // fax_matrix: settings combined in the matrix
+	Account string `json:"account"`  // tenant, taken from the API key on /cmd
+	Priority int   `json:"priority"` // 0 to 9, higher runs first, FIFO within a level
+	Ramp CmdRamp   `json:"ramp"`     // pacing profile up to Cps
 }
 
 type RtpTransfer struct {
@@ -178,6 +262,7 @@ type CallInfo struct {
 
 type TestReport struct {
 	Label            string     `json:"label"`
+	Account          string     `json:"account,omitempty"`
 	Start            string     `json:"start"`
 	End              string     `json:"end"`
 	Action           string     `json:"action"`
@@ -230,6 +315,7 @@ type ReportSip struct {
 
 type Report struct {
 	Uuid        string  `json:"uuid"`
+	Account     string  `json:"account,omitempty"`
 	Calls       int32   `json:"calls"`
 	Duration    int32   `json:"duration"`
 	AvgDuration float32 `json:"avg_duration"`
@@ -238,10 +324,11 @@ type Report struct {
 	Reachable   int32     `json:"reachable"`
 	Sip         ReportSip `json:"sip"`
 	Rtp         ReportRtp `json:"rtp"`
+	Cancelled   bool      `json:"cancelled,omitempty"` // partial, the job was cancelled
 }
 
-// Compile templates on start of the application
-var templates = template.Must(template.ParseFiles("public/cmd.html"))
+// Compiled on start of the application, see templatesInit
+var templates *template.Template
 
 // Display the named template
 func display(w http.ResponseWriter, page string) {
@@ -249,7 +336,7 @@ func display(w http.ResponseWriter, page string) {
 		LocalIp string
 		VpServer string
 	}
-	data := Vars{os.Getenv("LOCAL_IP"), os.Getenv("VP_SERVER_IP")} 
+	data := Vars{config.Net.LocalIp, config.Vp.ServerIp} 
 	err := templates.ExecuteTemplate(w, page+".html", data)
 	if err != nil {
 		fmt.Printf("error [%s]\n", err.Error())
@@ -258,42 +345,34 @@ func display(w http.ResponseWriter, page string) {
 	}
 }
 
-func cmdDockerExec(uuid string, idx int, callCount int, portSip uint16, portRtp uint16, ipAddr string, boundAddr string) (error) {
+func cmdDockerExec(uuid string, account string, idx int, batch int, callCount int, portSip uint16, portRtp uint16, ipAddr string, boundAddr string) (error) {
 	defer runnersDec()
 	sport := fmt.Sprintf("%d", portSip)
 	rport := fmt.Sprintf("%d", portRtp)
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
+	// the calls of the batch will not be made, the job fails
+	fail := func(err error) error {
+		cmdJobState(uuid, CMD_JOB_FAILED, err.Error())
 		cmdDecCallLeft(uuid, callCount)
+		portsFreeSipPort(portSip)
+		portsFreeRtpPort(portRtp)
 		return err
 	}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return fail(err)
+	}
 	ctx := context.Background()
 	fmt.Printf("client created... [%s]\n", sport)
 	cli.NegotiateAPIVersion(ctx)
 
-	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	containerId, err := cmdClientContainer(ctx, cli)
 	if err != nil {
-		cmdDecCallLeft(uuid, callCount)
-		return err
-	}
-	containerId := ""
-	containerName := ""
-	for _, ctr := range containers {
-		if strings.Contains(ctr.Image, "hct_client") {
-			containerId = ctr.ID
-			containerName = ctr.Image
-			fmt.Printf("hct_client container running %s %s\n", containerName, containerId)
-			break
-		}
-	}
-	if containerId == "" {
-		err := errors.New("hct_client container not running\n")
-		return err
+		return fail(err)
 	}
 
-	xml_fn := fmt.Sprintf("/xml/hct/%s-%d.xml", uuid, idx)
-	out_fn := fmt.Sprintf("/output/%s-%d.json", uuid, idx)
-	log_fn := fmt.Sprintf("/output/%s-%d.log", uuid, idx)
+	xml_fn := fmt.Sprintf("%s/%s-%d-%d.xml", accountDir(config.Paths.Xml, account), uuid, idx, batch)
+	out_fn := fmt.Sprintf("%s/%s-%d-%d.json", accountOutputDir(account), uuid, idx, batch)
+	log_fn := fmt.Sprintf("%s/%s-%d-%d.log", accountOutputDir(account), uuid, idx, batch)
 	cmd := []string{"/git/voip_patrol/voip_patrol", "--udp",  "--rtp-port", rport,
                         "--port", sport,
                         "--conf", xml_fn,
@@ -301,8 +380,8 @@ func cmdDockerExec(uuid string, idx int, callCount int, portSip uint16, portRtp
                         "--log", log_fn,
                         "--ip-addr", ipAddr,
                         "--bound-addr", boundAddr,
-                        "--log-level-file", os.Getenv("VP_LOG_LEVEL"),
-                        "--log-level-console", os.Getenv("VP_LOG_LEVEL")}
+                        "--log-level-file", strconv.Itoa(config.Vp.LogLevel),
+                        "--log-level-console", strconv.Itoa(config.Vp.LogLevel)}
 	execConfig := types.ExecConfig{
 		AttachStdout: true,
 		AttachStderr: true,
@@ -312,7 +391,7 @@ func cmdDockerExec(uuid string, idx int, callCount int, portSip uint16, portRtp
 	response, err := cli.ContainerExecCreate(ctx, containerId, execConfig)
 	if err != nil {
 		fmt.Printf("error [%s]\n", err.Error())
-		return err
+		return fail(err)
 	}
 	startConfig := types.ExecStartCheck{
 		Detach: false,
@@ -324,44 +403,122 @@ func cmdDockerExec(uuid string, idx int, callCount int, portSip uint16, portRtp
 	if err != nil {
 		fmt.Printf("error [%s]\n", err.Error())
 		runnersDec()
-		return err
+		return fail(err)
 	}
 	fmt.Printf("ContainerExecStart [%s]\n", containerId)
 	execInspect, err := cli.ContainerExecInspect(ctx, response.ID)
 	fmt.Printf("ContainerExecInspect >> pid[%d]running[%t]\n", execInspect.Pid, execInspect.Running)
+	cmdJobExecStart(uuid, CmdExec{Idx: idx, Calls: callCount, PortSip: portSip, PortRtp: portRtp,
+	                              Pid: execInspect.Pid, Started: time.Now()})
+	if cmdJobCancelled(uuid) {
+		// cancelled while the exec was starting
+		cmdDockerKill(uuid)
+	}
 	time.Sleep(10 * time.Second)
 	for execInspect.Running {
 		time.Sleep(1000 * time.Millisecond)
 		execInspect, err = cli.ContainerExecInspect(ctx, response.ID)
 		fmt.Printf("ContainerExecInspect >> pid[%d]running[%t]\n", execInspect.Pid, execInspect.Running)
 	}
+	cmdJobExecEnd(uuid, portSip)
 	x := cmdDecCallLeft(uuid, callCount)
 	portsFreeSipPort(portSip)
 	portsFreeRtpPort(portRtp)
-	fmt.Printf("uuid[%s] idx[%d] calls completed[%d] left[%d] total_active_Calls[%d]\n", uuid, idx, callCount, x, totalActiveCalls)
+	fmt.Printf("uuid[%s] idx[%d] calls completed[%d] left[%d] total_active_Calls[%d]\n", uuid, idx, callCount, x, cmdActiveCallsCount())
 	if x == 0 {
-		report, err := resGetReport(uuid)
-		if err != nil { 
-			return err
-		} else {
-			rmqPublish(report, os.Getenv("RMQ_PUB_KEY_SUMMARY"))
-			cleanUp(uuid)
+		return cmdReport(uuid, account)
+	}
+	return nil
+}
+
+// cmdReport publishes the summary of the command once its calls ended.
+func cmdReport(uuid string, account string) (error) {
+	cmdJobState(uuid, CMD_JOB_REPORTING, "")
+	report, err := resGetReport(uuid, account)
+	if err != nil { 
+		cmdJobState(uuid, CMD_JOB_FAILED, err.Error())
+		return err
+	}
+	rmqPublish(report, config.Rmq.PubKeySummary)
+	cleanUp(uuid, account)
+	cmdJobState(uuid, CMD_JOB_DONE, "")
+	return nil
+}
+
+func cmdClientContainer(ctx context.Context, cli *client.Client) (string, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, ctr := range containers {
+		if strings.Contains(ctr.Image, "hct_client") {
+			fmt.Printf("hct_client container running %s %s\n", ctr.Image, ctr.ID)
+			return ctr.ID, nil
 		}
 	}
+	return "", errors.New("hct_client container not running")
+}
+
+// cmdUuidCheck tells if the command uuid is a UUID, it goes in file names and
+// in the kill script.
+func cmdUuidCheck(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("invalid uuid [%s]", id)
+	}
 	return nil
 }
 
-func createXmlFile(uuid string, idx int, xml string) (error) {
+// cmdDockerKill terminates the voip_patrol processes of the command, found by
+// the uuid in their command line (--conf and --output), in the hct_client
+// container. The waiting cmdDockerExec then frees the ports and reports.
+func cmdDockerKill(uuid string) (error) {
+	// the uuid is pasted in the script
+	if err := cmdUuidCheck(uuid); err != nil {
+		return err
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	cli.NegotiateAPIVersion(ctx)
+	containerId, err := cmdClientContainer(ctx, cli)
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`for p in /proc/[0-9]*; do
+  [ "${p#/proc/}" = "$$" ] && continue
+  grep -qa voip_patrol $p/cmdline 2>/dev/null && grep -qa '/%s-' $p/cmdline 2>/dev/null && kill ${p#/proc/}
+done; true`, uuid)
+	execConfig := types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd: []string{"sh", "-c", script},
+	}
+	response, err := cli.ContainerExecCreate(ctx, containerId, execConfig)
+	if err != nil {
+		return err
+	}
+	err = cli.ContainerExecStart(ctx, response.ID, types.ExecStartCheck{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("cmdDockerKill: uuid[%s] voip_patrol terminated in [%s]\n", uuid, containerId)
+	return nil
+}
+
+func createXmlFile(uuid string, account string, idx int, batch int, xml string) (error) {
 	// Create file
-	dst, err := os.Create(fmt.Sprintf("/xml/hct/%s-%d.xml", uuid, idx))
+	fn := fmt.Sprintf("%s/%s-%d-%d.xml", accountDir(config.Paths.Xml, account), uuid, idx, batch)
+	dst, err := os.Create(fn)
 	if err != nil {
 		return err
 	}
 	defer dst.Close()
-	if err := os.WriteFile(fmt.Sprintf("/xml/hct/%s-%d.xml", uuid, idx), []byte(xml), 0666); err != nil {
+	if err := os.WriteFile(fn, []byte(xml), 0666); err != nil {
 		return err
 	}
-	fmt.Printf("createXmlFile: %s\n",fmt.Sprintf("/xml/hct/%s-%d.xml", uuid, idx))
+	fmt.Printf("createXmlFile: %s\n", fn)
 	return nil
 }
 
@@ -439,53 +596,164 @@ func portsGetSipPort() (uint16) {
 
 func cmdCallCreateParams(cmd Cmd, c Call, idx int) (CallParams, error) {
 	p := CallParams{c.Ruri, c.From, 0, c.Username, c.Password,
-	                c.Duration, c.EarlyRecord, portsGetRtpPort(), portsGetSipPort(), idx, cmd.Uuid, "", "", c.ExpectedCauseCode}
+	                c.Duration, c.EarlyRecord, portsGetRtpPort(), portsGetSipPort(), idx, cmd.Uuid, "", "", c.ExpectedCauseCode,
+	                cmd.Account, 0}
 	if cmd.Context == "customer" {
-		p.IpAddr = os.Getenv("PUBLIC_IP_CUSTOMER");
-		p.BoundAddr = os.Getenv("PRIVATE_IP_CUSTOMER");
+		p.IpAddr = config.Net.PublicIpCustomer;
+		p.BoundAddr = config.Net.PrivateIpCustomer;
 	} else if cmd.Context == "provider" {
-		p.IpAddr = os.Getenv("PUBLIC_IP_PROVIDER");
-		p.BoundAddr = os.Getenv("PRIVATE_IP_PROVIDER");
+		p.IpAddr = config.Net.PublicIpProvider;
+		p.BoundAddr = config.Net.PrivateIpProvider;
 	}
 	return p, nil
 }
 
 func cmdMakeCalls(cmd Cmd) (error) {
+	pacer := cmdPacerNew(cmd)
+	if cmd.Type == "fax" || cmd.Type == "fax_matrix" {
+		for i, c := range cmd.CallsIn {
+			go func(c Call, i int) {
+				for n := 0; n < c.Count; n++ {
+					if cmdJobCancelled(cmd.Uuid) || pacer.Done() {
+						cmdJobDrop(cmd.Uuid, c.Count-n)
+						if cmdDecCallLeft(cmd.Uuid, c.Count-n) == 0 {
+							cmdJobState(cmd.Uuid, CMD_JOB_DONE, "")
+						}
+						return
+					}
+					if pacer != nil {
+						pacer.Take(1)
+					}
+					if cmd.Type == "fax_matrix" {
+						cmdFaxMatrix(cmd, c, i)
+					} else {
+						cmdFaxTest(cmd, c, i)
+					}
+				}
+			}(c, i)
+		}
+		return nil
+	}
 	var CallsParams []CallParams
+	launched := 0
+	batch := 0
+	count := cmdCount(&cmd)
+	// a batch fits under the calls the command holds
+	size := CMD_PACE_MAX_BATCH
+	if size > maxCalls {
+		size = maxCalls
+	}
+	// stop drops the calls not launched yet when the job is cancelled or the
+	// hold time is over and frees their ports, the report is published when
+	// no exec is left running
+	stop := func() bool {
+		reason := ""
+		if cmdJobCancelled(cmd.Uuid) {
+			reason = "cancelled"
+		} else if pacer.Done() {
+			reason = "hold time over"
+		} else {
+			return false
+		}
+		for _, p := range CallsParams {
+			portsFreeSipPort(p.PortSip)
+			portsFreeRtpPort(p.PortRtp)
+		}
+		dropped := count - launched
+		cmdJobDrop(cmd.Uuid, dropped)
+		x := cmdDecCallLeft(cmd.Uuid, dropped)
+		fmt.Printf("cmdMakeCalls: uuid[%s] %s, calls dropped[%d] left[%d]\n", cmd.Uuid, reason, dropped, x)
+		if x == 0 {
+			cmdReport(cmd.Uuid, cmd.Account)
+		}
+		return true
+	}
+	if pacer != nil {
+		// one exec for the calls of each pacer tick
+		for i, c := range cmd.CallsIn {
+			repeat := c.Count
+			if repeat == 0 {
+				repeat = 1
+			}
+			for repeat > 0 {
+				max := repeat
+				if max > size {
+					max = size
+				}
+				cmdBatchWait(cmd.Uuid, count, launched, max)
+				if stop() {
+					return nil
+				}
+				n := pacer.Take(max)
+				params, _ := cmdCallCreateParams(cmd, c, i)
+				params.Repeat = n-1
+				params.Batch = batch
+				batch++
+				launched += n
+				repeat -= n
+				go cmdExecCall([]CallParams{params})
+			}
+		}
+		return nil
+	}
 	for i, c := range cmd.CallsIn {
 		repeat := c.Count
 		fmt.Printf("cmdMakeCalls: proceeding with test, count[%d]\n", repeat)
 		if repeat > 0 {
 			for repeat > 0 {
-				params, _ := cmdCallCreateParams(cmd, c, i)
-				if repeat < 50 {
-					params.Repeat = repeat-1
-					repeat = 0
-				} else {
-					params.Repeat = 49
-					repeat -= 50
+				n := repeat
+				if n > size {
+					n = size
+				}
+				cmdBatchWait(cmd.Uuid, count, launched, n)
+				if stop() {
+					return nil
 				}
+				params, _ := cmdCallCreateParams(cmd, c, i)
+				params.Repeat = n-1
+				repeat -= n
+				params.Batch = batch
+				batch++
 				CallsParams = append(CallsParams, params)
+				launched += params.Repeat + 1
 				go cmdExecCall(CallsParams)
-				CallsParams = CallsParams[:0]
+				CallsParams = nil
 				time.Sleep(250 * time.Millisecond)
 			}
 		} else {
+			if stop() {
+				return nil
+			}
 			params, _ := cmdCallCreateParams(cmd, c, i)
 			CallsParams = append(CallsParams, params)
-			if i >= 0 && i % 50 == 0 {
+			if i % 50 == 0 || len(CallsParams) >= size {
+				cmdBatchWait(cmd.Uuid, count, launched, len(CallsParams))
+				if stop() {
+					return nil
+				}
+				CallsParams[0].Batch = batch
+				batch++
+				launched += len(CallsParams)
 				go cmdExecCall(CallsParams)
-				CallsParams = CallsParams[:0]
+				CallsParams = nil
 				time.Sleep(2100 * time.Millisecond)
 			}
 		}
 	}
+	if len(CallsParams) > 0 {
+		cmdBatchWait(cmd.Uuid, count, launched, len(CallsParams))
+		if stop() {
+			return nil
+		}
+		CallsParams[0].Batch = batch
+		go cmdExecCall(CallsParams)
+	}
 	return nil
 }
 
 const N2T_CODE = 800;
 
-func cmdCreateCall(cmd *Cmd, cmdQ *[]Cmd,  context string, idx int) (error) {
+func cmdCreateCall(cmd *Cmd, context string, idx int) (error) {
 	if cmd.Context == "" {
 		cmd.Context = context
 	}
@@ -497,10 +765,20 @@ func cmdCreateCall(cmd *Cmd, cmdQ *[]Cmd,  context string, idx int) (error) {
 			cmd.CallsIn[i].Duration = 0
 			cmd.CallsIn[i].Count = 1
 			cmd.CallsIn[i].ExpectedCauseCode = N2T_CODE // This is a hack to identify the test type when looking at the result.
+		} else if cmd.Type == "fax" || cmd.Type == "fax_matrix" { // fax: round-trip of a test document, count times
+			if cmd.Type == "fax_matrix" {
+				if _, err := faxMatrixCells(cmd.Matrix); err != nil {
+					return err
+				}
+			}
+			cmd.CallsIn[i].Duration = 0
+			if cmd.CallsIn[i].Count == 0 {
+				cmd.CallsIn[i].Count = 1
+			}
 		}
 		fmt.Printf("cmd[%s] %d\n", cmd.Type, cmd.CallsIn[i].EarlyRecord);
 		if cmd.CallsIn[i].Allow != "" {
-			host := os.Getenv("VP_SERVER_IP")+":"+os.Getenv("VP_SERVER_PORT")
+			host := config.Vp.ServerIp+":"+strconv.Itoa(config.Vp.ServerPort)
 			code, _ := AllowIp(host, cmd.CallsIn[i].Allow)
 			if code != 200 {
 				err := errors.New(fmt.Sprintf("allow UP failed with code : %d\n", code))
@@ -525,135 +803,86 @@ func cmdCreateCall(cmd *Cmd, cmdQ *[]Cmd,  context string, idx int) (error) {
 		cmd.CallsIn[i].Idx = idx
 		cmd.CallsOut = append(cmd.CallsOut, cmd.CallsIn[i])
 	}
-	*cmdQ = append(*cmdQ, *cmd)
 	return nil
 }
 
-func cmdCreate(s string, cmdQ *[]Cmd,  context string) (string, error) {
+func cmdCreate(s string, cmdQ *CmdQueue,  context string, account string) (string, error) {
 	cmd := new(Cmd)
 	b := []byte(s)
 
 	err := json.Unmarshal(b, cmd)
 	if err != nil {
-		fmt.Printf("invalid command [%s][%s]\n", cmd, err)
+		fmt.Printf("invalid command [%s][%s]\n", s, err)
 		return "", err
 	}
-	if cmd.Uuid == "" {
+	// an account key never chooses the uuid, the admin may give its own
+	if cmd.Uuid == "" || account != ACCOUNT_ADMIN {
 		cmd.Uuid = uuid.NewString()
+	} else if err := cmdUuidCheck(cmd.Uuid); err != nil {
+		return "", err
+	} else if _, found := cmdJobGet(cmd.Uuid); found {
+		return "", fmt.Errorf("uuid already used [%s]", cmd.Uuid)
 	}
-	count := 0
-	for i := 0; i < len(cmd.Calls); i++ {
-		if cmd.Calls[i].Count == 0 {
-			count++
-		} else {
-			count = count + cmd.Calls[i].Count
-		}
+	if account != ACCOUNT_ADMIN {
+		cmd.Account = account
 	}
-	if count + totalActiveCalls > maxCalls {
-		fmt.Printf("too many active calls, adding to queue %d > %d (max calls) \n", count, maxCalls)
+	if err := cmdPriorityCheck(cmd.Priority); err != nil {
+		return cmd.Uuid, err
+	}
+	if err := cmdPaceCheck(cmd); err != nil {
+		return cmd.Uuid, err
+	}
+	if err := faxTestReceiverCheck(cmd.Receiver, account); err != nil {
+		return cmd.Uuid, err
+	}
+	count := cmdCount(cmd)
+	// the paced calls up at once never fit, the others go out in batches
+	if concurrent, ok := cmdPacedCalls(cmd); ok && concurrent > maxCalls {
+		fmt.Printf("too many concurrent calls requested %d > %d (max calls)\n", concurrent, maxCalls)
+		err := fmt.Errorf("too many concurrent calls requested %d > %d (max calls), lower cps or the call duration", concurrent, maxCalls)
+		return cmd.Uuid, err
 	}
-	if count > maxCalls {
-		fmt.Printf("too many calls requested %d > %d (max calls)\n", count, maxCalls)
-		err := errors.New("too many calls requested")
+	if err := accountAdmit(cmd.Account, count); err != nil {
+		fmt.Printf("account[%s] %s\n", cmd.Account, err)
 		return cmd.Uuid, err
 	}
-	cmdIncCallLeft(cmd.Uuid, count)
 	fmt.Printf(">>>>> cmdCreate: calls[%d] count[%d] <<<<<\n", len(cmd.Calls), count)
-	// create and queue each call
+	// create each call and queue the command
 	i := 0
 	for ; i < len(cmd.Calls); i++ {
 		cmd.CallsIn = append(cmd.CallsIn, cmd.Calls[i])
 	}
-	err = cmdCreateCall(cmd, cmdQ, context, i)
+	err = cmdCreateCall(cmd, context, i)
 	if err != nil {
-		fmt.Printf("error creating call [%s][%s]\n", cmd, err)
+		fmt.Printf("error creating call [%s][%s]\n", cmd.Uuid, err)
 		return cmd.Uuid, err
 	}
+	cmdIncCallLeft(cmd.Uuid, cmd.Account, count)
+	cmdJobCreate(*cmd, count)
+	position := cmdQ.Push(*cmd)
+	fmt.Printf("uuid[%s] queued priority[%d] position[%d] calls[%d] total_active_calls[%d]\n",
+	           cmd.Uuid, cmd.Priority, position, count, cmdActiveCallsCount())
 	return cmd.Uuid, nil
 }
 
-// Compile templates on start of the application
-var templates_ui = template.Must(template.ParseFiles("public/upload.html"))
+var templates_ui *template.Template
+
+// templatesInit compiles the templates of public/, mounted next to the
+// binary, in main so the package can be tested without them.
+func templatesInit() {
+	templates = template.Must(template.ParseFiles("public/cmd.html"))
+	templates_ui = template.Must(template.ParseFiles("public/upload.html"))
+}
 // Display the named template
 func display_ui(w http.ResponseWriter, page string, data interface{}) {
         templates_ui.ExecuteTemplate(w, page+".html", data)
 }
-func dockerExecSendFax(fn string) (error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return err
-	}
-	ctx := context.Background()
-	fmt.Printf("docker client created...\n")
-	cli.NegotiateAPIVersion(ctx)
-
-	containers, err := cli.ContainerList(ctx, container.ListOptions{})
-	if err != nil {
-		return err
-	}
-	containerId := ""
-	containerName := ""
-	for _, ctr := range containers {
-		if strings.Contains(ctr.Image, "freeswitch") {
-			containerId = ctr.ID
-			containerName = ctr.Image
-			fmt.Printf("freeswitch container running %s %s\n", containerName, containerId)
-			break
-
-		}
-			fmt.Printf("container running %s %s\n", ctr.ID, ctr.Image)
-	}
-	if containerId == "" {
-		err := errors.New("freeswitch container not running\n")
-		return err
-	}
-	// cmd := []string{"echo", "fs_cli", fn}
-	// cmd := []string{"gs", "-q", "-dNOPAUSE", "-sDEVICE=tiffg4", "-sOutputFile=/files/upload/"+fn+".tiff", "/files/upload/"+fn,"-c","quit"}
-	cmd_gs := exec.Command("gs", "-q", "-dNOPAUSE", "-sDEVICE=tiffg4", "-sOutputFile=/files/upload/"+fn+".tiff", "/files/upload/"+fn,"-c","quit")
-	output, err := cmd_gs.Output()
-	if err != nil {
-		fmt.Println("Error executing command:", err)
- 		return err
-	}
-	fmt.Println(string(output))
-	// gs -q -dNOPAUSE -sDEVICE=tiffg4 -sOutputFile=/files/upload/tx.tiff /files/upload/invoice.pdf -c quit
-	cmd := []string{"/usr/local/freeswitch/bin/fs_cli","-x", "originate {absolute_codec_string='PCMU'}sofia/external/fax@15.222.241.45:5062 &txfax(/files/upload/"+fn+".tiff)"}
-
-	execConfig := types.ExecConfig{
-		AttachStdout: true,
-		AttachStderr: true,
-		Cmd: cmd,
-	}
-
-	response, err := cli.ContainerExecCreate(ctx, containerId, execConfig)
-	if err != nil {
-		fmt.Printf("error [%s]\n", err.Error())
-		return err
-	}
-	startConfig := types.ExecStartCheck{
-		Detach: false,
-		Tty:    false,
-	}
-	fmt.Printf("ContainerExecCreate [%s] cmd %s\n", containerId, cmd)
-	runnersInc()
-	err = cli.ContainerExecStart(ctx, response.ID, startConfig)
-	if err != nil {
-		fmt.Printf("error [%s]\n", err.Error())
-		runnersDec()
-		return err
-	}
-	fmt.Printf("ContainerExecStart [%s]\n", containerId)
-	execInspect, err := cli.ContainerExecInspect(ctx, response.ID)
-	fmt.Printf("ContainerExecInspect >> pid[%d]running[%t]\n", execInspect.Pid, execInspect.Running)
-	time.Sleep(10 * time.Second)
-	for execInspect.Running {
-		time.Sleep(1000 * time.Millisecond)
-		execInspect, err = cli.ContainerExecInspect(ctx, response.ID)
-		fmt.Printf("ContainerExecInspect >> pid[%d]running[%t]\n", execInspect.Pid, execInspect.Running)
-	}
-	return nil
-}
 func uploadFile(w http.ResponseWriter, r *http.Request) {
+        account := accountOf(r)
+        if err := accountAdmit(account, 1); err != nil {
+                accountError(w, err)
+                return
+        }
         // Maximum upload of 16 MB files
         r.ParseMultipartForm(16 << 20)
 
@@ -679,7 +908,8 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
         // fmt.Printf("MIME Header: %+v\n", handler.Header)
 
         // Create file
-        dst, err := os.Create("/files/upload/" + handler.Filename)
+        fn := accountDir(config.Paths.Upload, account) + "/" + filepath.Base(handler.Filename)
+        dst, err := os.Create(fn)
         defer dst.Close()
         if err != nil {
                 http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -694,11 +924,15 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 
         fmt.Printf("Successfully Uploaded File [%s] size[%d]\n", handler.Filename, handler.Size)
         fmt.Fprintf(w, "Successfully Uploaded File [%s] size[%d]\n", handler.Filename, handler.Size)
-	err = dockerExecSendFax(handler.Filename)
+	job := FaxJob{Id: uuid.NewString(), Account: account, Request: faxDefaultRequest(), Document: fn}
+	err = faxJobCreate(&job)
         if err != nil {
                 http.Error(w, err.Error(), http.StatusInternalServerError)
                 return
         }
+	go faxJobRun(job.Id)
+	fmt.Fprintf(w, "fax job [%s] progress on /faxes/%s/events\n", job.Id, job.Id)
+	faxUploadProgress(w, r, job)
 }
 
 
@@ -718,14 +952,22 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 func cmdExec(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	s := r.FormValue("cmd")
-	uuid, err := cmdCreate(s, &cmdQ, "")
+	uuid, err := cmdCreate(s, cmdQ, "", accountOf(r))
+	if errors.Is(err, errQuota) {
+		accountError(w, err)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError )
 		return
 	}
+	queued := ""
+	if position := cmdQ.Position(uuid); position > 0 {
+		queued = fmt.Sprintf(" (queued, position %d)", position)
+	}
 	w.WriteHeader(200)
-	w.Write([]byte("<html><a href=\"http://"+os.Getenv("LOCAL_IP")+":8080/res?id="+uuid+"\">check report for "+uuid+"</a></html>"))
-	fmt.Printf("adding command to the queue uuid:%s \n", uuid)
+	w.Write([]byte("<html><a href=\"http://"+config.Net.LocalIp+":8080/res?id="+uuid+"\">check report for "+uuid+"</a>"+queued+"</html>"))
+	fmt.Printf("adding command to the queue uuid:%s%s\n", uuid, queued)
 	return
 }
 
@@ -787,14 +1029,14 @@ func statsUpdate(s *Stat, latency int32) {
 }
 
 func resProcessResultFile(fn string, report *Report) (error) {
-	file, err := os.Open("/output/"+fn)
+	file, err := os.Open(fn)
 	if err != nil {
 		fmt.Printf("error opening result file [%s]\n", err)
 		return err;
 	}
 	defer file.Close()
 
-	fi, err := os.Stat("/output/"+fn)
+	fi, err := os.Stat(fn)
 	if err != nil {
 		return err
 	}
@@ -853,8 +1095,9 @@ func resProcessResultFile(fn string, report *Report) (error) {
 				report.AvgDuration = float32(report.Duration/report.Calls)
 			}
 
+			testReport.Account = report.Account
 			reportJson, _ := json.Marshal(testReport)
-			rmqPublish(string(reportJson), os.Getenv("RMQ_PUB_KEY_DETAILS"))
+			rmqPublish(string(reportJson), config.Rmq.PubKeyDetails)
 		}
 	}
 
@@ -865,8 +1108,9 @@ func resProcessResultFile(fn string, report *Report) (error) {
 	return nil
 }
 
-func cleanUp(uuid string) (error) {
-	entries, err := os.ReadDir("/output")
+func cleanUp(uuid string, account string) (error) {
+	dir := accountOutputDir(account)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		fmt.Printf("error opening result directory [%s]\n", err)
 		return err
@@ -878,7 +1122,7 @@ func cleanUp(uuid string) (error) {
 		}
 		if  s[len(s)-5:] == ".json" && strings.Contains(s, uuid) {
 			fmt.Printf("cleanUp: %s\n",s)
-			e := os.Remove("/output/"+s)
+			e := os.Remove(filepath.Join(dir, s))
 			if e != nil {
 				fmt.Printf("file cleanup error [%s][%s]\n", s, e)
 				return e
@@ -888,10 +1132,14 @@ func cleanUp(uuid string) (error) {
 	return nil
 }
 
-func resGetReport(uuid string) (string, error) {
+// resGetReport reads the results of the command in the directory of the account.
+func resGetReport(uuid string, account string) (string, error) {
 	var report Report
 	report.Uuid = uuid
-	entries, err := os.ReadDir("/output")
+	report.Account = account
+	report.Cancelled = cmdJobCancelled(uuid)
+	dir := accountOutputDir(account)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		fmt.Printf("error opening result directory [%s]\n", err)
 		return "", err
@@ -903,7 +1151,7 @@ func resGetReport(uuid string) (string, error) {
 		}
 		if  s[len(s)-5:] == ".json" && strings.Contains(s, uuid) {
 			fmt.Printf("resGetReport: %s\n",s)
-			err := resProcessResultFile(s, &report)
+			err := resProcessResultFile(filepath.Join(dir, s), &report)
 			if err != nil {
 				return "", err
 			}
@@ -931,7 +1179,16 @@ func resHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Println("id =>", uuid)
 
-	report, err := resGetReport(uuid)
+	// the admin key reads the results of any account
+	account := accountOf(r)
+	if account == ACCOUNT_ADMIN {
+		account = r.URL.Query().Get("account")
+		if account != "" && !accountIdRe.MatchString(account) {
+			http.Error(w, "invalid account", http.StatusBadRequest)
+			return
+		}
+	}
+	report, err := resGetReport(uuid, account)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -945,7 +1202,8 @@ func cmdExecCall(CallsParams []CallParams) (error) {
 	portSip := CallsParams[0].PortSip
 	portRtp := CallsParams[0].PortRtp
 	idx := CallsParams[0].Idx
-	fmt.Printf(">>>> idx:%d\n", idx)
+	batch := CallsParams[0].Batch
+	fmt.Printf(">>>> idx:%d batch:%d\n", idx, batch)
 	ipAddr := CallsParams[0].IpAddr
 	boundAddr := CallsParams[0].BoundAddr
 	callCount := 0
@@ -996,11 +1254,16 @@ func cmdExecCall(CallsParams []CallParams) (error) {
 	`, xmlActions, (waitDuration + 30)*1000)
 	fmt.Printf("%s\n", xml)
 
-	err := createXmlFile(uuid, idx, xml)
+	account := CallsParams[0].Account
+	err := createXmlFile(uuid, account, idx, batch, xml)
 	if err != nil {
+		cmdJobState(uuid, CMD_JOB_FAILED, err.Error())
+		cmdDecCallLeft(uuid, callCount)
+		portsFreeSipPort(portSip)
+		portsFreeRtpPort(portRtp)
 		return err
 	}
-	err = cmdDockerExec(uuid, idx, callCount, portSip, portRtp, ipAddr, boundAddr)
+	err = cmdDockerExec(uuid, account, idx, batch, callCount, portSip, portRtp, ipAddr, boundAddr)
 	if err != nil {
 		return err
 	}
@@ -1021,61 +1284,92 @@ func rmqTest() {
        "count": 2,
        "duration": 10
     }
-}`, os.Getenv("VP_SERVER_IP"), os.Getenv("VP_SERVER_PORT"))
-	go rmqPublish(body, os.Getenv("RMQ_SUB_KEY_COMMAND"));
+}`, config.Vp.ServerIp, strconv.Itoa(config.Vp.ServerPort))
+	go rmqPublish(body, config.Rmq.SubKeyCommand);
 }
 
 func cmdRunner() {
 	fmt.Printf("runner reading command queue\n")
 	for {
-		if len(cmdQ) > 0 {
-			cmd := cmdQ[len(cmdQ)-1]
-			if count + totalActiveCalls > maxCalls {
-				fmt.Printf("too many active calls, skipping queue %d > %d (max calls) \n", count, maxCalls)
-			}
-			cmdQ = cmdQ[:len(cmdQ)-1]
-			fmt.Printf("cmd: %v\n", cmd)
-			cmdMakeCalls(cmd)
-			fmt.Printf("getting command from the queue uuid:%s \n", cmd.Uuid)
-			// for cmdIsCallsLeft(cmd.Uuid) {
-			if runnersActive() {
-				time.Sleep(500 * time.Millisecond)
-			}
-		} else {
-			time.Sleep(500 * time.Millisecond)
-		}
+		// waits until the calls of the next command fit under maxCalls
+		cmd := cmdQ.Pop()
+		cmdJobState(cmd.Uuid, CMD_JOB_RUNNING, "")
+		fmt.Printf("getting command from the queue uuid:%s priority[%d] total_active_calls[%d]\n",
+		           cmd.Uuid, cmd.Priority, cmdActiveCallsCount())
+		fmt.Printf("cmd: %v\n", cmd)
+		cmdMakeCalls(cmd)
 	}
 }
 
 func main() {
 	version := "0.0.0"
-	cmdQ = make([]Cmd, 0)
 	cmdCallLeftCount = make(map[string]int)
-	go rmqSubscribe(&cmdQ, os.Getenv("RMQ_SUB_Q_CUSTOMER"));
-	go rmqSubscribe(&cmdQ, os.Getenv("RMQ_SUB_Q_PROVIDER"));
+	cmdCallLeftAccount = make(map[string]string)
+	cmdCallLeftActive = make(map[string]int)
 
-	maxCalls = 20
-	if len(os.Args) < 2 {
-		fmt.Printf("Missing argument %d\n", len(os.Args))
-		return
+	e := configLoad(os.Args[1:])
+	if e != nil {
+		fmt.Printf("%s\n", e)
+		os.Exit(1)
 	}
-	port, e := strconv.Atoi(os.Args[1])
+	maxCalls = config.MaxCalls
+	templatesInit()
+	e = portsInit(uint16(config.Ports.SipStart), uint16(config.Ports.SipEnd),
+	              uint16(config.Ports.RtpStart), uint16(config.Ports.RtpEnd))
 	if e != nil {
-		fmt.Printf("Invalid argument port %s\n", os.Args[1])
-		return
+		fmt.Printf("%s\n", e)
+		os.Exit(1)
 	}
+	go rmqSubscribe(cmdQ, config.Rmq.SubQCustomer);
+	go rmqSubscribe(cmdQ, config.Rmq.SubQProvider);
 
 	// Upload route
-	http.HandleFunc("/cmd", cmdHandler)
-	http.HandleFunc("/res", resHandler)
-        http.HandleFunc("/upload", uploadHandler)
+	http.HandleFunc("/cmd", accountAuth(cmdHandler))
+	http.HandleFunc("/res", accountAuth(resHandler))
+	http.HandleFunc("/queue", accountAuth(cmdQueueHandler))
+	http.HandleFunc("/jobs", accountAuth(cmdJobsHandler))
+	http.HandleFunc("/jobs/", accountAuth(cmdJobsHandler))
+	http.HandleFunc("/upload", accountAuth(uploadHandler))
+	http.HandleFunc("/faxes", accountAuth(faxesHandler))
+	http.HandleFunc("/faxes/", accountAuth(faxHandler))
+	http.HandleFunc("/faxes/inbound", accountAuth(faxInboundHandler))
+	http.HandleFunc("/faxes/inbound/", accountAuth(faxInboundHandler))
+	http.HandleFunc("/faxes/covers", accountAuth(faxCoversHandler))
+	http.HandleFunc("/faxes/covers/", accountAuth(faxCoversHandler))
+	http.HandleFunc("/faxes/broadcasts", accountAuth(faxBroadcastsHandler))
+	http.HandleFunc("/faxes/broadcasts/", accountAuth(faxBroadcastsHandler))
+	http.HandleFunc("/webhooks", accountAuth(webhooksHandler))
+	http.HandleFunc("/webhooks/", accountAuth(webhooksHandler))
+	http.HandleFunc("/mailboxes", accountAuth(mailboxesHandler))
+	http.HandleFunc("/mailboxes/", accountAuth(mailboxesHandler))
+	http.HandleFunc("/routes", accountAuth(faxRoutesHandler))
+	http.HandleFunc("/routes/", accountAuth(faxRoutesHandler))
+	http.HandleFunc("/accounts", accountAuth(accountsHandler))
+	http.HandleFunc("/accounts/", accountAuth(accountsHandler))
+	http.HandleFunc("/config", accountAuth(configHandler))
+	// called by FreeSWITCH mod_xml_curl
+	http.HandleFunc("/dialplan", faxDialplanHandler)
 
 	// http.HandleFunc("/download", downloadHandler)
 
-	go cmdRunner()
+	e = faxStoreOpen(config.Paths.Db)
+	if e != nil {
+		fmt.Printf("fax store error [%s]\n", e)
+		return
+	}
+	defer faxDb.Close()
 
-	fmt.Printf("version[%s] Listen on port %d\n", version, port)
-	e = http.ListenAndServe(":"+os.Args[1], nil)
+	go cmdRunner()
+	go eslRun()
+	go faxInboundRun()
+	go smtpRun()
+	faxJobsResume()
+	faxBroadcastsResume()
+	webhookResume()
+	mailResume()
+
+	fmt.Printf("version[%s] Listen on port %d config[%s]\n", version, config.Port, configFile)
+	e = http.ListenAndServe(":"+strconv.Itoa(config.Port), nil)
 	if e != nil {
 		fmt.Printf("ListenAndServe: %s\n", e)
 	}
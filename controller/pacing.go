@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Call pacing of a command, Cmd.Cps calls per second shared by all the
+// voip_patrol execs of the command, a token bucket filled at the rate of the
+// ramp profile :
+//   linear : from ramp.start cps to Cps over ramp.duration seconds
+//   step   : ramp.steps equal steps from ramp.start to Cps over ramp.duration
+//   burst  : Cps, plus ramp.burst calls at once every ramp.interval seconds
+// With ramp.hold the command sends for hold seconds after the ramp, the calls
+// not made by then are dropped.
+
+const CMD_RAMP_LINEAR = "linear"
+const CMD_RAMP_STEP = "step"
+const CMD_RAMP_BURST = "burst"
+
+const CMD_PACE_MAX_BATCH = 50 // calls of one voip_patrol exec, as without pacing
+const CMD_PACE_CALL_SETUP = 10 // seconds of a call before its duration, ringing included
+
+type CmdRamp struct {
+	Profile  string  `json:"profile"`
+	Start    float64 `json:"start"`    // linear, step: cps at the start
+	Duration int     `json:"duration"` // linear, step: seconds to reach Cps
+	Steps    int     `json:"steps"`    // step
+	Burst    int     `json:"burst"`    // burst: calls of a burst
+	Interval int     `json:"interval"` // burst: seconds between bursts
+	Hold     int     `json:"hold"`     // seconds at Cps after the ramp, 0 until all calls are made
+}
+
+type CmdPacer struct {
+	mu     sync.Mutex
+	cps    float64
+	ramp   CmdRamp
+	start  time.Time
+	last   time.Time
+	tokens float64
+	burst  int // calls of the bursts not launched yet
+	bursts int // bursts credited
+}
+
+func cmdPaceCheck(cmd *Cmd) error {
+	r := cmd.Ramp
+	if cmd.Cps < 0 {
+		return fmt.Errorf("invalid cps [%d]", cmd.Cps)
+	}
+	if r.Profile == "" && r.Hold == 0 {
+		return nil
+	}
+	if cmd.Cps == 0 {
+		return fmt.Errorf("ramp profile [%s] without cps", r.Profile)
+	}
+	if r.Hold < 0 || r.Start < 0 || r.Duration < 0 || r.Steps < 0 || r.Burst < 0 || r.Interval < 0 {
+		return fmt.Errorf("invalid ramp, negative value %+v", r)
+	}
+	switch r.Profile {
+	case "":
+	case CMD_RAMP_LINEAR:
+		if r.Duration == 0 || r.Start > float64(cmd.Cps) {
+			return fmt.Errorf("invalid linear ramp, expected a duration and start <= cps")
+		}
+	case CMD_RAMP_STEP:
+		if r.Duration == 0 || r.Steps == 0 || r.Start > float64(cmd.Cps) {
+			return fmt.Errorf("invalid step ramp, expected a duration, steps and start <= cps")
+		}
+	case CMD_RAMP_BURST:
+		if r.Burst == 0 || r.Interval == 0 {
+			return fmt.Errorf("invalid burst ramp, expected burst and interval")
+		}
+	default:
+		return fmt.Errorf("invalid ramp profile [%s], expected %s, %s or %s", r.Profile,
+		                  CMD_RAMP_LINEAR, CMD_RAMP_STEP, CMD_RAMP_BURST)
+	}
+	return nil
+}
+
+// cmdPacedCalls returns the calls of a paced command up at once, the calls
+// started during the longest call at the peak rate, false without cps or
+// when a call has no duration.
+func cmdPacedCalls(cmd *Cmd) (int, bool) {
+	if cmd.Cps == 0 {
+		return 0, false
+	}
+	duration := 0
+	for _, c := range cmd.Calls {
+		if c.Duration == 0 {
+			return 0, false
+		}
+		if c.Duration > duration {
+			duration = c.Duration
+		}
+	}
+	concurrent := cmd.Cps * (duration + CMD_PACE_CALL_SETUP)
+	if cmd.Ramp.Profile == CMD_RAMP_BURST {
+		concurrent += cmd.Ramp.Burst * ((duration + CMD_PACE_CALL_SETUP) / cmd.Ramp.Interval + 1)
+	}
+	if count := cmdCount(cmd); concurrent > count {
+		return count, true
+	}
+	return concurrent, true
+}
+
+// cmdConcurrentCalls returns the calls of the command counted against maxCalls
+// while it runs : the paced calls up at once, all of them otherwise.
+func cmdConcurrentCalls(cmd *Cmd) int {
+	if concurrent, ok := cmdPacedCalls(cmd); ok {
+		return concurrent
+	}
+	return cmdCount(cmd)
+}
+
+// cmdPacerNew returns nil when the command is not paced, the calls are then
+// launched in batches of 50 as they come.
+func cmdPacerNew(cmd Cmd) *CmdPacer {
+	if cmd.Cps == 0 {
+		return nil
+	}
+	now := time.Now()
+	p := &CmdPacer{cps: float64(cmd.Cps), ramp: cmd.Ramp, start: now, last: now}
+	if rate := p.rate(now); rate > 0 {
+		p.tokens = math.Max(1, rate) // the first second of calls leaves now
+	}
+	return p
+}
+
+// rate returns the calls per second at t.
+func (p *CmdPacer) rate(t time.Time) float64 {
+	elapsed := t.Sub(p.start).Seconds()
+	r := p.ramp
+	switch r.Profile {
+	case CMD_RAMP_LINEAR:
+		if elapsed < float64(r.Duration) {
+			return r.Start + (p.cps-r.Start)*elapsed/float64(r.Duration)
+		}
+	case CMD_RAMP_STEP:
+		if elapsed < float64(r.Duration) {
+			step := math.Floor(elapsed / (float64(r.Duration) / float64(r.Steps)))
+			return r.Start + (p.cps-r.Start)*step/float64(r.Steps)
+		}
+	}
+	return p.cps
+}
+
+// rampEnd returns the end of the ramp, the hold starts there.
+func (p *CmdPacer) rampEnd() time.Time {
+	if p.ramp.Profile == CMD_RAMP_LINEAR || p.ramp.Profile == CMD_RAMP_STEP {
+		return p.start.Add(time.Duration(p.ramp.Duration) * time.Second)
+	}
+	return p.start
+}
+
+// Done tells if the hold time is over.
+func (p *CmdPacer) Done() bool {
+	if p == nil || p.ramp.Hold == 0 {
+		return false
+	}
+	return time.Now().After(p.rampEnd().Add(time.Duration(p.ramp.Hold) * time.Second))
+}
+
+func (p *CmdPacer) fill(now time.Time) {
+	rate := p.rate(now)
+	p.tokens += rate * now.Sub(p.last).Seconds()
+	p.last = now
+	// at most one second of calls waiting, the rate holds over any second
+	if max := math.Max(1, rate); p.tokens > max {
+		p.tokens = max
+	}
+	if p.ramp.Profile == CMD_RAMP_BURST {
+		n := int(now.Sub(p.start).Seconds()) / p.ramp.Interval
+		if n > p.bursts {
+			p.burst += (n - p.bursts) * p.ramp.Burst
+			p.bursts = n
+		}
+	}
+}
+
+// Take waits until calls may leave and returns how many, at most max, the
+// calls of a burst first. The calls of one second leave together, one exec
+// per second rather than one per call.
+func (p *CmdPacer) Take(max int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		now := time.Now()
+		p.fill(now)
+		if p.burst > 0 {
+			n := p.burst
+			if n > max {
+				n = max
+			}
+			p.burst -= n
+			return n
+		}
+		rate := p.rate(now)
+		need := math.Min(float64(max), math.Max(1, math.Floor(rate)))
+		if p.tokens >= need {
+			n := int(p.tokens)
+			if n > max {
+				n = max
+			}
+			p.tokens -= float64(n)
+			return n
+		}
+		wait := time.Second
+		if rate > 0 {
+			wait = time.Duration((need - p.tokens) / rate * float64(time.Second))
+		}
+		if wait < 10*time.Millisecond {
+			wait = 10 * time.Millisecond
+		} else if wait > time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+	}
+}
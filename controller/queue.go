@@ -1,10 +1,198 @@
 package main
 
-import {
-    "errors"
-    "fmt"
-    "container/list"
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Command scheduler, the commands wait in one FIFO per priority level, the
+// highest level first. The command at the head is held until its calls fit
+// under maxCalls, commands behind it wait their turn so a large test is not
+// starved by smaller ones.
+
+const CMD_PRIORITY_MIN = 0
+const CMD_PRIORITY_MAX = 9
+
+type CmdQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	levels [CMD_PRIORITY_MAX+1]*list.List
+	held   string // uuid of the head command waiting for calls to end
+}
+
+type CmdQueued struct {
+	Uuid     string `json:"uuid"`
+	Type     string `json:"type"`
+	Priority int    `json:"priority"`
+	Calls    int    `json:"calls"`
+	Position int    `json:"position"` // 1 is the next command to run
+	Account  string `json:"account,omitempty"`
+}
+
+func cmdQueueNew() *CmdQueue {
+	q := new(CmdQueue)
+	q.cond = sync.NewCond(&q.mu)
+	for i := range q.levels {
+		q.levels[i] = list.New()
+	}
+	return q
+}
+
+// cmdCount returns the number of calls of the command.
+func cmdCount(cmd *Cmd) int {
+	count := 0
+	for i := 0; i < len(cmd.Calls); i++ {
+		if cmd.Calls[i].Count == 0 {
+			count++
+		} else {
+			count = count + cmd.Calls[i].Count
+		}
+	}
+	return count
+}
+
+func cmdPriorityCheck(priority int) error {
+	if priority < CMD_PRIORITY_MIN || priority > CMD_PRIORITY_MAX {
+		return fmt.Errorf("invalid priority [%d], expected %d to %d", priority, CMD_PRIORITY_MIN, CMD_PRIORITY_MAX)
+	}
+	return nil
+}
+
+// Push adds the command at the end of its priority level, checked with
+// cmdPriorityCheck, and returns its position in the queue.
+func (q *CmdQueue) Push(cmd Cmd) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.levels[cmd.Priority].PushBack(cmd)
+	q.cond.Broadcast()
+	return q.position(cmd.Uuid)
+}
+
+func (q *CmdQueue) front() *list.Element {
+	for i := CMD_PRIORITY_MAX; i >= CMD_PRIORITY_MIN; i-- {
+		if e := q.levels[i].Front(); e != nil {
+			return e
+		}
+	}
+	return nil
 }
 
+// Pop waits for a command and for its calls to fit under maxCalls, the calls
+// are counted as active before it is returned.
+func (q *CmdQueue) Pop() Cmd {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		e := q.front()
+		if e == nil {
+			q.cond.Wait()
+			continue
+		}
+		cmd := e.Value.(Cmd)
+		count := cmdConcurrentCalls(&cmd)
+		if !cmdActiveCallsAdd(cmd.Uuid, count) {
+			if q.held != cmd.Uuid {
+				q.held = cmd.Uuid
+				fmt.Printf("too many active calls, holding queue uuid[%s] %d + %d > %d (max calls)\n",
+				           cmd.Uuid, count, cmdActiveCallsCount(), maxCalls)
+				q.log()
+			}
+			q.cond.Wait()
+			continue
+		}
+		q.held = ""
+		q.levels[cmd.Priority].Remove(e)
+		return cmd
+	}
+}
+
+// Signal wakes up the runner, calls ended or the limit changed.
+func (q *CmdQueue) Signal() {
+	q.mu.Lock()
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// Remove drops a waiting command, false when it is not in the queue.
+func (q *CmdQueue) Remove(uuid string) (Cmd, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, l := range q.levels {
+		for e := l.Front(); e != nil; e = e.Next() {
+			if cmd := e.Value.(Cmd); cmd.Uuid == uuid {
+				l.Remove(e)
+				q.cond.Broadcast()
+				return cmd, true
+			}
+		}
+	}
+	return Cmd{}, false
+}
+
+func (q *CmdQueue) position(uuid string) int {
+	n := 0
+	for i := CMD_PRIORITY_MAX; i >= CMD_PRIORITY_MIN; i-- {
+		for e := q.levels[i].Front(); e != nil; e = e.Next() {
+			n++
+			if e.Value.(Cmd).Uuid == uuid {
+				return n
+			}
+		}
+	}
+	return 0
+}
 
+// Position returns the position of the command in the queue, 0 when it is
+// not waiting.
+func (q *CmdQueue) Position(uuid string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.position(uuid)
+}
 
+// List returns the waiting commands in the order they run.
+func (q *CmdQueue) List() []CmdQueued {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.list()
+}
+
+func (q *CmdQueue) list() []CmdQueued {
+	res := []CmdQueued{}
+	for i := CMD_PRIORITY_MAX; i >= CMD_PRIORITY_MIN; i-- {
+		for e := q.levels[i].Front(); e != nil; e = e.Next() {
+			cmd := e.Value.(Cmd)
+			res = append(res, CmdQueued{cmd.Uuid, cmd.Type, cmd.Priority, cmdCount(&cmd), len(res)+1, cmd.Account})
+		}
+	}
+	return res
+}
+
+func (q *CmdQueue) log() {
+	for _, c := range q.list() {
+		fmt.Printf("queue position[%d] uuid[%s] priority[%d] calls[%d]\n", c.Position, c.Uuid, c.Priority, c.Calls)
+	}
+}
+
+// cmdQueueHandler serves GET /queue, the waiting commands with their
+// position, an account key only sees the commands of its account.
+func cmdQueueHandler(w http.ResponseWriter, r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	m := "queue"
+	fmt.Printf("[%s] %s...\n", ua, m)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res := []CmdQueued{}
+	for _, c := range cmdQ.List() {
+		if accountVisible(r, c.Account) {
+			res = append(res, c)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
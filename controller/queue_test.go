@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// queueTestCalls starts the calls accounting with max calls, it is put back
+// after the test.
+func queueTestCalls(t *testing.T, max int) {
+	oldMax, oldCount, oldAccount, oldActive, oldTotal := maxCalls, cmdCallLeftCount, cmdCallLeftAccount,
+	                                                    cmdCallLeftActive, totalActiveCalls
+	maxCalls = max
+	cmdCallLeftCount = make(map[string]int)
+	cmdCallLeftAccount = make(map[string]string)
+	cmdCallLeftActive = make(map[string]int)
+	totalActiveCalls = 0
+	t.Cleanup(func() {
+		maxCalls, cmdCallLeftCount, cmdCallLeftAccount, cmdCallLeftActive, totalActiveCalls = oldMax, oldCount,
+		oldAccount, oldActive, oldTotal
+	})
+}
+
+func TestCmdPacedCalls(t *testing.T) {
+	cases := []struct {
+		cmd        Cmd
+		concurrent int
+		paced      bool
+	}{
+		{Cmd{Calls: []Call{{Count: 100}}}, 0, false},
+		{Cmd{Cps: 2, Calls: []Call{{Count: 100}}}, 0, false}, // no duration
+		{Cmd{Cps: 2, Calls: []Call{{Count: 100, Duration: 5}}}, 30, true},
+		{Cmd{Cps: 20, Calls: []Call{{Count: 100, Duration: 30}}}, 100, true},
+	}
+	for _, c := range cases {
+		concurrent, paced := cmdPacedCalls(&c.cmd)
+		if concurrent != c.concurrent || paced != c.paced {
+			t.Errorf("%+v: %d %t, expected %d %t", c.cmd, concurrent, paced, c.concurrent, c.paced)
+		}
+	}
+}
+
+func TestCmdCreateLarge(t *testing.T) {
+	queueTestCalls(t, 20)
+	// paced calls up at once over max calls never fit
+	if _, err := cmdCreate(`{"cps":20,"calls":[{"destination":"sip:1@127.0.0.1","count":100,"duration":30}]}`,
+	                       cmdQueueNew(), "test", ACCOUNT_ADMIN); err == nil {
+		t.Fatalf("paced command over max calls accepted")
+	}
+}
+
+func TestCmdActiveCallsLarge(t *testing.T) {
+	queueTestCalls(t, 20)
+	// a command larger than max calls holds all of them
+	oldQ := cmdQ
+	cmdQ = cmdQueueNew()
+	t.Cleanup(func() { cmdQ = oldQ })
+	cmdIncCallLeft("large", ACCOUNT_ADMIN, 100)
+	if !cmdActiveCallsAdd("large", 100) {
+		t.Fatalf("large command not admitted with nothing running")
+	}
+	if n := cmdActiveCallsCount(); n != 20 {
+		t.Fatalf("%d active calls, expected 20", n)
+	}
+	cmdIncCallLeft("small", ACCOUNT_ADMIN, 1)
+	if cmdActiveCallsAdd("small", 1) {
+		t.Fatalf("command admitted next to the large one")
+	}
+
+	// the next batch waits for the calls of the first one to end
+	done := make(chan bool)
+	go func() {
+		cmdBatchWait("large", 100, 20, 20)
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatalf("batch sent over max calls")
+	case <-time.After(100 * time.Millisecond):
+	}
+	cmdDecCallLeft("large", 20) // the first batch ended
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("batch still waiting after the calls ended")
+	}
+
+	// the slots are released when the calls left go under max calls
+	cmdDecCallLeft("large", 60)
+	if n := cmdActiveCallsCount(); n != 20 {
+		t.Fatalf("%d active calls with 20 calls left, expected 20", n)
+	}
+	cmdDecCallLeft("large", 10)
+	if n := cmdActiveCallsCount(); n != 10 {
+		t.Fatalf("%d active calls, expected 10", n)
+	}
+	if !cmdActiveCallsAdd("small", 1) {
+		t.Fatalf("command not admitted under max calls")
+	}
+}
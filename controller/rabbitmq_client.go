@@ -4,18 +4,17 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"os"
 	"time"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // func rmqPublish(queue string, report string, key string) {
 func rmqPublish(report string, key string) {
-	rmqIp := os.Getenv("RMQ_IP")
-	rmqUsername := os.Getenv("RMQ_USERNAME")
-	rmqPassword := os.Getenv("RMQ_PASSWORD")
+	rmqIp := config.Rmq.Ip
+	rmqUsername := config.Rmq.Username
+	rmqPassword := config.Rmq.Password
 	rmq := "amqp://"+rmqUsername+":"+rmqPassword+"@"+rmqIp+":5672/"
-	fmt.Printf("rmqPublish [%s] exchange[%s] key[%s]", rmq, os.Getenv("RMQ_PUB_EXCHANGE"), key)
+	fmt.Printf("rmqPublish [%s] exchange[%s] key[%s]", rmq, config.Rmq.PubExchange, key)
 	conn, err := amqp.Dial(rmq)
 	if err != nil {
 		fmt.Printf("error [%s]\n", err.Error())
@@ -32,7 +31,7 @@ func rmqPublish(report string, key string) {
 	defer cancel()
 
 	err = ch.PublishWithContext(ctx,
-		os.Getenv("RMQ_PUB_EXCHANGE"), // exchange
+		config.Rmq.PubExchange, // exchange
 		key,    // routing key
 		false,  // mandatory
 		false,  // immediate
@@ -46,10 +45,10 @@ func rmqPublish(report string, key string) {
 	fmt.Printf(" [x] Sent %s\n", report)
 }
 
-func rmqSubscribe(cmdQ *[]Cmd, q string) {
-	rmqIp := os.Getenv("RMQ_IP")
-	rmqUsername := os.Getenv("RMQ_USERNAME")
-	rmqPassword := os.Getenv("RMQ_PASSWORD")
+func rmqSubscribe(cmdQ *CmdQueue, q string) {
+	rmqIp := config.Rmq.Ip
+	rmqUsername := config.Rmq.Username
+	rmqPassword := config.Rmq.Password
 	rmq := "amqp://"+rmqUsername+":"+rmqPassword+"@"+rmqIp+":5672/"
 	fmt.Printf("rmq consumer [%s]queue[%s]\n", rmq, q)
 	conn, err := amqp.Dial(rmq)
@@ -92,9 +91,15 @@ func rmqSubscribe(cmdQ *[]Cmd, q string) {
 	go func() {
 		for d := range msgs {
 			fmt.Printf("command message received: %s\n", d.Body)
-			_, err := cmdCreate(string(d.Body[:]), cmdQ, context)
+			if uuid, ok := cmdCancelMessage(d.Body); ok {
+				if _, err := cmdJobCancel(uuid, "cancelled by message"); err != nil {
+					fmt.Printf("cancel message error [%s]\n", err)
+				}
+				continue
+			}
+			_, err := cmdCreate(string(d.Body[:]), cmdQ, context, ACCOUNT_ADMIN)
 			if err != nil {
-				fmt.Printf("cmdCreate: message received error:", err)
+				fmt.Printf("cmdCreate: message received error [%s]\n", err)
 			}
 		}
 	} ()
@@ -20,12 +20,18 @@ export SIP_PORT_INTERNAL=${SIP_PORT_INTERNAL}
 export TLS_PORT_INTERNAL=${TLS_PORT_INTERNAL}
 export RTP_START_PORT=${RTP_START_PORT}
 export RTP_END_PORT=${RTP_END_PORT}
+export XML_CURL_URL=${XML_CURL_URL}
+export XML_CURL_SECRET=${XML_CURL_SECRET}
 
 dockerize -timeout 120s -template /usr/local/freeswitch/conf/autoload_configs/event_socket.conf.xml.tmpl:/usr/local/freeswitch/conf/autoload_configs/event_socket.conf.xml \
 	 -template /usr/local/freeswitch/conf/vars.xml.tmpl:/usr/local/freeswitch/conf/vars.xml \
 	 -template /usr/local/freeswitch/conf/sip_profiles/external.xml.tmpl:/usr/local/freeswitch/conf/sip_profiles/external.xml \
 	 -template /usr/local/freeswitch/conf/sip_profiles/internal.xml.tmpl:/usr/local/freeswitch/conf/sip_profiles/internal.xml \
-	 -template /usr/local/freeswitch/conf/autoload_configs/switch.conf.xml.tmpl:/usr/local/freeswitch/conf/autoload_configs/switch.conf.xml
+	 -template /usr/local/freeswitch/conf/autoload_configs/switch.conf.xml.tmpl:/usr/local/freeswitch/conf/autoload_configs/switch.conf.xml \
+	 -template /usr/local/freeswitch/conf/autoload_configs/xml_curl.conf.xml.tmpl:/usr/local/freeswitch/conf/autoload_configs/xml_curl.conf.xml
+
+# received faxes, see 00_inbound_did.xml and the routes of the controller
+mkdir -p /files/inbound
 
 # CMD="tail -f /dev/null"
 if [ "$1" = "" ]; then
@@ -22,6 +22,7 @@ docker run -d --net=host \
               -e TLS_PORT_INTERNAL=7041 \
               -e RTP_START_PORT=12000 \
               -e RTP_END_PORT=12999 \
+              -e XML_CURL_URL=http://127.0.0.1:8090/dialplan \
               --log-driver syslog \
               --log-opt tag="{{.Name}}" \
               --restart unless-stopped \